@@ -0,0 +1,177 @@
+package cachefunk
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AutoCleanupCache wraps another Cache and runs Cleanup when enough of its entries have expired.
+// Every SampleEvery sets, the ratio of ExpiredEntryCount to EntryCount is sampled
+// and Cleanup is triggered if it is at least Ratio. Only one automatic cleanup runs at a time.
+// AutoCleanupCache is safe for concurrent use when the wrapped cache is.
+type AutoCleanupCache struct {
+	Cache       Cache
+	Ratio       float64
+	SampleEvery int
+	// Async runs automatic cleanups in a worker goroutine instead of in the Set that triggered them,
+	// skipping the cleanup if no worker is free, see MaxWorkers. Only enable it for caches that are
+	// safe for concurrent use such as GORMCache, SQLiteCache and ReadMostlyCache, not InMemoryCache
+	Async    bool
+	setCount atomic.Int64
+	// cleanupMutex is held while an automatic cleanup runs, from the Set that starts it
+	cleanupMutex sync.Mutex
+	lastCleanup  atomic.Pointer[CleanupResult]
+}
+
+func NewAutoCleanupCache(inner Cache, ratio float64, sampleEvery int) *AutoCleanupCache {
+	if sampleEvery <= 0 {
+		sampleEvery = 1
+	}
+	cache := AutoCleanupCache{
+		Cache:       inner,
+		Ratio:       ratio,
+		SampleEvery: sampleEvery,
+	}
+	return &cache
+}
+
+// LastCleanup returns the result of the most recent automatic cleanup
+func (c *AutoCleanupCache) LastCleanup() CleanupResult {
+	if result := c.lastCleanup.Load(); result != nil {
+		return *result
+	}
+	return CleanupResult{}
+}
+
+// Wait blocks until a running automatic cleanup has finished
+func (c *AutoCleanupCache) Wait() {
+	c.cleanupMutex.Lock()
+	defer c.cleanupMutex.Unlock()
+}
+
+// maybeCleanup samples the expired entry ratio every SampleEvery sets
+func (c *AutoCleanupCache) maybeCleanup() {
+	sampleEvery := int64(c.SampleEvery)
+	if sampleEvery <= 0 {
+		sampleEvery = 1
+	}
+	if c.setCount.Add(1)%sampleEvery != 0 {
+		return
+	}
+	// a cleanup that is already running will remove the entries this sample would find
+	if !c.cleanupMutex.TryLock() {
+		return
+	}
+	if !c.Async {
+		c.sampleAndCleanup()
+	} else if !c.GetConfig().goWorker(c.sampleAndCleanup) {
+		c.cleanupMutex.Unlock()
+	}
+}
+
+// sampleAndCleanup runs Cleanup if the ratio of expired entries is at least Ratio,
+// unlocking cleanupMutex when it is done
+func (c *AutoCleanupCache) sampleAndCleanup() {
+	defer c.cleanupMutex.Unlock()
+	total := c.Cache.EntryCount()
+	if total == 0 {
+		return
+	}
+	expired := c.Cache.ExpiredEntryCount()
+	if float64(expired)/float64(total) >= c.Ratio {
+		result := c.Cache.CleanupWithResult()
+		c.lastCleanup.Store(&result)
+	}
+}
+
+func (c *AutoCleanupCache) SetConfig(config *CacheFunkConfig) {
+	c.Cache.SetConfig(config)
+}
+
+func (c *AutoCleanupCache) GetConfig() *CacheFunkConfig {
+	return c.Cache.GetConfig()
+}
+
+func (c *AutoCleanupCache) GetIgnoreCacheCtxKey() interface{} {
+	return c.Cache.GetIgnoreCacheCtxKey()
+}
+
+func (c *AutoCleanupCache) Get(key string, params string) ([]byte, bool) {
+	return c.Cache.Get(key, params)
+}
+
+func (c *AutoCleanupCache) GetWithInfo(key string, params string) ([]byte, EntryInfo, bool) {
+	return c.Cache.GetWithInfo(key, params)
+}
+
+func (c *AutoCleanupCache) GetMany(key string, paramsList []string) map[string][]byte {
+	return c.Cache.GetMany(key, paramsList)
+}
+
+func (c *AutoCleanupCache) Set(key string, params string, value []byte) {
+	c.Cache.Set(key, params, value)
+	c.maybeCleanup()
+}
+
+func (c *AutoCleanupCache) SetMany(key string, values map[string][]byte) {
+	c.Cache.SetMany(key, values)
+	c.maybeCleanup()
+}
+
+func (c *AutoCleanupCache) SetRaw(key string, params string, value []byte, timestamp time.Time, isCompressed bool) {
+	c.Cache.SetRaw(key, params, value, timestamp, isCompressed)
+	c.maybeCleanup()
+}
+
+func (c *AutoCleanupCache) KeyEntries(key string) []EntryInfo {
+	return c.Cache.KeyEntries(key)
+}
+
+func (c *AutoCleanupCache) Iterate(fn func(key string, params string, timestamp time.Time) bool) error {
+	return c.Cache.Iterate(fn)
+}
+
+func (c *AutoCleanupCache) EntryCount() int64 {
+	return c.Cache.EntryCount()
+}
+
+func (c *AutoCleanupCache) ExpiredEntryCount() int64 {
+	return c.Cache.ExpiredEntryCount()
+}
+
+func (c *AutoCleanupCache) Clear() {
+	c.Cache.Clear()
+}
+
+func (c *AutoCleanupCache) ClearKey(key string) {
+	c.Cache.ClearKey(key)
+}
+
+func (c *AutoCleanupCache) Delete(key string, params string) {
+	c.Cache.Delete(key, params)
+}
+
+func (c *AutoCleanupCache) Cleanup() {
+	c.Cache.Cleanup()
+}
+
+func (c *AutoCleanupCache) CleanupWithResult() CleanupResult {
+	return c.Cache.CleanupWithResult()
+}
+
+// Close waits for a running automatic cleanup, then closes the wrapped cache if it implements ClosableCache
+func (c *AutoCleanupCache) Close() error {
+	c.Wait()
+	return Close(c.Cache)
+}
+
+// CleanupBatch cleans up the wrapped cache, see the CleanupBatch function
+func (c *AutoCleanupCache) CleanupBatch(maxDeletes int) CleanupResult {
+	return CleanupBatch(c.Cache, maxDeletes)
+}
+
+// ForceCleanup force cleans the wrapped cache, see the ForceCleanup function
+func (c *AutoCleanupCache) ForceCleanup(key string, maxAge time.Duration) CleanupResult {
+	return ForceCleanup(c.Cache, key, maxAge)
+}
@@ -0,0 +1,89 @@
+package cachefunk_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rohfle/cachefunk"
+)
+
+func TestAutoCleanupCache(t *testing.T) {
+	inner := cachefunk.NewInMemoryCache()
+	cache := cachefunk.NewAutoCleanupCache(inner, 0.5, 2)
+
+	runTestWrapString(t, cache)
+	cache.Clear()
+	runTestWrapObject(t, cache)
+	cache.Clear()
+
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 60},
+		},
+	})
+
+	// 2 expired entries of 3 is over the ratio but only sampled every 2 sets
+	cache.SetRaw("hello", "1", []byte("old"), time.Time{}, false)
+	cache.SetRaw("hello", "2", []byte("old"), time.Time{}, false)
+	if count := cache.EntryCount(); count != 0 {
+		t.Fatalf("expected expired entries to be cleaned up after sampling but got %d entries", count)
+	}
+	if removed := cache.LastCleanup().Removed; removed != 2 {
+		t.Fatalf("expected last cleanup to remove %d entries got %d", 2, removed)
+	}
+
+	for i := 0; i < 4; i++ {
+		cache.Set("hello", fmt.Sprint("fresh", i), []byte("new"))
+	}
+	cache.SetRaw("hello", "3", []byte("old"), time.Time{}, false)
+	if count := cache.EntryCount(); count != 5 {
+		t.Fatalf("expected expired entry under ratio to remain but got %d entries", count)
+	}
+	if count := cache.ExpiredEntryCount(); count != 1 {
+		t.Fatalf("expected %d expired entry got %d", 1, count)
+	}
+}
+
+func TestAutoCleanupCacheAsync(t *testing.T) {
+	inner := cachefunk.NewReadMostlyCache()
+	inner.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 60},
+		},
+	})
+	cache := cachefunk.NewAutoCleanupCache(inner, 0.5, 10)
+	cache.Async = true
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				cache.SetRaw("hello", fmt.Sprint(i, "-", j), []byte("old"), time.Time{}, false)
+				cache.LastCleanup()
+			}
+		}(i)
+	}
+	wg.Wait()
+	cache.Wait()
+
+	// samples are skipped while a cleanup is running, so sample again once none are
+	for i := 0; i < 10; i++ {
+		cache.SetRaw("hello", fmt.Sprint("last-", i), []byte("old"), time.Time{}, false)
+	}
+	cache.Wait()
+
+	// every entry set is expired, so the cleanup after the last sample removes them all
+	if count := cache.EntryCount(); count != 0 {
+		t.Errorf("expected expired entries to be cleaned up got %d entries", count)
+	}
+	if removed := cache.LastCleanup().Removed; removed == 0 {
+		t.Error("expected the last cleanup to remove entries")
+	}
+	if err := cache.Close(); err != nil {
+		t.Errorf("unexpected error closing cache: %v", err)
+	}
+}
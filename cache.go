@@ -4,37 +4,415 @@ package cachefunk
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type CtxKey string
 
+// DEFAULT_IGNORE_CACHE_CTX_KEY is the context key caches store ignoreCache under by default
+// The IgnoreCacheCtxKey of a cache can be set to any comparable value instead, such as
+// a value of an unexported struct type, so that it cannot collide with keys set by other packages
 const DEFAULT_IGNORE_CACHE_CTX_KEY CtxKey = "ignoreCache"
 
+// CacheMode controls how the WithContext cache functions use the cache
+// Set it in the context under CacheModeCtxKey
+type CacheMode int
+
+const (
+	// CacheModeNormal returns cached values, retrieving and storing values that are not cached
+	CacheModeNormal CacheMode = iota
+	// CacheModeRefresh always retrieves and stores values, like setting ignoreCache
+	CacheModeRefresh
+	// CacheModeOnly only returns cached values, returning ErrNotCached instead of retrieving
+	CacheModeOnly
+	// CacheModeBypass always retrieves values without storing them
+	CacheModeBypass
+)
+
+// CacheModeCtxKey is the context key for the CacheMode, which takes priority over ignoreCache
+const CacheModeCtxKey CtxKey = "cacheMode"
+
+// CompressionCtxKey is the context key for a bool that overrides UseCompression
+// for values stored by the WithContext functions. Whether a value is compressed is stored
+// with each entry, so entries are read correctly whatever compression they were stored with.
+// EncryptedCache stores every value uncompressed, so the override has no effect on it.
+const CompressionCtxKey CtxKey = "compression"
+
 // Cache is an interface that supports get/set of values by key
 type Cache interface {
 	SetConfig(config *CacheFunkConfig)
+	// Get the config used by the cache
+	GetConfig() *CacheFunkConfig
 	// Get a value from the cache if it exists
 	Get(key string, params string) (value []byte, found bool)
+	// Get a value from the cache like Get, along with information about its entry
+	// If the entry has expired, found is false and info describes the expired entry
+	GetWithInfo(key string, params string) (value []byte, info EntryInfo, found bool)
+	// Get many values for a key from the cache, indexed by params
+	// Only values that exist and have not expired are returned
+	GetMany(key string, paramsList []string) map[string][]byte
 	// Set a value in the cache
 	Set(key string, params string, value []byte)
+	// Set many values for a key in the cache, indexed by params
+	SetMany(key string, values map[string][]byte)
 	// Set a raw value for key in the cache
 	SetRaw(key string, params string, value []byte, timestamp time.Time, isCompressed bool)
+	// Get information about every entry stored for key, including expired entries
+	KeyEntries(key string) []EntryInfo
+	// Call fn for every entry stored in the cache, including expired entries, until fn returns false
+	// Params are reported as in EntryInfo
+	Iterate(fn func(key string, params string, timestamp time.Time) bool) error
 	// Get the number of entries in the cache
 	EntryCount() int64
 	// Get how many entries have expired in the cache compared to cutoff
 	// entries expiry compared to utc now if cutoff is nil
+	// Entries of keys without a config or that never expire are not counted, see ForceCleanup
 	ExpiredEntryCount() int64
 	// Delete all entries in the cache
 	Clear()
+	// Delete all entries for key in the cache
+	ClearKey(key string)
+	// Delete the entry for key and params if it exists
+	Delete(key string, params string)
 	// Delete entries that have timestamps in cache before cutoff
 	// entries expiry compared to utc now if cutoff is nil
+	// Errors are ignored, use CleanupWithResult to check that cleanup is working
+	// Entries of keys without a config or that never expire are kept, see ForceCleanup
 	Cleanup()
+	// Delete expired entries like Cleanup, reporting how many were removed and any errors
+	CleanupWithResult() CleanupResult
 	// GetIgnoreCacheCtxKey returns Value key under which ignoreCache is stored
-	GetIgnoreCacheCtxKey() CtxKey
+	GetIgnoreCacheCtxKey() interface{}
+}
+
+// ContextCache is implemented by caches that can pass a context to their storage,
+// such as GORMCache and SQLiteCache, so queries are aborted when the context is done.
+// The WithContext cache functions use these methods when the cache implements them,
+// and the other functions call them with context.Background() through the Cache methods.
+// Decorators such as EncryptedCache do not implement ContextCache so the context is not passed through them.
+type ContextCache interface {
+	Cache
+	GetWithInfoContext(ctx context.Context, key string, params string) (value []byte, info EntryInfo, found bool)
+	SetContext(ctx context.Context, key string, params string, value []byte)
+	SetRawContext(ctx context.Context, key string, params string, value []byte, timestamp time.Time, isCompressed bool)
+}
+
+// PrefixCache is implemented by caches that can delete the entries of every key
+// starting with a prefix in one operation, such as GORMCache and SQLiteCache
+type PrefixCache interface {
+	Cache
+	ClearPrefix(prefix string) error
+}
+
+// BatchCleanupCache is implemented by caches that find their own expired entries for CleanupBatch,
+// such as DiskCache, which cannot report the params of its entries to Iterate
+type BatchCleanupCache interface {
+	Cache
+	CleanupBatch(maxDeletes int) CleanupResult
+}
+
+// ForceCleanupCache is implemented by caches that delete old entries of a key for ForceCleanup
+// themselves, such as DiskCache, which cannot report the params of its entries to Iterate
+type ForceCleanupCache interface {
+	Cache
+	ForceCleanup(key string, maxAge time.Duration) CleanupResult
+}
+
+// ClosableCache is implemented by caches that hold resources to release on shutdown,
+// such as the database connections of GORMCache and SQLiteCache
+type ClosableCache interface {
+	Cache
+	Close() error
+}
+
+// Close closes cache if it implements ClosableCache, otherwise it does nothing
+func Close(cache Cache) error {
+	if closable, ok := cache.(ClosableCache); ok {
+		return closable.Close()
+	}
+	return nil
+}
+
+// EntryInfo describes an entry stored in the cache
+type EntryInfo struct {
+	// Params as stored by the cache, DiskCache can only report the file name
+	Params       string
+	Timestamp    time.Time
+	Size         int64
+	IsCompressed bool
+	// CreatedAt is when the entry was first stored, kept when it is overwritten
+	// HitCount is how many times the entry has been returned, including by the read reporting it
+	// Only InMemoryCache, ReadMostlyCache and GORMCache track these, other caches such as
+	// DiskCache cannot track them cheaply and report zero
+	CreatedAt time.Time
+	HitCount  int64
+}
+
+// GET_MANY_BATCH_SIZE is the most params GORMCache and SQLiteCache look up in one GetMany query,
+// keeping queries under SQLite's default limit of 999 query parameters
+const GET_MANY_BATCH_SIZE = 500
+
+// batches splits items into consecutive slices of at most size items
+func batches[T any](items []T, size int) [][]T {
+	var result [][]T
+	for len(items) > size {
+		result = append(result, items[:size])
+		items = items[size:]
+	}
+	if len(items) > 0 {
+		result = append(result, items)
+	}
+	return result
+}
+
+// Keys returns the sorted keys that have entries stored in cache
+func Keys(cache Cache) ([]string, error) {
+	seen := make(map[string]struct{})
+	err := cache.Iterate(func(key string, params string, timestamp time.Time) bool {
+		seen[key] = struct{}{}
+		return true
+	})
+	keys := make([]string, 0, len(seen))
+	for key := range seen {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, err
+}
+
+// CleanupBatch deletes at most maxDeletes expired entries, or every expired entry if maxDeletes is 0 or less
+// Calling it repeatedly with a small maxDeletes bounds the work of each pass and spreads deletions out,
+// rather than deleting every entry written in a burst at once as Cleanup does. TTLJitter spreads
+// when such entries expire, so they become due for cleanup over TTLJitter seconds instead of at once.
+// Which expired entries are deleted first is unspecified. Caches that do not implement
+// BatchCleanupCache have their expired entries found with Iterate and deleted with Delete,
+// and Removed only counts the deletes that the EntryCount of the cache confirms.
+func CleanupBatch(cache Cache, maxDeletes int) CleanupResult {
+	if maxDeletes <= 0 {
+		return cache.CleanupWithResult()
+	}
+	if batchCache, ok := cache.(BatchCleanupCache); ok {
+		return batchCache.CleanupBatch(maxDeletes)
+	}
+	if isReadOnly(cache) {
+		return CleanupResult{Errors: []error{ErrReadOnly}}
+	}
+
+	type entry struct {
+		key    string
+		params string
+	}
+	var expired []entry
+	now := cache.GetConfig().Now()
+	configs := cache.GetConfig().KeyConfigs()
+	var result CleanupResult
+	err := cache.Iterate(func(key string, params string, timestamp time.Time) bool {
+		config, exists := configs[key]
+		if exists && timestamp.Before(config.GetExpireTime(now)) {
+			expired = append(expired, entry{key, params})
+		}
+		return len(expired) < maxDeletes
+	})
+	if err != nil {
+		result.Errors = append(result.Errors, err)
+	}
+	// entries are deleted after iterating, as caches are not safe to modify while iterating
+	before := cache.EntryCount()
+	for _, entry := range expired {
+		cache.Delete(entry.key, entry.params)
+	}
+	result.Removed = confirmedRemovals(before, cache.EntryCount(), len(expired))
+	return result
+}
+
+// ForceCleanup deletes the entries of key stored more than maxAge ago, whatever the config of key is
+// Cleanup and ExpiredEntryCount only consider keys that have a config and entries of keys whose TTL
+// is above TTL_MAX never expire, so entries stored under an earlier TTL are kept forever when the key
+// is reconfigured to never expire or its config is removed. ForceCleanup removes such entries.
+// A maxAge of 0 or less deletes every entry of key. Caches that do not implement ForceCleanupCache
+// have the entries of key found with Iterate and deleted with Delete,
+// and Removed only counts the deletes that the KeyEntries of the cache confirm.
+func ForceCleanup(cache Cache, key string, maxAge time.Duration) CleanupResult {
+	if forceCache, ok := cache.(ForceCleanupCache); ok {
+		return forceCache.ForceCleanup(key, maxAge)
+	}
+	if isReadOnly(cache) {
+		return CleanupResult{Errors: []error{ErrReadOnly}}
+	}
+
+	var old []string
+	cutoff := forceCleanupCutoff(cache, maxAge)
+	var result CleanupResult
+	err := cache.Iterate(func(entryKey string, params string, timestamp time.Time) bool {
+		if entryKey == key && timestamp.Before(cutoff) {
+			old = append(old, params)
+		}
+		return true
+	})
+	if err != nil {
+		result.Errors = append(result.Errors, err)
+	}
+	// entries are deleted after iterating, as caches are not safe to modify while iterating
+	before := int64(len(cache.KeyEntries(key)))
+	for _, params := range old {
+		cache.Delete(key, params)
+	}
+	result.Removed = confirmedRemovals(before, int64(len(cache.KeyEntries(key))), len(old))
+	return result
+}
+
+// confirmedRemovals returns how many of the attempted deletes the cache confirms by its entry count
+// falling from before to after. Delete does not report whether it removed anything, and caches such as
+// DiskCache iterate params that Delete cannot find, so deletes are only counted once the count drops.
+func confirmedRemovals(before int64, after int64, attempted int) int64 {
+	removed := before - after
+	if removed < 0 {
+		return 0
+	}
+	if removed > int64(attempted) {
+		return int64(attempted)
+	}
+	return removed
+}
+
+// forceCleanupCutoff returns the time before which ForceCleanup deletes entries
+func forceCleanupCutoff(cache Cache, maxAge time.Duration) time.Time {
+	now := cache.GetConfig().Now()
+	if maxAge <= 0 {
+		// entries stored now are deleted too
+		return now.Add(time.Nanosecond)
+	}
+	return now.Add(-maxAge)
+}
+
+// InvalidatePrefix deletes the entries of every key starting with prefix, such as "user:"
+// The prefix is matched against keys only, never params. Caches that do not implement
+// PrefixCache have their keys listed with Iterate and cleared with ClearKey.
+func InvalidatePrefix(cache Cache, prefix string) error {
+	if prefixCache, ok := cache.(PrefixCache); ok {
+		return prefixCache.ClearPrefix(prefix)
+	}
+	keys, err := Keys(cache)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if strings.HasPrefix(key, prefix) {
+			cache.ClearKey(key)
+		}
+	}
+	return nil
+}
+
+// escapeLike escapes the LIKE wildcards in s so it is matched literally with ESCAPE '\'
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// Dump prints up to n entries in cache to stdout, see DumpTo
+func Dump(cache Cache, n int64) error {
+	return DumpTo(os.Stdout, cache, n)
+}
+
+// DumpTo writes a line with the key, params and timestamp of up to n entries in cache to w
+// All entries are written if n is 0 or less. Entries are written in the order the cache iterates them.
+func DumpTo(w io.Writer, cache Cache, n int64) error {
+	var written int64
+	var writeErr error
+	err := cache.Iterate(func(key string, params string, timestamp time.Time) bool {
+		if n > 0 && written >= n {
+			return false
+		}
+		_, writeErr = fmt.Fprintf(w, "%s\t%s\t%s\n", key, params, timestamp.Format(time.RFC3339))
+		written += 1
+		return writeErr == nil
+	})
+	if writeErr != nil {
+		return writeErr
+	}
+	return err
+}
+
+// CleanupResult reports what CleanupWithResult removed
+type CleanupResult struct {
+	// Removed is the number of expired entries deleted
+	Removed int64
+	// Errors from deleting entries, cleanup continues past them
+	Errors []error
+}
+
+// Err joins Errors into a single error, or returns nil if cleanup had no errors
+func (r CleanupResult) Err() error {
+	return errors.Join(r.Errors...)
+}
+
+// CacheSource describes where a result returned by the cache functions came from
+type CacheSource int
+
+const (
+	// SourceMiss means there was no entry in the cache so the result was retrieved
+	SourceMiss CacheSource = iota
+	// SourceHit means the result was returned from the cache
+	SourceHit
+	// SourceExpired means the entry in the cache had expired so the result was retrieved
+	SourceExpired
+	// SourceIgnored means the cache was ignored so the result was retrieved
+	SourceIgnored
+)
+
+// CacheMeta describes how a result was returned by CacheObjectWithMeta
+type CacheMeta struct {
+	Source CacheSource
+	// Age is how long ago a cached result was stored, and is zero unless Source is SourceHit
+	// Timestamps are moved back by TTLJitter so Age includes the jitter
+	Age time.Duration
+	// MaxAge is how long the result will stay cached, for use as the max-age of a Cache-Control header
+	// For hits it is the time left before the entry expires, so Age + MaxAge is the TTL.
+	// For retrieved results that were stored it is TTL less TTLJitter, the shortest life the new entry can have.
+	MaxAge time.Duration
+	// FromCache is true when Source is SourceHit
+	FromCache bool
+	// Expired is true when Source is SourceExpired, meaning a stale entry was found and replaced
+	Expired bool
+	// Size is the size of the cached entry as stored, and is zero unless Source is SourceHit
+	Size int64
+	// CompressionUsed is whether the cached entry was stored compressed
+	CompressionUsed bool
+}
+
+// CacheControl returns a Cache-Control header value such as "max-age=60" from MaxAge
+// Results that will not be cached return "no-store"
+func (m CacheMeta) CacheControl() string {
+	if m.MaxAge <= 0 {
+		return "no-store"
+	}
+	return "max-age=" + strconv.FormatInt(int64(m.MaxAge/time.Second), 10)
+}
+
+// Cached is a result together with how it was returned, see WrapMeta
+type Cached[ResultType any] struct {
+	Value ResultType
+	Meta  CacheMeta
+}
+
+// PrimeEntry is a precomputed value to be loaded into the cache with SetMany
+type PrimeEntry struct {
+	Key    string
+	Params interface{}
+	// Value is encoded as JSON like CacheObject, except for string and []byte
+	// values which are stored as is like CacheString
+	Value interface{}
 }
 
 // renderParameters returns a string representation of params
+// nil params, including nil pointers, maps and slices, render as "null"
 func RenderParameters(params interface{}) (string, error) {
 	raw, err := json.Marshal(params)
 	if err != nil {
@@ -43,6 +421,256 @@ func RenderParameters(params interface{}) (string, error) {
 	return string(raw), nil
 }
 
+// SetMany loads precomputed values into the cache without calling any retrieve functions.
+// Entries are grouped by key and written with one SetMany call per key.
+func SetMany(cache Cache, entries []PrimeEntry) error {
+	var keys []string
+	valuesByKey := make(map[string]map[string][]byte)
+	for _, entry := range entries {
+		paramsRendered, err := renderParams(cache, entry.Key, entry.Params)
+		if err != nil {
+			return err
+		}
+
+		var value []byte
+		switch v := entry.Value.(type) {
+		case string:
+			value = []byte(v)
+		case []byte:
+			value = v
+		default:
+			value, err = json.Marshal(v)
+			if err != nil {
+				return fmt.Errorf("%w: %w", ErrValueMarshal, err)
+			}
+		}
+
+		values, exists := valuesByKey[entry.Key]
+		if !exists {
+			values = make(map[string][]byte)
+			valuesByKey[entry.Key] = values
+			keys = append(keys, entry.Key)
+		}
+		values[paramsRendered] = value
+	}
+
+	for _, key := range keys {
+		cache.SetMany(key, valuesByKey[key])
+	}
+	return nil
+}
+
+// Warm stores value in the cache for key and params without calling any retrieve function.
+// The value is encoded the same way as SetMany.
+func Warm(cache Cache, key string, params interface{}, value interface{}) error {
+	return SetMany(cache, []PrimeEntry{{Key: key, Params: params, Value: value}})
+}
+
+// GetOrSet returns the cached value for key and params if it exists and has not expired.
+// Otherwise value is stored in the cache and returned.
+// Like CacheObject, values are encoded as JSON.
+func GetOrSet[ResultType any](
+	cache Cache,
+	key string,
+	params interface{},
+	value ResultType,
+) (ResultType, error) {
+	return cacheObject(context.Background(), cache, key, func(interface{}) (ResultType, error) {
+		return value, nil
+	}, CacheModeNormal, params)
+}
+
+// GetOrResolve is CacheObject for a single inline call, without building a retrieve function
+// that takes ignoreCache. It returns the cached value for key and params if it exists and
+// has not expired, otherwise resolveFunc is called and its result is stored and returned.
+func GetOrResolve[Params any, ResultType any](
+	cache Cache,
+	key string,
+	params Params,
+	resolveFunc func(Params) (ResultType, error),
+) (ResultType, error) {
+	return cacheObject(context.Background(), cache, key, resolveFunc, CacheModeNormal, params)
+}
+
+// GetOrResolveWithContext is GetOrResolve that passes ctx to resolveFunc and uses
+// the CacheMode and ignoreCache set in ctx like CacheObjectWithContext.
+func GetOrResolveWithContext[Params any, ResultType any](
+	cache Cache,
+	key string,
+	ctx context.Context,
+	params Params,
+	resolveFunc func(context.Context, Params) (ResultType, error),
+) (ResultType, error) {
+	return cacheObject(ctx, cache, key, func(params Params) (ResultType, error) {
+		return resolveFunc(ctx, params)
+	}, getCacheMode(ctx, cache), params)
+}
+
+// getKeyConfig returns the config for key, or DEFAULT_KEYCONFIG if cache has no config
+func getKeyConfig(cache Cache, key string) *KeyConfig {
+	if config := cache.GetConfig(); config != nil {
+		return config.Get(key)
+	}
+	return DEFAULT_KEYCONFIG
+}
+
+// renderParams renders params with the RenderParams function configured for key,
+// falling back to RenderParameters, and prefixes them with the configured Version
+func renderParams(cache Cache, key string, params interface{}) (string, error) {
+	config := getKeyConfig(cache, key)
+	render := config.RenderParams
+	if render == nil {
+		render = RenderParameters
+	}
+	if config.Version != "" {
+		render = VersionedParams(config.Version, render)
+	}
+	rendered, err := render(params)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrParamsMarshal, err)
+	}
+	return rendered, nil
+}
+
+// retrieve calls retrieveFunc, retrying failures as configured by ResolverRetries
+// The delay between attempts starts at ResolverRetryDelayMs and doubles after each retry
+// Retries stop early if ctx is done, returning the last error from retrieveFunc
+// If ctx is done while retrieveFunc is running, ctx.Err() is returned without waiting for it, see callWithContext
+func retrieve[Params any, ResultType any](
+	ctx context.Context,
+	cache Cache,
+	key string,
+	retrieveFunc func(Params) (ResultType, error),
+	params Params,
+) (ResultType, error) {
+	config := getKeyConfig(cache, key)
+	delay := time.Duration(config.ResolverRetryDelayMs) * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		result, err := callWithContext(ctx, cache.GetConfig(), retrieveFunc, params)
+		if err == nil || attempt >= config.ResolverRetries {
+			return result, err
+		}
+		if config.ShouldRetry != nil && !config.ShouldRetry(err) {
+			return result, err
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return result, err
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
+// callWithContext calls retrieveFunc, returning ctx.Err() if ctx is done before it returns
+// retrieveFunc is left running in its own goroutine and its result is discarded, so retrieve
+// functions should still stop when ctx is done to avoid doing work that is thrown away.
+// retrieveFunc is not called if ctx is already done, and either its result or ctx.Err()
+// may be returned if it returns just as ctx becomes done.
+// Contexts that can never be done, such as context.Background(), call retrieveFunc directly.
+// retrieveFunc is also called directly when config has no worker free, see MaxWorkers,
+// in which case it is waited for even if ctx becomes done.
+// A panic in retrieveFunc is recovered in its goroutine and raised again in the caller's goroutine,
+// or dropped if ctx is already done, so it never crashes the process from a goroutine callers cannot recover.
+func callWithContext[Params any, ResultType any](
+	ctx context.Context,
+	config *CacheFunkConfig,
+	retrieveFunc func(Params) (ResultType, error),
+	params Params,
+) (ResultType, error) {
+	if ctx.Done() == nil {
+		return retrieveFunc(params)
+	}
+	if err := ctx.Err(); err != nil {
+		var result ResultType
+		return result, err
+	}
+
+	type outcome struct {
+		result    ResultType
+		err       error
+		panicked  bool
+		recovered interface{}
+	}
+	done := make(chan outcome, 1)
+	started := config.goWorker(func() {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				done <- outcome{panicked: true, recovered: recovered}
+			}
+		}()
+		result, err := retrieveFunc(params)
+		done <- outcome{result: result, err: err}
+	})
+	if !started {
+		return retrieveFunc(params)
+	}
+
+	select {
+	case out := <-done:
+		if out.panicked {
+			panic(out.recovered)
+		}
+		return out.result, out.err
+	case <-ctx.Done():
+		var result ResultType
+		return result, ctx.Err()
+	}
+}
+
+// Has returns whether an entry for key and params exists in the cache and has not expired
+func Has(cache Cache, key string, params interface{}) (bool, error) {
+	paramsRendered, err := renderParams(cache, key, params)
+	if err != nil {
+		return false, err
+	}
+	_, found := cache.Get(key, paramsRendered)
+	return found, nil
+}
+
+// ErrNotCached is returned by MustGet when there is no fresh entry for key and params
+var ErrNotCached = errors.New("cachefunk: value not cached")
+
+// ErrParamsMarshal is wrapped around errors from rendering params into the string identifying an entry
+var ErrParamsMarshal = errors.New("cachefunk: params could not be rendered")
+
+// ErrValueMarshal is wrapped around errors from encoding a result as JSON to store it
+var ErrValueMarshal = errors.New("cachefunk: value could not be marshaled")
+
+// ErrResolverTTLNeverExpire is reported to the Observer when a resolver returns a TTL for a key
+// configured to never expire, and the result is not cached
+var ErrResolverTTLNeverExpire = errors.New("cachefunk: resolver TTL given for a key that never expires")
+
+// MustGet returns the cached value for key and params without calling a retrieve function,
+// returning ErrNotCached on a miss. Use it for precomputed data that must be in the cache.
+// Values are decoded the way SetMany encodes them: string and []byte results are
+// returned as stored, other types are decoded from JSON.
+func MustGet[ResultType any](cache Cache, key string, params interface{}) (ResultType, error) {
+	var result ResultType
+	paramsRendered, err := renderParams(cache, key, params)
+	if err != nil {
+		return result, err
+	}
+	value, found := cache.Get(key, paramsRendered)
+	if !found {
+		return result, ErrNotCached
+	}
+	switch r := interface{}(&result).(type) {
+	case *string:
+		*r = string(value)
+	case *[]byte:
+		*r = value
+	default:
+		if err := json.Unmarshal(value, &result); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
 // Wrap type functions
 // These don't work with type methods unfortunately
 
@@ -57,6 +685,82 @@ func WrapObject[Params any, ResultType any](
 	}
 }
 
+// WrapObjectVariadic is a function wrapper like WrapObject for functions with variadic args.
+// The args are cached as a JSON array. When less is nil, the same args in a different order
+// are a different cache entry. Otherwise args are sorted with less to find the cache entry,
+// so any order shares an entry, while retrieveFunc is still called with the original order.
+func WrapObjectVariadic[Arg any, ResultType any](
+	cache Cache,
+	key string,
+	retrieveFunc func(bool, ...Arg) (ResultType, error),
+	less func(a, b Arg) bool,
+) func(bool, ...Arg) (ResultType, error) {
+	return func(ignoreCache bool, args ...Arg) (ResultType, error) {
+		// no args and an empty slice of args are the same entry
+		var params []Arg
+		if len(args) > 0 {
+			params = args
+		}
+		if less != nil && len(args) > 1 {
+			params = append([]Arg(nil), args...)
+			sort.SliceStable(params, func(i, j int) bool {
+				return less(params[i], params[j])
+			})
+		}
+		return cacheObject(context.Background(), cache, key, func([]Arg) (ResultType, error) {
+			return retrieveFunc(ignoreCache, args...)
+		}, cacheModeFor(ignoreCache), params)
+	}
+}
+
+// WrapWithTTL is a function wrapper like WrapObject for resolvers that return their own TTL, see CacheWithTTL.
+func WrapWithTTL[Params any, ResultType any](
+	cache Cache,
+	key string,
+	retrieveFunc func(bool, Params) (ResultType, time.Duration, error),
+) func(bool, Params) (ResultType, error) {
+	return func(ignoreCache bool, params Params) (ResultType, error) {
+		return CacheWithTTL(cache, key, retrieveFunc, ignoreCache, params)
+	}
+}
+
+// noParams is the params of functions wrapped by WrapNoParams, which always renders as "{}"
+type noParams struct{}
+
+// WrapNoParams is a function wrapper like WrapObject for functions without params,
+// such as fetching global config. All calls share a single cache entry for key.
+func WrapNoParams[ResultType any](
+	cache Cache,
+	key string,
+	retrieveFunc func(bool) (ResultType, error),
+) func(bool) (ResultType, error) {
+	return func(ignoreCache bool) (ResultType, error) {
+		return CacheNoParams(cache, key, retrieveFunc, ignoreCache)
+	}
+}
+
+// WrapNoParamsWithContext is WrapNoParams for functions that take a context.
+func WrapNoParamsWithContext[ResultType any](
+	cache Cache,
+	key string,
+	retrieveFunc func(context.Context) (ResultType, error),
+) func(context.Context) (ResultType, error) {
+	return func(ctx context.Context) (ResultType, error) {
+		return CacheNoParamsWithContext(cache, key, retrieveFunc, ctx)
+	}
+}
+
+// WrapObjectWithMeta is WrapObject that also returns where each result came from.
+func WrapObjectWithMeta[Params any, ResultType any](
+	cache Cache,
+	key string,
+	retrieveFunc func(bool, Params) (ResultType, error),
+) func(bool, Params) (ResultType, CacheMeta, error) {
+	return func(ignoreCache bool, params Params) (ResultType, CacheMeta, error) {
+		return CacheObjectWithMeta(cache, key, retrieveFunc, ignoreCache, params)
+	}
+}
+
 // WrapString is a function wrapper that caches string or []byte responses.
 func WrapString[Params any, ResultType string | []byte](
 	cache Cache,
@@ -93,6 +797,7 @@ func WrapStringWithContext[Params any, ResultType string | []byte](
 // Cache functions
 // Less pretty than wrappers but they work with type methods
 
+// CacheString caches string or []byte responses.
 func CacheString[Params any, ResultType string | []byte](
 	cache Cache,
 	key string,
@@ -100,30 +805,12 @@ func CacheString[Params any, ResultType string | []byte](
 	ignoreCache bool,
 	params Params,
 ) (ResultType, error) {
-	// serialize parameters for cache
-	// key + parameters determines a unique identifier for a request
-	var result ResultType
-	paramsRendered, err := RenderParameters(params)
-	if err != nil {
-		return result, err
-	}
-
-	if !ignoreCache {
-		// Look for existing value in cache
-		value, found := cache.Get(key, paramsRendered)
-		if found {
-			return ResultType(value), nil
-		}
-	}
-	value, err := retrieveFunc(ignoreCache, params)
-	if err != nil {
-		return value, err
-	}
-	cache.Set(key, paramsRendered, []byte(value))
-	return value, nil
+	return cacheString(context.Background(), cache, key, func(params Params) (ResultType, error) {
+		return retrieveFunc(ignoreCache, params)
+	}, cacheModeFor(ignoreCache), params)
 }
 
-// CacheObject is a function wrapper that caches responses of any json serializable type.
+// CacheObject caches responses of any json serializable type.
 func CacheObject[Params any, ResultType any](
 	cache Cache,
 	key string,
@@ -131,102 +818,435 @@ func CacheObject[Params any, ResultType any](
 	ignoreCache bool,
 	params Params,
 ) (ResultType, error) {
-	// serialize parameters for cache
-	// key + parameters determines a unique identifier for a request
-	var result ResultType
-	paramsRendered, err := RenderParameters(params)
-	if err != nil {
+	return cacheObject(context.Background(), cache, key, func(params Params) (ResultType, error) {
+		return retrieveFunc(ignoreCache, params)
+	}, cacheModeFor(ignoreCache), params)
+}
+
+// CacheNoParams caches responses of any json serializable type from a function without params.
+func CacheNoParams[ResultType any](
+	cache Cache,
+	key string,
+	retrieveFunc func(bool) (ResultType, error),
+	ignoreCache bool,
+) (ResultType, error) {
+	return cacheObject(context.Background(), cache, key, func(noParams) (ResultType, error) {
+		return retrieveFunc(ignoreCache)
+	}, cacheModeFor(ignoreCache), noParams{})
+}
+
+// CacheNoParamsWithContext caches responses of any json serializable type from a function without params.
+func CacheNoParamsWithContext[ResultType any](
+	cache Cache,
+	key string,
+	retrieveFunc func(context.Context) (ResultType, error),
+	ctx context.Context,
+) (ResultType, error) {
+	return cacheObject(ctx, cache, key, func(noParams) (ResultType, error) {
+		return retrieveFunc(ctx)
+	}, getCacheMode(ctx, cache), noParams{})
+}
+
+// CacheWithTTL caches responses of any json serializable type from a resolver that also returns
+// how long its result is valid for, such as an HTTP max-age or a DNS TTL.
+// A returned TTL of zero uses the TTL from the config, and a negative TTL does not cache the result.
+// A positive TTL does not cache the result of a key configured to never expire, as its entries
+// cannot expire any sooner, and ErrResolverTTLNeverExpire is reported to the Observer.
+// Entries with a returned TTL are stored with their timestamp moved so they expire at the right
+// time under the config TTL, so CacheMeta.Age is not meaningful for them.
+func CacheWithTTL[Params any, ResultType any](
+	cache Cache,
+	key string,
+	retrieveFunc func(bool, Params) (ResultType, time.Duration, error),
+	ignoreCache bool,
+	params Params,
+) (ResultType, error) {
+	var ttl time.Duration
+	ctx := context.WithValue(context.Background(), resolverTTLCtxKey, &ttl)
+	return cacheObject(ctx, cache, key, func(params Params) (ResultType, error) {
+		result, resultTTL, err := retrieveFunc(ignoreCache, params)
+		ttl = resultTTL
 		return result, err
+	}, cacheModeFor(ignoreCache), params)
+}
+
+// CacheObjectWithMeta is CacheObject that also returns where the result came from.
+func CacheObjectWithMeta[Params any, ResultType any](
+	cache Cache,
+	key string,
+	retrieveFunc func(bool, Params) (ResultType, error),
+	ignoreCache bool,
+	params Params,
+) (ResultType, CacheMeta, error) {
+	return cacheObjectWithMeta(context.Background(), cache, key, func(params Params) (ResultType, error) {
+		return retrieveFunc(ignoreCache, params)
+	}, cacheModeFor(ignoreCache), params)
+}
+
+// CacheStringWithContext caches string or []byte responses.
+func CacheStringWithContext[Params any, ResultType string | []byte](
+	cache Cache,
+	key string,
+	retrieveFunc func(ctx context.Context, params Params) (ResultType, error),
+	ctx context.Context,
+	params Params,
+) (ResultType, error) {
+	return cacheString(ctx, cache, key, func(params Params) (ResultType, error) {
+		return retrieveFunc(ctx, params)
+	}, getCacheMode(ctx, cache), params)
+}
+
+// CacheObjectWithContext caches responses of any json serializable type.
+func CacheObjectWithContext[Params any, ResultType any](
+	cache Cache,
+	key string,
+	retrieveFunc func(ctx context.Context, params Params) (ResultType, error),
+	ctx context.Context,
+	params Params,
+) (ResultType, error) {
+	return cacheObject(ctx, cache, key, func(params Params) (ResultType, error) {
+		return retrieveFunc(ctx, params)
+	}, getCacheMode(ctx, cache), params)
+}
+
+// CacheObjectAs caches responses of any json serializable type and converts them with convertFunc.
+// This lets callers wanting different shapes of the same data share a single cache entry.
+func CacheObjectAs[Params any, Stored any, Out any](
+	cache Cache,
+	key string,
+	retrieveFunc func(bool, Params) (Stored, error),
+	convertFunc func(Stored) (Out, error),
+	ignoreCache bool,
+	params Params,
+) (Out, error) {
+	stored, err := CacheObject(cache, key, retrieveFunc, ignoreCache, params)
+	if err != nil {
+		var out Out
+		return out, err
 	}
-	if !ignoreCache {
-		// Look for existing value in cache
-		value, found := cache.Get(key, paramsRendered)
-		if found {
-			var result ResultType
-			if err := json.Unmarshal(value, &result); err == nil {
-				// Errors during unmarshal are ignored because the invalid cached value
-				// will be overwritten by a fresh response anyway
-				return result, nil
-			}
+	return convertFunc(stored)
+}
+
+// CacheObjectAsWithContext caches responses of any json serializable type and converts them with convertFunc.
+func CacheObjectAsWithContext[Params any, Stored any, Out any](
+	cache Cache,
+	key string,
+	retrieveFunc func(ctx context.Context, params Params) (Stored, error),
+	convertFunc func(Stored) (Out, error),
+	ctx context.Context,
+	params Params,
+) (Out, error) {
+	stored, err := CacheObjectWithContext(cache, key, retrieveFunc, ctx, params)
+	if err != nil {
+		var out Out
+		return out, err
+	}
+	return convertFunc(stored)
+}
+
+// getIgnoreCache returns whether ignoreCache has been set to true in ctx
+func getIgnoreCache(ctx context.Context, cache Cache) bool {
+	ignoreCache, ok := ctx.Value(cache.GetIgnoreCacheCtxKey()).(bool)
+	return ok && ignoreCache
+}
+
+// resolverTTLKey is the type of resolverTTLCtxKey, unexported so no other package can set it
+type resolverTTLKey struct{}
+
+// resolverTTLCtxKey holds a *time.Duration that CacheWithTTL sets to the TTL returned by its resolver
+var resolverTTLCtxKey = resolverTTLKey{}
+
+// resolverTTL returns the TTL returned by the resolver of CacheWithTTL, or 0 to use the config TTL
+func resolverTTL(ctx context.Context) time.Duration {
+	if ttl, ok := ctx.Value(resolverTTLCtxKey).(*time.Duration); ok {
+		return *ttl
+	}
+	return 0
+}
+
+// setWithContext stores value like cache.Set, unless compression or TTL is overridden in ctx
+// A TTL from the resolver is stored by moving the timestamp so that the entry expires
+// after that TTL under the config TTL, without jitter. Negative TTLs discard the entry.
+// Entries of keys that never expire cannot be given a TTL that way, so they are discarded
+// and ErrResolverTTLNeverExpire is reported to the Observer.
+func setWithContext(ctx context.Context, cache Cache, key string, params string, value []byte) {
+	ttl := resolverTTL(ctx)
+	useCompression, overridden := ctx.Value(CompressionCtxKey).(bool)
+	if !overridden && ttl == 0 {
+		if contextCache, ok := cache.(ContextCache); ok {
+			contextCache.SetContext(ctx, key, params, value)
+		} else {
+			cache.Set(key, params, value)
 		}
+		return
 	}
-	result, err = retrieveFunc(ignoreCache, params)
-	if err != nil {
-		return result, err
+
+	config := getKeyConfig(cache, key)
+	if ttl < 0 || (ttl == 0 && config.IsImmediateExpire()) {
+		return // immediately discard the entry
+	}
+	if ttl > 0 && config.IsNeverExpire() {
+		cache.GetConfig().notifySetError(key, ErrResolverTTLNeverExpire)
+		return
+	}
+	var err error
+	if !overridden {
+		value, useCompression, err = cache.GetConfig().compressValue(key, config, value)
+	} else if useCompression {
+		value, err = compressBytes(value)
+	}
+	if err == nil {
+		err = checkValueSize(config, value)
 	}
-	value, err := json.Marshal(result)
 	if err != nil {
-		return result, err
+		cache.GetConfig().notifySetError(key, err)
+		return
+	}
+
+	var timestamp time.Time
+	if ttl > 0 {
+		timestamp = cache.GetConfig().Now().Add(ttl - time.Duration(config.TTL)*time.Second)
+	} else {
+		timestamp = cache.GetConfig().GetTimestamp(config)
+	}
+	if contextCache, ok := cache.(ContextCache); ok {
+		contextCache.SetRawContext(ctx, key, params, value, timestamp, useCompression)
+	} else {
+		cache.SetRaw(key, params, value, timestamp, useCompression)
 	}
-	cache.Set(key, paramsRendered, value)
-	return result, nil
 }
 
-// CacheWithStringContext caches string or []byte responses.
-func CacheStringWithContext[Params any, ResultType string | []byte](
+// getWithInfo calls cache.GetWithInfo, passing ctx to caches that implement ContextCache
+func getWithInfo(ctx context.Context, cache Cache, key string, params string) ([]byte, EntryInfo, bool) {
+	if contextCache, ok := cache.(ContextCache); ok {
+		return contextCache.GetWithInfoContext(ctx, key, params)
+	}
+	return cache.GetWithInfo(key, params)
+}
+
+// getCacheMode returns the CacheMode set in ctx under CacheModeCtxKey
+// If there is none, ignoreCache set to true in ctx is CacheModeRefresh
+func getCacheMode(ctx context.Context, cache Cache) CacheMode {
+	if mode, ok := ctx.Value(CacheModeCtxKey).(CacheMode); ok {
+		return mode
+	}
+	return cacheModeFor(getIgnoreCache(ctx, cache))
+}
+
+// cacheModeFor returns the CacheMode equivalent to ignoreCache
+func cacheModeFor(ignoreCache bool) CacheMode {
+	if ignoreCache {
+		return CacheModeRefresh
+	}
+	return CacheModeNormal
+}
+
+// cacheString is the shared implementation of CacheString and CacheStringWithContext
+// so that the two entry points cannot drift apart.
+func cacheString[Params any, ResultType string | []byte](
+	ctx context.Context,
 	cache Cache,
 	key string,
-	retrieveFunc func(ctx context.Context, params Params) (ResultType, error),
-	ctx context.Context,
+	retrieveFunc func(Params) (ResultType, error),
+	mode CacheMode,
 	params Params,
 ) (ResultType, error) {
 	// serialize parameters for cache
 	// key + parameters determines a unique identifier for a request
 	var result ResultType
-	paramsRendered, err := RenderParameters(params)
+	paramsRendered, err := renderParams(cache, key, params)
 	if err != nil {
 		return result, err
 	}
-	if ignoreCache, ok := ctx.Value(cache.GetIgnoreCacheCtxKey()).(bool); !ok || !ignoreCache {
+
+	if mode == CacheModeNormal || mode == CacheModeOnly {
 		// Look for existing value in cache
-		value, found := cache.Get(key, paramsRendered)
+		value, _, found := getWithInfo(ctx, cache, key, paramsRendered)
 		if found {
+			cache.GetConfig().notifyHit(key, paramsRendered)
 			return ResultType(value), nil
 		}
+		cache.GetConfig().notifyMiss(key, paramsRendered)
+		if mode == CacheModeOnly {
+			return result, ErrNotCached
+		}
 	}
-	value, err := retrieveFunc(ctx, params)
+	value, err := retrieve(ctx, cache, key, retrieveFunc, params)
 	if err != nil {
+		cache.GetConfig().notifyResolverError(key, err)
 		return value, err
 	}
-	cache.Set(key, paramsRendered, []byte(value))
+	if mode != CacheModeBypass {
+		setWithContext(ctx, cache, key, paramsRendered, []byte(value))
+	}
 	return value, nil
 }
 
-// CacheWithContext caches responses of any json serializable type.
-func CacheObjectWithContext[Params any, ResultType any](
+// cacheObject is the shared implementation of CacheObject and CacheObjectWithContext
+// so that the two entry points cannot drift apart.
+func cacheObject[Params any, ResultType any](
+	ctx context.Context,
 	cache Cache,
 	key string,
-	retrieveFunc func(ctx context.Context, params Params) (ResultType, error),
-	ctx context.Context,
+	retrieveFunc func(Params) (ResultType, error),
+	mode CacheMode,
 	params Params,
 ) (ResultType, error) {
+	result, _, err := cacheObjectWithMeta(ctx, cache, key, retrieveFunc, mode, params)
+	return result, err
+}
+
+// WrapMeta is WrapObjectWithMeta returning the result and its CacheMeta together as a Cached.
+func WrapMeta[Params any, ResultType any](
+	cache Cache,
+	key string,
+	retrieveFunc func(bool, Params) (ResultType, error),
+) func(bool, Params) (Cached[ResultType], error) {
+	return func(ignoreCache bool, params Params) (Cached[ResultType], error) {
+		result, meta, err := CacheObjectWithMeta(cache, key, retrieveFunc, ignoreCache, params)
+		return Cached[ResultType]{Value: result, Meta: meta}, err
+	}
+}
+
+// cacheObjectWithMeta is cacheObject that also reports where the result came from
+func cacheObjectWithMeta[Params any, ResultType any](
+	ctx context.Context,
+	cache Cache,
+	key string,
+	retrieveFunc func(Params) (ResultType, error),
+	mode CacheMode,
+	params Params,
+) (ResultType, CacheMeta, error) {
 	// serialize parameters for cache
 	// key + parameters determines a unique identifier for a request
 	var result ResultType
-	paramsRendered, err := RenderParameters(params)
+	meta := CacheMeta{Source: SourceIgnored}
+	paramsRendered, err := renderParams(cache, key, params)
 	if err != nil {
-		return result, err
+		return result, meta, err
 	}
-	if ignoreCache, ok := ctx.Value(cache.GetIgnoreCacheCtxKey()).(bool); !ok || !ignoreCache {
+	if mode == CacheModeNormal || mode == CacheModeOnly {
 		// Look for existing value in cache
-		value, found := cache.Get(key, paramsRendered)
+		value, info, found := getWithInfo(ctx, cache, key, paramsRendered)
 		if found {
 			var result ResultType
 			if err := json.Unmarshal(value, &result); err == nil {
-				// Errors during unmarshal are ignored because the invalid cached value
-				// will be overwritten by a fresh response anyway
-				return result, nil
+				cache.GetConfig().notifyHit(key, paramsRendered)
+				config := getKeyConfig(cache, key)
+				now := cache.GetConfig().Now()
+				meta = CacheMeta{
+					Source:          SourceHit,
+					Age:             now.Sub(info.Timestamp),
+					MaxAge:          maxDuration(info.Timestamp.Sub(config.GetExpireTime(now)), 0),
+					FromCache:       true,
+					Size:            info.Size,
+					CompressionUsed: info.IsCompressed,
+				}
+				return result, meta, nil
 			}
+			// a value that cannot be unmarshalled is poisoned, so delete it
+			// rather than leave it to fail every read if a fresh value is not stored
+			cache.Delete(key, paramsRendered)
+			info = EntryInfo{}
+		}
+		cache.GetConfig().notifyMiss(key, paramsRendered)
+		meta.Source = SourceMiss
+		if !found && !info.Timestamp.IsZero() {
+			meta.Source = SourceExpired
+			meta.Expired = true
+		}
+		if mode == CacheModeOnly {
+			return result, meta, ErrNotCached
 		}
 	}
-	result, err = retrieveFunc(ctx, params)
+	result, err = retrieve(ctx, cache, key, retrieveFunc, params)
 	if err != nil {
-		return result, err
+		cache.GetConfig().notifyResolverError(key, err)
+		return result, meta, err
 	}
 	value, err := json.Marshal(result)
 	if err != nil {
-		return result, err
+		err = fmt.Errorf("%w: %w", ErrValueMarshal, err)
+		cache.GetConfig().notifySetError(key, err)
+		return result, meta, err
 	}
-	cache.Set(key, paramsRendered, value)
-	return result, nil
+	if mode != CacheModeBypass {
+		setWithContext(ctx, cache, key, paramsRendered, value)
+		if ttl := resolverTTL(ctx); ttl != 0 {
+			meta.MaxAge = maxDuration(ttl, 0)
+		} else {
+			config := getKeyConfig(cache, key)
+			meta.MaxAge = maxDuration(time.Duration(config.TTL-config.TTLJitter)*time.Second, 0)
+		}
+	}
+	return result, meta, nil
+}
+
+func maxDuration(a time.Duration, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// CacheObjectMany caches responses of any json serializable type for a list of params.
+// Cached values are fetched with a single GetMany call and retrieveFunc is only
+// called for params that were not found in the cache.
+func CacheObjectMany[Params any, ResultType any](
+	cache Cache,
+	key string,
+	retrieveFunc func(bool, Params) (ResultType, error),
+	ignoreCache bool,
+	paramsList []Params,
+) ([]ResultType, error) {
+	// serialize parameters for cache
+	// key + parameters determines a unique identifier for a request
+	paramsRenderedList := make([]string, len(paramsList))
+	for idx, params := range paramsList {
+		paramsRendered, err := renderParams(cache, key, params)
+		if err != nil {
+			return nil, err
+		}
+		paramsRenderedList[idx] = paramsRendered
+	}
+
+	var values map[string][]byte
+	if !ignoreCache {
+		// Look for existing values in cache
+		values = cache.GetMany(key, paramsRenderedList)
+	}
+
+	results := make([]ResultType, len(paramsList))
+	for idx, params := range paramsList {
+		paramsRendered := paramsRenderedList[idx]
+		if value, found := values[paramsRendered]; found {
+			var result ResultType
+			if err := json.Unmarshal(value, &result); err == nil {
+				cache.GetConfig().notifyHit(key, paramsRendered)
+				results[idx] = result
+				continue
+			}
+			// delete the poisoned value, see cacheObjectWithMeta
+			cache.Delete(key, paramsRendered)
+		}
+		if !ignoreCache {
+			cache.GetConfig().notifyMiss(key, paramsRendered)
+		}
+		result, err := retrieve(context.Background(), cache, key, func(params Params) (ResultType, error) {
+			return retrieveFunc(ignoreCache, params)
+		}, params)
+		if err != nil {
+			cache.GetConfig().notifyResolverError(key, err)
+			return nil, err
+		}
+		value, err := json.Marshal(result)
+		if err != nil {
+			err = fmt.Errorf("%w: %w", ErrValueMarshal, err)
+			cache.GetConfig().notifySetError(key, err)
+			return nil, err
+		}
+		cache.Set(key, paramsRendered, value)
+		results[idx] = result
+	}
+	return results, nil
 }
@@ -1,11 +1,15 @@
 package cachefunk_test
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/fs"
+	"math"
+	"math/rand"
+	"strings"
 	"testing"
 	"time"
 
@@ -130,7 +134,9 @@ func runTestCacheFuncTTL(t *testing.T, cache cachefunk.Cache, expireAllEntries f
 			})
 		}
 	}
-	cache.Cleanup()
+	if result := cache.CleanupWithResult(); result.Removed != 1 || len(result.Errors) != 0 {
+		t.Fatalf("expected cleanup to remove 1 entry without errors but got %+v", result)
+	}
 	if cache.EntryCount() != 0 {
 		t.Fatal("expected 0 cache entries after cache cleanup but got", cache.EntryCount())
 	}
@@ -548,3 +554,1698 @@ func runTestWrapObjectWithContext(t *testing.T, cache cachefunk.Cache) {
 		t.Fatalf("expected %d cached values after clear got %d", 0, cacheEntries)
 	}
 }
+
+func runTestCacheObjectMany(t *testing.T, cache cachefunk.Cache) {
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"helloWorld": {TTL: 5, TTLJitter: 1, UseCompression: true},
+		},
+	})
+
+	helloCounter := 0
+	helloWorld := func(ignoreCache bool, params *HelloWorldParams) (string, error) {
+		helloCounter += 1
+		return fmt.Sprintf("Hello %s, you are %d", params.Name, params.Age), nil
+	}
+
+	testCases := []struct {
+		ignoreCache bool
+		params      []*HelloWorldParams
+		results     []string
+		counter     int
+	}{
+		{false, []*HelloWorldParams{{"Bob", 42}, {"Clark", 24}}, []string{"Hello Bob, you are 42", "Hello Clark, you are 24"}, 2},
+		{false, []*HelloWorldParams{{"Clark", 24}, {"Bob", 43}, {"Bob", 42}}, []string{"Hello Clark, you are 24", "Hello Bob, you are 43", "Hello Bob, you are 42"}, 3},
+		{false, []*HelloWorldParams{}, []string{}, 3},
+		{true, []*HelloWorldParams{{"Bob", 42}}, []string{"Hello Bob, you are 42"}, 4},
+	}
+
+	for line, tc := range testCases {
+		results, err := cachefunk.CacheObjectMany(cache, "helloWorld", helloWorld, tc.ignoreCache, tc.params)
+
+		if err != nil {
+			t.Errorf("subtest %d: call to CacheObjectMany returned an error: %s", line+1, err)
+		}
+
+		if helloCounter != tc.counter {
+			t.Errorf("subtest %d: helloCounter expected %d got %d", line+1, tc.counter, helloCounter)
+		}
+
+		if len(results) != len(tc.results) {
+			t.Errorf("subtest %d: expected %d results got %d", line+1, len(tc.results), len(results))
+		} else {
+			for idx, result := range results {
+				if result != tc.results[idx] {
+					t.Errorf("subtest %d: result %d expected \"%s\" got \"%s\"", line+1, idx, tc.results[idx], result)
+				}
+			}
+		}
+
+		if t.Failed() {
+			return
+		}
+	}
+
+	if cacheEntries := cache.EntryCount(); cacheEntries != 3 {
+		t.Fatalf("expected %d cached values got %d", 3, cacheEntries)
+	}
+
+	failWorld := func(ignoreCache bool, params *HelloWorldParams) (string, error) {
+		return "", errors.New("oh no")
+	}
+
+	if _, err := cachefunk.CacheObjectMany(cache, "helloWorld", failWorld, false, []*HelloWorldParams{{"Bob", 42}, {"Lois", 30}}); err == nil {
+		t.Fatal("expected an error but got nil")
+	}
+}
+
+func runTestSetMany(t *testing.T, cache cachefunk.Cache) {
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"helloString": {TTL: 5, TTLJitter: 1},
+			"helloObject": {TTL: 5, TTLJitter: 1, UseCompression: true},
+		},
+	})
+
+	type HelloWorldResult struct {
+		Result string
+	}
+
+	helloCounter := 0
+	helloString := func(ignoreCache bool, params *HelloWorldParams) (string, error) {
+		helloCounter += 1
+		return "resolved", nil
+	}
+	helloObject := func(ignoreCache bool, params *HelloWorldParams) (*HelloWorldResult, error) {
+		helloCounter += 1
+		return &HelloWorldResult{"resolved"}, nil
+	}
+
+	err := cachefunk.SetMany(cache, []cachefunk.PrimeEntry{
+		{Key: "helloString", Params: &HelloWorldParams{"Bob", 42}, Value: "Hello Bob"},
+		{Key: "helloString", Params: &HelloWorldParams{"Clark", 24}, Value: []byte("Hello Clark")},
+		{Key: "helloObject", Params: &HelloWorldParams{"Bob", 42}, Value: &HelloWorldResult{"Hello Bob"}},
+	})
+	if err != nil {
+		t.Fatal("call to SetMany returned an error:", err)
+	}
+
+	if cacheEntries := cache.EntryCount(); cacheEntries != 3 {
+		t.Fatalf("expected %d cached values got %d", 3, cacheEntries)
+	}
+
+	HelloString := cachefunk.WrapString(cache, "helloString", helloString)
+	HelloObject := cachefunk.WrapObject(cache, "helloObject", helloObject)
+
+	if result, _ := HelloString(false, &HelloWorldParams{"Bob", 42}); result != "Hello Bob" {
+		t.Errorf("expected primed value \"%s\" got \"%s\"", "Hello Bob", result)
+	}
+	if result, _ := HelloString(false, &HelloWorldParams{"Clark", 24}); result != "Hello Clark" {
+		t.Errorf("expected primed value \"%s\" got \"%s\"", "Hello Clark", result)
+	}
+	if result, _ := HelloObject(false, &HelloWorldParams{"Bob", 42}); result == nil || result.Result != "Hello Bob" {
+		t.Errorf("expected primed value \"%s\" got %v", "Hello Bob", result)
+	}
+	if helloCounter != 0 {
+		t.Errorf("expected helloCounter to be 0 got %d", helloCounter)
+	}
+
+	err = cachefunk.SetMany(cache, []cachefunk.PrimeEntry{
+		{Key: "helloObject", Params: &HelloWorldParams{"Bob", 42}, Value: func() {}},
+	})
+	if err == nil {
+		t.Fatal("expected error for unserializable value")
+	}
+}
+
+func runTestWarm(t *testing.T, cache cachefunk.Cache) {
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"helloWorld": {TTL: 5, TTLJitter: 1},
+			"noCache":    {TTL: 0},
+		},
+	})
+
+	type HelloWorldResult struct {
+		Result string
+	}
+
+	helloCounter := 0
+	helloWorld := func(ignoreCache bool, params *HelloWorldParams) (*HelloWorldResult, error) {
+		helloCounter += 1
+		return &HelloWorldResult{"resolved"}, nil
+	}
+
+	params := &HelloWorldParams{"Bob", 42}
+	if err := cachefunk.Warm(cache, "helloWorld", params, &HelloWorldResult{"warmed"}); err != nil {
+		t.Fatal("call to Warm returned an error:", err)
+	}
+
+	HelloWorld := cachefunk.WrapObject(cache, "helloWorld", helloWorld)
+	result, err := HelloWorld(false, params)
+	if err != nil {
+		t.Fatal("call to HelloWorld returned an error:", err)
+	}
+	if result.Result != "warmed" {
+		t.Errorf("expected warmed value \"%s\" got \"%s\"", "warmed", result.Result)
+	}
+	if helloCounter != 0 {
+		t.Errorf("expected helloCounter to be 0 got %d", helloCounter)
+	}
+
+	cache.Clear()
+	if err := cachefunk.Warm(cache, "noCache", params, &HelloWorldResult{"warmed"}); err != nil {
+		t.Fatal("call to Warm returned an error:", err)
+	}
+	if cacheEntries := cache.EntryCount(); cacheEntries != 0 {
+		t.Fatalf("expected %d cached values for TTL 0 got %d", 0, cacheEntries)
+	}
+}
+
+func runTestCacheObjectAs(t *testing.T, cache cachefunk.Cache) {
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"helloWorld": {TTL: 5, TTLJitter: 1},
+		},
+	})
+
+	type HelloWorldResult struct {
+		Result string
+		Params *HelloWorldParams
+	}
+
+	helloCounter := 0
+	helloWorld := func(ignoreCache bool, params *HelloWorldParams) (*HelloWorldResult, error) {
+		helloCounter += 1
+		s := fmt.Sprintf("Hello %s, you are %d", params.Name, params.Age)
+		return &HelloWorldResult{Result: s, Params: params}, nil
+	}
+	helloWorldCtx := func(ctx context.Context, params *HelloWorldParams) (*HelloWorldResult, error) {
+		return helloWorld(false, params)
+	}
+	toName := func(result *HelloWorldResult) (string, error) {
+		return result.Params.Name, nil
+	}
+
+	params := &HelloWorldParams{"Bob", 42}
+	full, err := cachefunk.CacheObject(cache, "helloWorld", helloWorld, false, params)
+	if err != nil || full.Result != "Hello Bob, you are 42" {
+		t.Fatalf("expected full result got %v (err %v)", full, err)
+	}
+
+	name, err := cachefunk.CacheObjectAs(cache, "helloWorld", helloWorld, toName, false, params)
+	if err != nil || name != "Bob" {
+		t.Fatalf("expected converted result \"Bob\" got \"%s\" (err %v)", name, err)
+	}
+
+	name, err = cachefunk.CacheObjectAsWithContext(cache, "helloWorld", helloWorldCtx, toName, context.TODO(), params)
+	if err != nil || name != "Bob" {
+		t.Fatalf("expected converted result \"Bob\" got \"%s\" (err %v)", name, err)
+	}
+
+	if helloCounter != 1 {
+		t.Errorf("expected helloCounter to be 1 got %d", helloCounter)
+	}
+	if cacheEntries := cache.EntryCount(); cacheEntries != 1 {
+		t.Fatalf("expected %d cached values got %d", 1, cacheEntries)
+	}
+
+	failConvert := func(result *HelloWorldResult) (string, error) {
+		return "", errors.New("oh no")
+	}
+	if _, err := cachefunk.CacheObjectAs(cache, "helloWorld", helloWorld, failConvert, false, params); err == nil {
+		t.Fatal("expected an error but got nil")
+	}
+}
+
+func runTestGetOrSet(t *testing.T, cache cachefunk.Cache) {
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"helloWorld": {TTL: 5, TTLJitter: 1},
+		},
+	})
+
+	params := &HelloWorldParams{"Bob", 42}
+	result, err := cachefunk.GetOrSet(cache, "helloWorld", params, "first")
+	if err != nil || result != "first" {
+		t.Fatalf("expected \"first\" got \"%s\" (err %v)", result, err)
+	}
+
+	result, err = cachefunk.GetOrSet(cache, "helloWorld", params, "second")
+	if err != nil || result != "first" {
+		t.Fatalf("expected cached \"first\" got \"%s\" (err %v)", result, err)
+	}
+
+	result, err = cachefunk.GetOrSet(cache, "helloWorld", &HelloWorldParams{"Clark", 24}, "third")
+	if err != nil || result != "third" {
+		t.Fatalf("expected \"third\" got \"%s\" (err %v)", result, err)
+	}
+
+	if cacheEntries := cache.EntryCount(); cacheEntries != 2 {
+		t.Fatalf("expected %d cached values got %d", 2, cacheEntries)
+	}
+
+	if _, err := cachefunk.GetOrSet(cache, "helloWorld", func() {}, "fourth"); err == nil {
+		t.Fatal("expected error for unserializable params")
+	}
+}
+
+func runTestKeyEntries(t *testing.T, cache cachefunk.Cache) {
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"a": {TTL: 5},
+			"b": {TTL: 5, UseCompression: true},
+		},
+	})
+
+	before := time.Now().UTC().Add(-1 * time.Second)
+	cache.Set("a", "1", []byte("hello"))
+	cache.Set("a", "2", []byte("world"))
+	cache.Set("b", "1", []byte("hello"))
+
+	entries := cache.KeyEntries("a")
+	if len(entries) != 2 {
+		t.Fatalf("expected %d entries for key a got %d", 2, len(entries))
+	}
+	for _, entry := range entries {
+		if entry.Size <= 0 {
+			t.Errorf("expected entry %s to have a size but got %d", entry.Params, entry.Size)
+		}
+		if entry.Timestamp.Before(before) {
+			t.Errorf("expected entry %s timestamp after %s got %s", entry.Params, before, entry.Timestamp)
+		}
+		if entry.IsCompressed {
+			t.Errorf("expected entry %s to not be compressed", entry.Params)
+		}
+	}
+
+	entries = cache.KeyEntries("b")
+	if len(entries) != 1 || !entries[0].IsCompressed {
+		t.Fatalf("expected 1 compressed entry for key b got %+v", entries)
+	}
+
+	if entries := cache.KeyEntries("c"); len(entries) != 0 {
+		t.Fatalf("expected no entries for key c got %d", len(entries))
+	}
+
+	cache.ClearKey("a")
+	if entries := cache.KeyEntries("a"); len(entries) != 0 {
+		t.Fatalf("expected no entries for key a after ClearKey got %d", len(entries))
+	}
+	if entries := cache.KeyEntries("b"); len(entries) != 1 {
+		t.Fatalf("expected 1 entry for key b after ClearKey(a) got %d", len(entries))
+	}
+}
+
+func runTestMaxDecompressedSize(t *testing.T, cache cachefunk.Cache) {
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"limited": {TTL: 5, UseCompression: true, MaxDecompressedSize: 100},
+		},
+	})
+
+	testCases := []struct {
+		size  int
+		found bool
+	}{
+		{50, true},
+		{100, true},
+		{101, false},
+		{100000, false},
+	}
+
+	for line, tc := range testCases {
+		params := fmt.Sprint(tc.size)
+		cache.Set("limited", params, make([]byte, tc.size))
+		value, found := cache.Get("limited", params)
+		if found != tc.found {
+			t.Errorf("subtest %d: expected found %v got %v", line+1, tc.found, found)
+		} else if found && len(value) != tc.size {
+			t.Errorf("subtest %d: expected value of size %d got %d", line+1, tc.size, len(value))
+		}
+	}
+}
+
+func runTestMaxValueBytes(t *testing.T, cache cachefunk.Cache) {
+	observer := &recordingObserver{}
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"limited": {TTL: 5, MaxValueBytes: 100},
+		},
+		Observer: observer,
+	})
+
+	testCases := []struct {
+		size   int
+		stored bool
+	}{
+		{50, true},
+		{100, true},
+		{101, false},
+		{100000, false},
+	}
+
+	for line, tc := range testCases {
+		cache.Clear()
+		observer.events = nil
+		retrieve := cachefunk.WrapString(cache, "limited", func(ignoreCache bool, size int) ([]byte, error) {
+			return make([]byte, size), nil
+		})
+		value, err := retrieve(false, tc.size)
+		if err != nil || len(value) != tc.size {
+			t.Errorf("subtest %d: expected value of size %d got %d %v", line+1, tc.size, len(value), err)
+		}
+		stored := cache.EntryCount() == 1
+		if stored != tc.stored {
+			t.Errorf("subtest %d: expected stored %v got %v", line+1, tc.stored, stored)
+		}
+		reported := len(observer.events) > 0 && observer.events[len(observer.events)-1] == "set error limited"
+		if reported == tc.stored {
+			t.Errorf("subtest %d: expected set error reported %v got events %v", line+1, !tc.stored, observer.events)
+		}
+	}
+}
+
+func runTestHas(t *testing.T, cache cachefunk.Cache) {
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"helloWorld": {TTL: 5},
+		},
+	})
+
+	present := &HelloWorldParams{"Bob", 42}
+	expired := &HelloWorldParams{"Clark", 24}
+	missing := &HelloWorldParams{"Lois", 30}
+
+	cachefunk.Warm(cache, "helloWorld", present, "hello")
+	paramsRendered, _ := cachefunk.RenderParameters(expired)
+	cache.SetRaw("helloWorld", paramsRendered, []byte(`"hello"`), time.Unix(0, 0), false)
+
+	testCases := []struct {
+		params   *HelloWorldParams
+		expected bool
+	}{
+		{present, true},
+		{expired, false},
+		{missing, false},
+	}
+
+	for line, tc := range testCases {
+		found, err := cachefunk.Has(cache, "helloWorld", tc.params)
+		if err != nil {
+			t.Errorf("subtest %d: unexpected error: %s", line+1, err)
+		} else if found != tc.expected {
+			t.Errorf("subtest %d: expected %v got %v", line+1, tc.expected, found)
+		}
+	}
+
+	if _, err := cachefunk.Has(cache, "helloWorld", func() {}); err == nil {
+		t.Error("expected error for unserializable params")
+	}
+}
+
+func runTestAdaptiveCompression(t *testing.T, cache cachefunk.Cache) {
+	config := &cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"random":   {TTL: 60, UseCompression: true},
+			"repeated": {TTL: 60, UseCompression: true},
+		},
+		AdaptiveCompression: true,
+	}
+	cache.SetConfig(config)
+
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(random)
+	repeated := bytes.Repeat([]byte("hello world "), 400)
+
+	testCases := []struct {
+		key        string
+		value      []byte
+		compressed bool
+	}{
+		{"random", random, false},
+		{"repeated", repeated, true},
+	}
+
+	for line, tc := range testCases {
+		cache.Set(tc.key, "params", tc.value)
+		entries := cache.KeyEntries(tc.key)
+		if len(entries) != 1 {
+			t.Errorf("subtest %d: expected %d entry got %d", line+1, 1, len(entries))
+			continue
+		}
+		if entries[0].IsCompressed != tc.compressed {
+			t.Errorf("subtest %d: expected compressed %v got %v", line+1, tc.compressed, entries[0].IsCompressed)
+		}
+
+		// reads must use the compression stored with the entry rather than the config
+		config.Set(tc.key, &cachefunk.KeyConfig{TTL: 60, UseCompression: !tc.compressed})
+		value, found := cache.Get(tc.key, "params")
+		if !found {
+			t.Errorf("subtest %d: expected value to be found", line+1)
+		} else if !bytes.Equal(value, tc.value) {
+			t.Errorf("subtest %d: value does not match", line+1)
+		}
+	}
+}
+
+func runTestMustGet(t *testing.T, cache cachefunk.Cache) {
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"helloWorld": {TTL: 5},
+		},
+	})
+
+	present := &HelloWorldParams{"Bob", 42}
+	invalid := &HelloWorldParams{"Clark", 24}
+	cachefunk.Warm(cache, "helloWorld", present, "hello")
+	paramsRendered, _ := cachefunk.RenderParameters(invalid)
+	cache.Set("helloWorld", paramsRendered, []byte("not json"))
+
+	result, err := cachefunk.MustGet[string](cache, "helloWorld", present)
+	if err != nil || result != "hello" {
+		t.Errorf("expected \"hello\" got \"%s\" (err %v)", result, err)
+	}
+
+	if _, err := cachefunk.MustGet[string](cache, "helloWorld", &HelloWorldParams{"Lois", 30}); !errors.Is(err, cachefunk.ErrNotCached) {
+		t.Errorf("expected ErrNotCached got %v", err)
+	}
+
+	if _, err := cachefunk.MustGet[int](cache, "helloWorld", invalid); err == nil || errors.Is(err, cachefunk.ErrNotCached) {
+		t.Errorf("expected decode error got %v", err)
+	}
+
+	if _, err := cachefunk.MustGet[string](cache, "helloWorld", func() {}); err == nil {
+		t.Error("expected error for unserializable params")
+	}
+}
+
+func TestWrapObjectVariadic(t *testing.T) {
+	cache := cachefunk.NewInMemoryCache()
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"ordered":   {TTL: 60},
+			"unordered": {TTL: 60},
+		},
+	})
+
+	var calls int
+	sum := func(ignoreCache bool, ids ...int) (string, error) {
+		calls += 1
+		return fmt.Sprint(ids), nil
+	}
+	less := func(a, b int) bool { return a < b }
+
+	testCases := []struct {
+		less     func(a, b int) bool
+		key      string
+		args     [][]int
+		expected []string
+		calls    int
+	}{
+		{nil, "ordered", [][]int{{1, 2}, {2, 1}, {1, 2}}, []string{"[1 2]", "[2 1]", "[1 2]"}, 2},
+		{less, "unordered", [][]int{{1, 2}, {2, 1}, {3}}, []string{"[1 2]", "[1 2]", "[3]"}, 2},
+		{less, "unordered", [][]int{nil, {}}, []string{"[]", "[]"}, 1},
+	}
+
+	for line, tc := range testCases {
+		calls = 0
+		wrapped := cachefunk.WrapObjectVariadic(cache, tc.key, sum, tc.less)
+		for i, args := range tc.args {
+			result, err := wrapped(false, args...)
+			if err != nil {
+				t.Errorf("subtest %d: unexpected error: %s", line+1, err)
+			} else if result != tc.expected[i] {
+				t.Errorf("subtest %d: expected %q got %q", line+1, tc.expected[i], result)
+			}
+		}
+		if calls != tc.calls {
+			t.Errorf("subtest %d: expected %d calls got %d", line+1, tc.calls, calls)
+		}
+	}
+}
+
+func runTestCacheObjectWithMeta(t *testing.T, cache cachefunk.Cache) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"helloWorld": {TTL: 60},
+		},
+		Clock: func() time.Time { return now },
+	})
+
+	helloWorld := cachefunk.WrapObjectWithMeta(cache, "helloWorld", func(ignoreCache bool, params *HelloWorldParams) (string, error) {
+		return "Hello " + params.Name, nil
+	})
+	params := &HelloWorldParams{"Bob", 42}
+
+	testCases := []struct {
+		advance     time.Duration
+		ignoreCache bool
+		source      cachefunk.CacheSource
+		age         time.Duration
+		maxAge      time.Duration
+	}{
+		{0, false, cachefunk.SourceMiss, 0, time.Minute},
+		{10 * time.Second, false, cachefunk.SourceHit, 10 * time.Second, 50 * time.Second},
+		{time.Minute, false, cachefunk.SourceExpired, 0, time.Minute},
+		{0, true, cachefunk.SourceIgnored, 0, time.Minute},
+		{0, false, cachefunk.SourceHit, 0, time.Minute},
+	}
+
+	for line, tc := range testCases {
+		now = now.Add(tc.advance)
+		result, meta, err := helloWorld(tc.ignoreCache, params)
+		if err != nil || result != "Hello Bob" {
+			t.Errorf("subtest %d: expected \"Hello Bob\" got \"%s\" (err %v)", line+1, result, err)
+		}
+		if meta.Source != tc.source {
+			t.Errorf("subtest %d: expected source %d got %d", line+1, tc.source, meta.Source)
+		}
+		if meta.Age != tc.age {
+			t.Errorf("subtest %d: expected age %s got %s", line+1, tc.age, meta.Age)
+		}
+		if meta.MaxAge != tc.maxAge {
+			t.Errorf("subtest %d: expected max age %s got %s", line+1, tc.maxAge, meta.MaxAge)
+		}
+	}
+
+	if header := (cachefunk.CacheMeta{MaxAge: 50 * time.Second}).CacheControl(); header != "max-age=50" {
+		t.Errorf("expected \"max-age=50\" got %q", header)
+	}
+	if header := (cachefunk.CacheMeta{}).CacheControl(); header != "no-store" {
+		t.Errorf("expected \"no-store\" got %q", header)
+	}
+}
+
+func runTestWrapMeta(t *testing.T, cache cachefunk.Cache) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"helloWorld": {TTL: 60, UseCompression: true},
+		},
+		Clock: func() time.Time { return now },
+	})
+
+	helloWorld := cachefunk.WrapMeta(cache, "helloWorld", func(ignoreCache bool, params *HelloWorldParams) (string, error) {
+		return "Hello " + params.Name, nil
+	})
+	params := &HelloWorldParams{"Bob", 42}
+
+	testCases := []struct {
+		advance   time.Duration
+		fromCache bool
+		expired   bool
+		age       time.Duration
+	}{
+		{0, false, false, 0},
+		{10 * time.Second, true, false, 10 * time.Second},
+		{time.Minute, false, true, 0},
+	}
+
+	for line, tc := range testCases {
+		now = now.Add(tc.advance)
+		result, err := helloWorld(false, params)
+		if err != nil || result.Value != "Hello Bob" {
+			t.Errorf("subtest %d: expected \"Hello Bob\" got \"%s\" (err %v)", line+1, result.Value, err)
+		}
+		meta := result.Meta
+		if meta.FromCache != tc.fromCache || meta.Expired != tc.expired || meta.Age != tc.age {
+			t.Errorf("subtest %d: expected from cache %v, expired %v and age %s got %+v", line+1, tc.fromCache, tc.expired, tc.age, meta)
+		}
+		if meta.FromCache != (meta.Size > 0) || meta.FromCache != meta.CompressionUsed {
+			t.Errorf("subtest %d: expected size and compression only for cached results got %+v", line+1, meta)
+		}
+	}
+}
+
+func runTestIterate(t *testing.T, cache cachefunk.Cache) {
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 60},
+			"world": {TTL: 60},
+		},
+	})
+	cache.SetMany("hello", map[string][]byte{"bob": []byte("1"), "clark": []byte("2")})
+	cache.Set("world", "lois", []byte("3"))
+
+	visited := map[string]map[string]bool{}
+	err := cache.Iterate(func(key string, params string, timestamp time.Time) bool {
+		if visited[key] == nil {
+			visited[key] = map[string]bool{}
+		}
+		visited[key][params] = true
+		return true
+	})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	for _, key := range []string{"hello", "world"} {
+		entries := cache.KeyEntries(key)
+		if len(visited[key]) != len(entries) {
+			t.Errorf("expected %d entries visited for %s got %d", len(entries), key, len(visited[key]))
+		}
+		for _, entry := range entries {
+			if !visited[key][entry.Params] {
+				t.Errorf("expected entry %s for %s to be visited", entry.Params, key)
+			}
+		}
+	}
+
+	calls := 0
+	cache.Iterate(func(key string, params string, timestamp time.Time) bool {
+		calls += 1
+		return false
+	})
+	if calls != 1 {
+		t.Errorf("expected iteration to stop after 1 call got %d", calls)
+	}
+
+	keys, err := cachefunk.Keys(cache)
+	if err != nil || fmt.Sprint(keys) != "[hello world]" {
+		t.Errorf("expected keys [hello world] got %v (err %v)", keys, err)
+	}
+}
+
+func runTestInvalidatePrefix(t *testing.T, cache cachefunk.Cache) {
+	keys := []string{"user:profile", "user:settings", "users", "user_profile", "post"}
+	configs := map[string]*cachefunk.KeyConfig{}
+	for _, key := range keys {
+		configs[key] = &cachefunk.KeyConfig{TTL: 60}
+	}
+	cache.SetConfig(&cachefunk.CacheFunkConfig{Configs: configs})
+	for _, key := range keys {
+		cache.SetMany(key, map[string][]byte{"bob": []byte("1"), "user:clark": []byte("2")})
+	}
+
+	if err := cachefunk.InvalidatePrefix(cache, "user:"); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	testCases := []struct {
+		key     string
+		removed bool
+	}{
+		{"user:profile", true},
+		{"user:settings", true},
+		{"users", false},
+		{"user_profile", false},
+		{"post", false},
+	}
+	for line, tc := range testCases {
+		for _, params := range []string{"bob", "user:clark"} {
+			if _, found := cache.Get(tc.key, params); found == tc.removed {
+				t.Errorf("subtest %d: expected %s %s removed %v got found %v", line+1, tc.key, params, tc.removed, found)
+			}
+		}
+	}
+}
+
+func runTestCleanupBatch(t *testing.T, cache cachefunk.Cache) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 60},
+		},
+		Clock: func() time.Time { return now },
+	})
+	for i := 0; i < 25; i++ {
+		cache.SetRaw("hello", fmt.Sprint("expired", i), []byte("1"), now.Add(-time.Hour), false)
+	}
+	for i := 0; i < 5; i++ {
+		cache.SetRaw("hello", fmt.Sprint("fresh", i), []byte("1"), now, false)
+	}
+
+	testCases := []struct {
+		removed int64
+		expired int64
+	}{
+		{10, 15},
+		{10, 5},
+		{5, 0},
+		{0, 0},
+	}
+	for line, tc := range testCases {
+		result := cachefunk.CleanupBatch(cache, 10)
+		if err := result.Err(); err != nil {
+			t.Errorf("subtest %d: unexpected error: %v", line+1, err)
+		}
+		if result.Removed != tc.removed {
+			t.Errorf("subtest %d: expected %d removed got %d", line+1, tc.removed, result.Removed)
+		}
+		if count := cache.ExpiredEntryCount(); count != tc.expired {
+			t.Errorf("subtest %d: expected %d expired entries left got %d", line+1, tc.expired, count)
+		}
+	}
+	if count := cache.EntryCount(); count != 5 {
+		t.Errorf("expected %d fresh entries left got %d", 5, count)
+	}
+}
+
+func runTestForceCleanup(t *testing.T, cache cachefunk.Cache) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello":   {TTL: 60},
+			"goodbye": {TTL: 60},
+		},
+		Clock: func() time.Time { return now },
+	})
+	cache.SetRaw("hello", "old", []byte("1"), now.Add(-time.Hour), false)
+	cache.SetRaw("hello", "fresh", []byte("1"), now, false)
+	cache.SetRaw("goodbye", "old", []byte("1"), now.Add(-time.Hour), false)
+
+	// reconfigure hello to never expire and remove the config for goodbye,
+	// which orphans their old entries from Cleanup
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: cachefunk.TTL_MAX + 1},
+		},
+		Clock: func() time.Time { return now },
+	})
+	if count := cache.ExpiredEntryCount(); count != 0 {
+		t.Errorf("expected %d expired entries got %d", 0, count)
+	}
+	if result := cache.CleanupWithResult(); result.Removed != 0 || result.Err() != nil {
+		t.Errorf("expected cleanup to remove %d entries got %d (err %v)", 0, result.Removed, result.Err())
+	}
+
+	testCases := []struct {
+		key     string
+		maxAge  time.Duration
+		removed int64
+		left    int64
+	}{
+		{"hello", time.Minute, 1, 2},
+		{"hello", time.Minute, 0, 2},
+		{"goodbye", time.Minute, 1, 1},
+		{"hello", 0, 1, 0},
+	}
+	for line, tc := range testCases {
+		result := cachefunk.ForceCleanup(cache, tc.key, tc.maxAge)
+		if err := result.Err(); err != nil {
+			t.Errorf("subtest %d: unexpected error: %v", line+1, err)
+		}
+		if result.Removed != tc.removed {
+			t.Errorf("subtest %d: expected %d removed got %d", line+1, tc.removed, result.Removed)
+		}
+		if count := cache.EntryCount(); count != tc.left {
+			t.Errorf("subtest %d: expected %d entries left got %d", line+1, tc.left, count)
+		}
+	}
+}
+
+func runTestGetManyBatches(t *testing.T, cache cachefunk.Cache) {
+	observer := &recordingObserver{}
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 60},
+		},
+		Observer: observer,
+	})
+
+	// more params than SQLite allows in one query
+	stored := make(map[string][]byte)
+	var paramsList []string
+	for i := 0; i < 33000; i++ {
+		params := fmt.Sprint(i)
+		paramsList = append(paramsList, params)
+		if i%5 != 0 {
+			stored[params] = []byte(params)
+		}
+	}
+	cache.SetMany("hello", stored)
+
+	values := cache.GetMany("hello", paramsList)
+	if len(values) != len(stored) {
+		t.Errorf("expected %d values got %d", len(stored), len(values))
+	}
+	for params, value := range values {
+		if string(value) != params {
+			t.Errorf("expected %q got %q", params, value)
+		}
+	}
+	for _, event := range observer.events {
+		if strings.HasPrefix(event, "get error") {
+			t.Errorf("unexpected observer event %q", event)
+		}
+	}
+}
+
+func runTestHitCount(t *testing.T, cache cachefunk.Cache) {
+	created := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := created
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 60},
+		},
+		Clock: func() time.Time { return now },
+	})
+	cache.Set("hello", "bob", []byte("1"))
+
+	for hits := int64(1); hits <= 3; hits++ {
+		_, info, found := cache.GetWithInfo("hello", "bob")
+		if !found || info.HitCount != hits {
+			t.Errorf("subtest %d: expected hit count %d got %d", hits, hits, info.HitCount)
+		}
+	}
+	cache.GetMany("hello", []string{"bob", "missing"})
+
+	// overwriting the entry keeps when it was first stored and its hits
+	now = now.Add(10 * time.Second)
+	cache.Set("hello", "bob", []byte("2"))
+
+	entries := cache.KeyEntries("hello")
+	if len(entries) != 1 {
+		t.Fatalf("expected %d entry got %d", 1, len(entries))
+	}
+	if entries[0].HitCount != 4 {
+		t.Errorf("expected hit count %d got %d", 4, entries[0].HitCount)
+	}
+	if !entries[0].CreatedAt.Equal(created) {
+		t.Errorf("expected created at %s got %s", created, entries[0].CreatedAt)
+	}
+	if !entries[0].Timestamp.Equal(now) {
+		t.Errorf("expected timestamp %s got %s", now, entries[0].Timestamp)
+	}
+}
+
+func runTestCacheWithTTL(t *testing.T, cache cachefunk.Cache) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"helloWorld":  {TTL: 60},
+			"neverExpire": {TTL: math.MaxInt64},
+		},
+		Clock: func() time.Time { return now },
+	})
+
+	calls := 0
+	helloWorld := cachefunk.WrapWithTTL(cache, "helloWorld", func(ignoreCache bool, ttl time.Duration) (string, time.Duration, error) {
+		calls += 1
+		return fmt.Sprint("Hello ", calls), ttl, nil
+	})
+
+	testCases := []struct {
+		advance time.Duration
+		ttl     time.Duration
+		result  string
+	}{
+		// the resolver TTL of 2s overrides the config TTL of 60s
+		{0, 2 * time.Second, "Hello 1"},
+		{time.Second, 2 * time.Second, "Hello 1"},
+		{2 * time.Second, 2 * time.Second, "Hello 2"},
+		// zero uses the config TTL
+		{0, 0, "Hello 3"},
+		{59 * time.Second, 0, "Hello 3"},
+		{2 * time.Second, 0, "Hello 4"},
+		// negative TTLs are not cached
+		{0, -time.Second, "Hello 5"},
+		{0, -time.Second, "Hello 6"},
+	}
+
+	for line, tc := range testCases {
+		now = now.Add(tc.advance)
+		result, err := helloWorld(false, tc.ttl)
+		if err != nil || result != tc.result {
+			t.Errorf("subtest %d: expected %q got %q (err %v)", line+1, tc.result, result, err)
+		}
+	}
+
+	calls = 0
+	neverExpire := cachefunk.WrapWithTTL(cache, "neverExpire", func(ignoreCache bool, ttl time.Duration) (string, time.Duration, error) {
+		calls += 1
+		return fmt.Sprint("Hello ", calls), ttl, nil
+	})
+
+	testCases = []struct {
+		advance time.Duration
+		ttl     time.Duration
+		result  string
+	}{
+		// a resolver TTL cannot be stored for a key that never expires, so the result is not cached
+		{0, 2 * time.Second, "Hello 1"},
+		{2100 * time.Millisecond, 2 * time.Second, "Hello 2"},
+		{0, 2 * time.Second, "Hello 3"},
+		// zero uses the config TTL and never expires
+		{0, 0, "Hello 4"},
+		{24 * time.Hour, 0, "Hello 4"},
+	}
+
+	for line, tc := range testCases {
+		now = now.Add(tc.advance)
+		result, err := neverExpire(false, tc.ttl)
+		if err != nil || result != tc.result {
+			t.Errorf("never expire subtest %d: expected %q got %q (err %v)", line+1, tc.result, result, err)
+		}
+	}
+}
+
+func TestResolverTTLCtxKeyCollision(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache := cachefunk.NewInMemoryCache()
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 60},
+		},
+		Clock: func() time.Time { return now },
+	})
+
+	// a caller using the same string as the internal key cannot change the TTL
+	ttl := time.Second
+	ctx := context.WithValue(context.Background(), cachefunk.CtxKey("resolverTTL"), &ttl)
+	calls := 0
+	hello := func() (string, error) {
+		return cachefunk.CacheObjectWithContext(cache, "hello", func(ctx context.Context, name string) (string, error) {
+			calls += 1
+			return "Hello " + name, nil
+		}, ctx, "bob")
+	}
+
+	hello()
+	now = now.Add(2 * time.Second)
+	hello()
+	if calls != 1 {
+		t.Errorf("expected the config TTL to be used and %d call got %d", 1, calls)
+	}
+}
+
+func runTestPoisonedEntries(t *testing.T, cache cachefunk.Cache) {
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"poisoned": {TTL: 60},
+		},
+	})
+
+	// values that fail to decompress are deleted when read
+	cache.SetRaw("poisoned", "gzip", []byte("not gzip"), time.Now(), true)
+	if _, found := cache.Get("poisoned", "gzip"); found {
+		t.Fatal("expected value that fails to decompress to be a miss")
+	}
+	if entries := cache.KeyEntries("poisoned"); len(entries) != 0 {
+		t.Fatalf("expected value that fails to decompress to be deleted got %+v", entries)
+	}
+
+	// values that fail to unmarshal are deleted even if the resolver fails
+	fail := true
+	helloWorld := cachefunk.WrapObject(cache, "poisoned", func(ignoreCache bool, params *HelloWorldParams) (*HelloWorldParams, error) {
+		if fail {
+			return nil, errors.New("oh no")
+		}
+		return params, nil
+	})
+	params := &HelloWorldParams{"Bob", 42}
+	paramsRendered, _ := cachefunk.RenderParameters(params)
+	cache.SetRaw("poisoned", paramsRendered, []byte("{not json"), time.Now(), false)
+
+	if _, err := helloWorld(false, params); err == nil {
+		t.Fatal("expected resolver error")
+	}
+	if entries := cache.KeyEntries("poisoned"); len(entries) != 0 {
+		t.Fatalf("expected value that fails to unmarshal to be deleted got %+v", entries)
+	}
+
+	fail = false
+	if result, err := helloWorld(false, params); err != nil || result.Name != "Bob" {
+		t.Fatalf("expected fresh result got %+v (err %v)", result, err)
+	}
+	if result, err := cachefunk.MustGet[*HelloWorldParams](cache, "poisoned", params); err != nil || result.Name != "Bob" {
+		t.Fatalf("expected poisoned value to be replaced got %+v (err %v)", result, err)
+	}
+}
+
+func runTestCacheMode(t *testing.T, cache cachefunk.Cache) {
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"helloWorld": {TTL: 60},
+		},
+	})
+
+	var calls int
+	helloWorld := cachefunk.WrapObjectWithContext(cache, "helloWorld", func(ctx context.Context, params *HelloWorldParams) (string, error) {
+		calls += 1
+		return fmt.Sprint("Hello ", params.Name, " ", calls), nil
+	})
+	withMode := func(mode cachefunk.CacheMode) context.Context {
+		return context.WithValue(context.Background(), cachefunk.CacheModeCtxKey, mode)
+	}
+	bob := &HelloWorldParams{"Bob", 42}
+	clark := &HelloWorldParams{"Clark", 24}
+
+	testCases := []struct {
+		ctx      context.Context
+		params   *HelloWorldParams
+		expected string
+		err      error
+		calls    int
+		entries  int64
+	}{
+		{withMode(cachefunk.CacheModeOnly), bob, "", cachefunk.ErrNotCached, 0, 0},
+		{withMode(cachefunk.CacheModeNormal), bob, "Hello Bob 1", nil, 1, 1},
+		{withMode(cachefunk.CacheModeNormal), bob, "Hello Bob 1", nil, 1, 1},
+		{withMode(cachefunk.CacheModeOnly), bob, "Hello Bob 1", nil, 1, 1},
+		{withMode(cachefunk.CacheModeBypass), bob, "Hello Bob 2", nil, 2, 1},
+		{withMode(cachefunk.CacheModeNormal), bob, "Hello Bob 1", nil, 2, 1},
+		{withMode(cachefunk.CacheModeRefresh), bob, "Hello Bob 3", nil, 3, 1},
+		{withMode(cachefunk.CacheModeNormal), bob, "Hello Bob 3", nil, 3, 1},
+		{withMode(cachefunk.CacheModeBypass), clark, "Hello Clark 4", nil, 4, 1},
+		{withMode(cachefunk.CacheModeOnly), clark, "", cachefunk.ErrNotCached, 4, 1},
+		{context.WithValue(context.Background(), cache.GetIgnoreCacheCtxKey(), true), clark, "Hello Clark 5", nil, 5, 2},
+	}
+
+	for line, tc := range testCases {
+		result, err := helloWorld(tc.ctx, tc.params)
+		if !errors.Is(err, tc.err) {
+			t.Errorf("subtest %d: expected error %v got %v", line+1, tc.err, err)
+		}
+		if result != tc.expected {
+			t.Errorf("subtest %d: expected %q got %q", line+1, tc.expected, result)
+		}
+		if calls != tc.calls {
+			t.Errorf("subtest %d: expected %d calls got %d", line+1, tc.calls, calls)
+		}
+		if count := cache.EntryCount(); count != tc.entries {
+			t.Errorf("subtest %d: expected %d entries got %d", line+1, tc.entries, count)
+		}
+	}
+}
+
+func runTestCompressionContext(t *testing.T, cache cachefunk.Cache) {
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"helloWorld": {TTL: 60, UseCompression: true},
+		},
+	})
+
+	helloWorld := cachefunk.WrapStringWithContext(cache, "helloWorld", func(ctx context.Context, params *HelloWorldParams) (string, error) {
+		return "Hello " + params.Name, nil
+	})
+	withCompression := func(useCompression bool) context.Context {
+		return context.WithValue(context.Background(), cachefunk.CompressionCtxKey, useCompression)
+	}
+
+	testCases := []struct {
+		ctx        context.Context
+		params     *HelloWorldParams
+		compressed bool
+	}{
+		{context.Background(), &HelloWorldParams{"Bob", 42}, true},
+		{withCompression(false), &HelloWorldParams{"Clark", 24}, false},
+		{withCompression(true), &HelloWorldParams{"Lois", 30}, true},
+	}
+
+	for line, tc := range testCases {
+		cache.ClearKey("helloWorld")
+		if _, err := helloWorld(tc.ctx, tc.params); err != nil {
+			t.Errorf("subtest %d: unexpected error: %s", line+1, err)
+			continue
+		}
+		entries := cache.KeyEntries("helloWorld")
+		if len(entries) != 1 {
+			t.Errorf("subtest %d: expected %d entry got %d", line+1, 1, len(entries))
+		} else if entries[0].IsCompressed != tc.compressed {
+			t.Errorf("subtest %d: expected compressed %v got %v", line+1, tc.compressed, entries[0].IsCompressed)
+		}
+
+		// entries are read with the compression they were stored with
+		result, err := helloWorld(context.Background(), tc.params)
+		if expected := "Hello " + tc.params.Name; err != nil || result != expected {
+			t.Errorf("subtest %d: expected %q got %q (err %v)", line+1, expected, result, err)
+		}
+	}
+}
+
+func TestResolverRetries(t *testing.T) {
+	errTransient := errors.New("transient")
+	errPermanent := errors.New("permanent")
+
+	cache := cachefunk.NewInMemoryCache()
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"retry2":    {TTL: 5, ResolverRetries: 2, ResolverRetryDelayMs: 1},
+			"retry1":    {TTL: 5, ResolverRetries: 1, ResolverRetryDelayMs: 1},
+			"transient": {TTL: 5, ResolverRetries: 5, ResolverRetryDelayMs: 1, ShouldRetry: func(err error) bool { return err == errTransient }},
+			"slow":      {TTL: 5, ResolverRetries: 5, ResolverRetryDelayMs: 60000},
+		},
+	})
+
+	testCases := []struct {
+		key      string
+		errs     []error
+		counter  int
+		expected error
+	}{
+		{"retry2", []error{errTransient, errTransient}, 3, nil},
+		{"retry1", []error{errTransient, errTransient}, 2, errTransient},
+		{"transient", []error{errTransient, errPermanent, errTransient}, 2, errPermanent},
+		{"noRetry", []error{errTransient}, 1, errTransient},
+	}
+
+	for line, tc := range testCases {
+		counter := 0
+		flaky := func(ignoreCache bool, params *HelloWorldParams) (string, error) {
+			counter += 1
+			if counter <= len(tc.errs) {
+				return "", tc.errs[counter-1]
+			}
+			return "ok", nil
+		}
+
+		result, err := cachefunk.CacheString(cache, tc.key, flaky, false, &HelloWorldParams{"Bob", 42})
+		if err != tc.expected {
+			t.Errorf("subtest %d: expected error %v got %v", line+1, tc.expected, err)
+		}
+		if err == nil && result != "ok" {
+			t.Errorf("subtest %d: expected result \"ok\" got \"%s\"", line+1, result)
+		}
+		if counter != tc.counter {
+			t.Errorf("subtest %d: expected %d calls got %d", line+1, tc.counter, counter)
+		}
+	}
+
+	// a cancelled context stops retries without waiting for the delay
+	ctx, cancel := context.WithCancel(context.Background())
+	counter := 0
+	failing := func(ctx context.Context, params *HelloWorldParams) (string, error) {
+		counter += 1
+		cancel()
+		return "", errTransient
+	}
+	start := time.Now()
+	_, err := cachefunk.CacheStringWithContext(cache, "slow", failing, ctx, &HelloWorldParams{"Bob", 42})
+	// the resolver returns as ctx is cancelled so either error can be returned
+	if err != errTransient && err != context.Canceled {
+		t.Errorf("expected error %v or %v got %v", errTransient, context.Canceled, err)
+	}
+	if counter != 1 {
+		t.Errorf("expected %d call after cancel got %d", 1, counter)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected cancel to stop retries early but took %s", elapsed)
+	}
+}
+
+type recordingObserver struct {
+	events    []string
+	getErrors []error
+}
+
+func (o *recordingObserver) OnHit(key string, params string) {
+	o.events = append(o.events, "hit "+key)
+}
+
+func (o *recordingObserver) OnMiss(key string, params string) {
+	o.events = append(o.events, "miss "+key)
+}
+
+func (o *recordingObserver) OnExpired(key string) {
+	o.events = append(o.events, "expired "+key)
+}
+
+func (o *recordingObserver) OnResolverError(key string, err error) {
+	o.events = append(o.events, "resolver error "+key)
+}
+
+func (o *recordingObserver) OnSetError(key string, err error) {
+	o.events = append(o.events, "set error "+key)
+}
+
+func (o *recordingObserver) OnGetError(key string, err error) {
+	o.events = append(o.events, "get error "+key)
+	o.getErrors = append(o.getErrors, err)
+}
+
+func TestObserver(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	observer := &recordingObserver{}
+	cache := cachefunk.NewInMemoryCache()
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 60},
+		},
+		Clock:    func() time.Time { return now },
+		Observer: observer,
+	})
+
+	helloWorld := func(ignoreCache bool, name string) (string, error) {
+		if name == "" {
+			return "", errors.New("no name")
+		}
+		return "hello " + name, nil
+	}
+	unencodable := func(ignoreCache bool, name string) (func(), error) {
+		return func() {}, nil
+	}
+
+	cachefunk.CacheObject(cache, "hello", helloWorld, false, "bob")
+	cachefunk.CacheObject(cache, "hello", helloWorld, false, "bob")
+	now = now.Add(2 * time.Minute)
+	cachefunk.CacheObject(cache, "hello", helloWorld, false, "bob")
+	cachefunk.CacheObject(cache, "hello", helloWorld, false, "")
+	cachefunk.CacheObject(cache, "hello", unencodable, false, "clark")
+
+	expected := []string{
+		"miss hello",
+		"hit hello",
+		"expired hello",
+		"miss hello",
+		"miss hello",
+		"resolver error hello",
+		"miss hello",
+		"set error hello",
+	}
+	if fmt.Sprint(observer.events) != fmt.Sprint(expected) {
+		t.Errorf("expected events %q got %q", expected, observer.events)
+	}
+}
+
+func TestNilConfig(t *testing.T) {
+	caches := []cachefunk.Cache{
+		cachefunk.NewInMemoryCache(),
+		cachefunk.NewReadMostlyCache(),
+		cachefunk.NewDiskCache(t.TempDir()),
+	}
+
+	for line, cache := range caches {
+		calls := 0
+		helloWorld := cachefunk.WrapString(cache, "hello", func(ignoreCache bool, name string) (string, error) {
+			calls += 1
+			return "hello " + name, nil
+		})
+
+		for i := 0; i < 2; i++ {
+			value, err := helloWorld(false, "bob")
+			if err != nil || value != "hello bob" {
+				t.Errorf("subtest %d: expected \"hello bob\" got %q (err %v)", line+1, value, err)
+			}
+		}
+		if calls != 1 {
+			t.Errorf("subtest %d: expected second call to be cached but retrieve was called %d times", line+1, calls)
+		}
+
+		// DEFAULT_KEYCONFIG enables compression
+		entries := cache.KeyEntries("hello")
+		if len(entries) != 1 || entries[0].IsCompressed != cachefunk.DEFAULT_KEYCONFIG.UseCompression {
+			t.Errorf("subtest %d: expected one entry stored using DEFAULT_KEYCONFIG got %+v", line+1, entries)
+		}
+		if result := cache.CleanupWithResult(); result.Err() != nil {
+			t.Errorf("subtest %d: unexpected cleanup error: %v", line+1, result.Err())
+		}
+	}
+}
+
+func TestTypedErrors(t *testing.T) {
+	cache := cachefunk.NewInMemoryCache()
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"params": {TTL: 60},
+			"value":  {TTL: 60},
+		},
+	})
+	errResolver := errors.New("resolver failed")
+
+	badParams := cachefunk.WrapObject(cache, "params", func(ignoreCache bool, params func()) (string, error) {
+		return "hello", nil
+	})
+	badValue := cachefunk.WrapObject(cache, "value", func(ignoreCache bool, fail bool) (chan int, error) {
+		if fail {
+			return nil, errResolver
+		}
+		return make(chan int), nil
+	})
+
+	_, paramsErr := badParams(false, func() {})
+	_, valueErr := badValue(false, false)
+	_, resolverErr := badValue(false, true)
+
+	testCases := []struct {
+		err           error
+		paramsMarshal bool
+		valueMarshal  bool
+		resolver      bool
+	}{
+		{paramsErr, true, false, false},
+		{valueErr, false, true, false},
+		{resolverErr, false, false, true},
+	}
+	for line, tc := range testCases {
+		if tc.err == nil {
+			t.Fatalf("subtest %d: expected an error", line+1)
+		}
+		if errors.Is(tc.err, cachefunk.ErrParamsMarshal) != tc.paramsMarshal {
+			t.Errorf("subtest %d: expected ErrParamsMarshal %v got %v", line+1, tc.paramsMarshal, tc.err)
+		}
+		if errors.Is(tc.err, cachefunk.ErrValueMarshal) != tc.valueMarshal {
+			t.Errorf("subtest %d: expected ErrValueMarshal %v got %v", line+1, tc.valueMarshal, tc.err)
+		}
+		if errors.Is(tc.err, errResolver) != tc.resolver {
+			t.Errorf("subtest %d: expected resolver error %v got %v", line+1, tc.resolver, tc.err)
+		}
+	}
+
+	// the underlying encoding error is still available
+	var unsupported *json.UnsupportedTypeError
+	if !errors.As(paramsErr, &unsupported) {
+		t.Errorf("expected params error to wrap a json error got %v", paramsErr)
+	}
+}
+
+func TestDumpTo(t *testing.T) {
+	cache := cachefunk.NewInMemoryCache()
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 60},
+		},
+	})
+	timestamp := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache.SetRaw("hello", "bob", []byte("1"), timestamp, false)
+	cache.SetRaw("hello", "clark", []byte("2"), timestamp, false)
+
+	var out bytes.Buffer
+	if err := cachefunk.DumpTo(&out, cache, 0); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	expected := "hello\tbob\t2023-01-01T00:00:00Z\n"
+	if !strings.Contains(out.String(), expected) {
+		t.Errorf("expected output to contain %q got %q", expected, out.String())
+	}
+	if lines := strings.Count(out.String(), "\n"); lines != 2 {
+		t.Errorf("expected %d lines got %d", 2, lines)
+	}
+
+	out.Reset()
+	cachefunk.DumpTo(&out, cache, 1)
+	if lines := strings.Count(out.String(), "\n"); lines != 1 {
+		t.Errorf("expected %d line when limited got %d", 1, lines)
+	}
+}
+
+func ExampleGetOrResolve() {
+	cache := cachefunk.NewInMemoryCache()
+	calls := 0
+	greet := func(name string) (string, error) {
+		calls += 1
+		return "Hello " + name, nil
+	}
+
+	// First call will get value from resolver
+	value, err := cachefunk.GetOrResolve(cache, "hello", "bob", greet)
+	fmt.Println("First call:", value, err)
+	// Second call will get value from cache
+	value, err = cachefunk.GetOrResolve(cache, "hello", "bob", greet)
+	fmt.Println("Second call:", value, err)
+
+	// The context variant follows the CacheMode set in the context
+	ctx := context.WithValue(context.Background(), cachefunk.CacheModeCtxKey, cachefunk.CacheModeRefresh)
+	value, err = cachefunk.GetOrResolveWithContext(cache, "hello", ctx, "bob", func(ctx context.Context, name string) (string, error) {
+		return greet(name)
+	})
+	fmt.Println("Refreshed:", value, err)
+	fmt.Println("Calls:", calls)
+	// Output:
+	// First call: Hello bob <nil>
+	// Second call: Hello bob <nil>
+	// Refreshed: Hello bob <nil>
+	// Calls: 2
+}
+
+type ignoreCacheCtxKey struct{}
+
+func TestCustomIgnoreCacheCtxKey(t *testing.T) {
+	cache := cachefunk.NewInMemoryCache()
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 60},
+		},
+	})
+	cache.IgnoreCacheCtxKey = ignoreCacheCtxKey{}
+
+	calls := 0
+	helloWorld := cachefunk.WrapStringWithContext(cache, "hello", func(ctx context.Context, name string) (string, error) {
+		calls += 1
+		return fmt.Sprintf("Hello %s %d", name, calls), nil
+	})
+
+	testCases := []struct {
+		ctx      context.Context
+		expected string
+		calls    int
+	}{
+		{context.Background(), "Hello bob 1", 1},
+		{context.Background(), "Hello bob 1", 1},
+		// the default string key is no longer used, so it does not ignore the cache
+		{context.WithValue(context.Background(), cachefunk.DEFAULT_IGNORE_CACHE_CTX_KEY, true), "Hello bob 1", 1},
+		{context.WithValue(context.Background(), ignoreCacheCtxKey{}, true), "Hello bob 2", 2},
+		{context.Background(), "Hello bob 2", 2},
+	}
+	for line, tc := range testCases {
+		result, err := helloWorld(tc.ctx, "bob")
+		if err != nil {
+			t.Errorf("subtest %d: unexpected error: %v", line+1, err)
+		}
+		if result != tc.expected {
+			t.Errorf("subtest %d: expected %q got %q", line+1, tc.expected, result)
+		}
+		if calls != tc.calls {
+			t.Errorf("subtest %d: expected %d calls got %d", line+1, tc.calls, calls)
+		}
+	}
+}
+
+func TestMaxWorkers(t *testing.T) {
+	cache := cachefunk.NewInMemoryCache()
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 60},
+		},
+		MaxWorkers: 1,
+	})
+	hello := func(ctx context.Context, resolve func() (string, error)) (string, error) {
+		return cachefunk.CacheObjectWithContext(cache, "hello", func(ctx context.Context, name string) (string, error) {
+			return resolve()
+		}, ctx, fmt.Sprint(time.Now().UnixNano()))
+	}
+
+	// the first resolver takes the only worker until it is released
+	started := make(chan struct{})
+	release := make(chan struct{})
+	firstCtx, cancelFirst := context.WithCancel(context.Background())
+	defer cancelFirst()
+	first := make(chan error, 1)
+	go func() {
+		_, err := hello(firstCtx, func() (string, error) {
+			close(started)
+			<-release
+			return "first", nil
+		})
+		first <- err
+	}()
+	<-started
+
+	// with no worker free the second resolver runs in the calling goroutine, so it is waited for
+	// rather than context.Canceled being returned as soon as its context is cancelled
+	secondCtx, cancelSecond := context.WithCancel(context.Background())
+	result, err := hello(secondCtx, func() (string, error) {
+		cancelSecond()
+		time.Sleep(10 * time.Millisecond)
+		return "second", nil
+	})
+	if err != nil || result != "second" {
+		t.Errorf("expected resolver to run in the calling goroutine got %q (err %v)", result, err)
+	}
+
+	close(release)
+	if err := <-first; err != nil {
+		t.Errorf("unexpected error from first resolver: %v", err)
+	}
+}
+
+func TestKeyConfigVersion(t *testing.T) {
+	cache := cachefunk.NewInMemoryCache()
+	withVersion := func(version string) *cachefunk.CacheFunkConfig {
+		return &cachefunk.CacheFunkConfig{
+			Configs: map[string]*cachefunk.KeyConfig{
+				"helloWorld": {TTL: 60, Version: version},
+			},
+		}
+	}
+
+	calls := 0
+	helloWorld := cachefunk.WrapObject(cache, "helloWorld", func(ignoreCache bool, params *HelloWorldParams) (string, error) {
+		calls += 1
+		return fmt.Sprint("Hello ", params.Name, " ", calls), nil
+	})
+	params := &HelloWorldParams{"Bob", 42}
+
+	testCases := []struct {
+		version string
+		result  string
+	}{
+		{"1", "Hello Bob 1"},
+		{"1", "Hello Bob 1"},
+		// bumping the version makes the old entry a miss
+		{"2", "Hello Bob 2"},
+		{"2", "Hello Bob 2"},
+		{"", "Hello Bob 3"},
+	}
+
+	for line, tc := range testCases {
+		cache.SetConfig(withVersion(tc.version))
+		result, err := helloWorld(false, params)
+		if err != nil || result != tc.result {
+			t.Errorf("subtest %d: expected %q got %q (err %v)", line+1, tc.result, result, err)
+		}
+	}
+	if count := cache.EntryCount(); count != 3 {
+		t.Errorf("expected an entry for each version got %d", count)
+	}
+}
+
+func TestWrapNoParams(t *testing.T) {
+	renderers := []func(params interface{}) (string, error){
+		nil,
+		cachefunk.RenderQueryStringParameters,
+		cachefunk.RenderHashedParameters,
+	}
+
+	for line, render := range renderers {
+		cache := cachefunk.NewInMemoryCache()
+		cache.SetConfig(&cachefunk.CacheFunkConfig{
+			Configs: map[string]*cachefunk.KeyConfig{
+				"config":    {TTL: 60, RenderParams: render},
+				"configCtx": {TTL: 60, RenderParams: render},
+			},
+		})
+
+		calls := 0
+		fetchConfig := cachefunk.WrapNoParams(cache, "config", func(ignoreCache bool) (map[string]int, error) {
+			calls += 1
+			return map[string]int{"calls": calls}, nil
+		})
+		fetchConfigCtx := cachefunk.WrapNoParamsWithContext(cache, "configCtx", func(ctx context.Context) (map[string]int, error) {
+			calls += 1
+			return map[string]int{"calls": calls}, nil
+		})
+
+		for i := 0; i < 2; i++ {
+			if result, err := fetchConfig(false); err != nil || result["calls"] != 1 {
+				t.Errorf("subtest %d: expected cached result from call 1 got %v (err %v)", line+1, result, err)
+			}
+			if result, err := fetchConfigCtx(context.Background()); err != nil || result["calls"] != 2 {
+				t.Errorf("subtest %d: expected cached result from call 2 got %v (err %v)", line+1, result, err)
+			}
+		}
+		if calls != 2 {
+			t.Errorf("subtest %d: expected each resolver to be called once got %d calls", line+1, calls)
+		}
+		if result, _ := fetchConfig(true); result["calls"] != 3 {
+			t.Errorf("subtest %d: expected ignoreCache to call the resolver got %v", line+1, result)
+		}
+	}
+}
+
+func TestResolverContextDeadline(t *testing.T) {
+	cache := cachefunk.NewInMemoryCache()
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"slow": {TTL: 60},
+		},
+	})
+
+	release := make(chan struct{})
+	defer close(release)
+	slow := cachefunk.WrapStringWithContext(cache, "slow", func(ctx context.Context, name string) (string, error) {
+		// ignores ctx to check that the deadline is enforced anyway
+		<-release
+		return "hello " + name, nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := slow(ctx, "bob")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected call to return at the deadline but took %s", elapsed)
+	}
+	if count := cache.EntryCount(); count != 0 {
+		t.Fatalf("expected nothing to be cached got %d entries", count)
+	}
+
+	fast := cachefunk.WrapStringWithContext(cache, "slow", func(ctx context.Context, name string) (string, error) {
+		return "hello " + name, nil
+	})
+	if value, err := fast(ctx, "clark"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded for a done context got %q (err %v)", value, err)
+	}
+}
+
+func TestResolverContextPanic(t *testing.T) {
+	cache := cachefunk.NewInMemoryCache()
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 60},
+		},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	recovered := func() (recovered interface{}) {
+		defer func() {
+			recovered = recover()
+		}()
+		cachefunk.CacheObjectWithContext(cache, "hello", func(ctx context.Context, name string) (string, error) {
+			panic("resolver failed")
+		}, ctx, "bob")
+		return nil
+	}()
+	if recovered != "resolver failed" {
+		t.Fatalf("expected the resolver panic to be recovered by the caller got %v", recovered)
+	}
+	if count := cache.EntryCount(); count != 0 {
+		t.Fatalf("expected nothing to be cached got %d entries", count)
+	}
+}
+
+func runTestContextCache(t *testing.T, cache cachefunk.ContextCache) {
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 60},
+		},
+	})
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	cache.Set("hello", "world", []byte("value"))
+	if _, _, found := cache.GetWithInfoContext(cancelled, "hello", "world"); found {
+		t.Error("expected query with a cancelled context to be aborted")
+	}
+	if value, _, found := cache.GetWithInfoContext(context.Background(), "hello", "world"); !found || string(value) != "value" {
+		t.Errorf("expected \"value\" got \"%s\" (found %v)", value, found)
+	}
+
+	cache.SetContext(cancelled, "hello", "set", []byte("value"))
+	cache.SetRawContext(cancelled, "hello", "raw", []byte("value"), time.Now(), false)
+	if count := len(cache.KeyEntries("hello")); count != 1 {
+		t.Errorf("expected writes with a cancelled context to be aborted got %d entries", count)
+	}
+
+	// the context of the WithContext functions is passed to the cache
+	calls := 0
+	helloWorld := cachefunk.WrapStringWithContext(cache, "hello", func(ctx context.Context, name string) (string, error) {
+		calls += 1
+		return "hello " + name, nil
+	})
+	ctx := context.WithValue(context.Background(), cachefunk.CacheModeCtxKey, cachefunk.CacheModeOnly)
+	if _, err := helloWorld(ctx, "bob"); err != cachefunk.ErrNotCached {
+		t.Errorf("expected ErrNotCached got %v", err)
+	}
+	if value, err := helloWorld(context.Background(), "bob"); err != nil || value != "hello bob" {
+		t.Errorf("expected \"hello bob\" got %q (err %v)", value, err)
+	}
+	if value, err := helloWorld(ctx, "bob"); err != nil || value != "hello bob" || calls != 1 {
+		t.Errorf("expected cached \"hello bob\" got %q after %d calls (err %v)", value, calls, err)
+	}
+}
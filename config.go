@@ -3,7 +3,21 @@ package cachefunk
 import (
 	"bytes"
 	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
 	"io"
+	"math"
+	"math/rand"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
 )
 
 var DEFAULT_KEYCONFIG = &KeyConfig{
@@ -12,20 +26,429 @@ var DEFAULT_KEYCONFIG = &KeyConfig{
 	UseCompression: true,
 }
 
+// CacheFunkConfig holds the KeyConfig for each key
+// Use Get and Set rather than Configs directly while the config is in use by a cache
 type CacheFunkConfig struct {
-	Defaults *KeyConfig
-	Configs  map[string]*KeyConfig
+	Defaults *KeyConfig            `json:"defaults,omitempty"`
+	Configs  map[string]*KeyConfig `json:"configs"`
+	// Clock returns the current time, time.Now is used if nil
+	// Set it to control expiry in tests
+	Clock func() time.Time `json:"-"`
+	// AdaptiveCompression stops compressing keys whose values do not compress well
+	// Keys must still have UseCompression enabled to be compressed at all
+	AdaptiveCompression bool `json:"adaptive_compression,omitempty"`
+	// JitterSeed seeds TTLJitter for keys without their own Rand, the global source is used if 0
+	// Give each instance a different seed, for example with SeedFromInstanceID,
+	// to spread expiry across instances while keeping each instance reproducible
+	JitterSeed int64 `json:"jitter_seed,omitempty"`
+	// Observer is notified of hits, misses and errors, see Observer
+	Observer Observer `json:"-"`
+	// MaxWorkers is the most goroutines run at once for the work of every cache using this config,
+	// unlimited if 0. It is read when the first worker is started, see goWorker
+	MaxWorkers  int `json:"max_workers,omitempty"`
+	workers     chan struct{}
+	workersOnce sync.Once
+	jitterRand  *rand.Rand
+	compression map[string]*compressionState
+	merged      map[string]mergedKeyConfig
+	mutex       sync.RWMutex
 }
 
+// mergedKeyConfig is a KeyConfig merged with Defaults by Get, kept until either of them is replaced
+type mergedKeyConfig struct {
+	config   *KeyConfig
+	defaults *KeyConfig
+	merged   *KeyConfig
+}
+
+// Now returns the current time in UTC from Clock
+func (c *CacheFunkConfig) Now() time.Time {
+	if c != nil && c.Clock != nil {
+		return c.Clock().UTC()
+	}
+	return time.Now().UTC()
+}
+
+// GetTimestamp returns the timestamp to store with a new entry for config at Now
+// Jitter is drawn from config.Rand if set, otherwise from a source seeded with JitterSeed
+func (c *CacheFunkConfig) GetTimestamp(config *KeyConfig) time.Time {
+	now := c.Now()
+	if c == nil || c.JitterSeed == 0 || config.Rand != nil {
+		return config.GetTimestamp(now)
+	}
+	jitterMutex.Lock()
+	if c.jitterRand == nil {
+		c.jitterRand = rand.New(rand.NewSource(c.JitterSeed))
+	}
+	source := c.jitterRand
+	jitterMutex.Unlock()
+	return config.jitterTimestamp(now, source)
+}
+
+// SeedFromInstanceID returns a JitterSeed derived from an instance ID such as a hostname
+func SeedFromInstanceID(id string) int64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(id))
+	return int64(hash.Sum64())
+}
+
+// Get returns the KeyConfig for key
+// Keys without a config use Defaults, and are added to Configs so that they are cleaned up
+// Keys with a config inherit unset fields from Defaults, see KeyConfig.merge
+// The merged config is kept for later calls until the key config or Defaults is replaced,
+// so KeyConfigs changed in place must be given to Set or SetConfig again to take effect
+// A nil config uses DEFAULT_KEYCONFIG for every key, so caches work before SetConfig is called
 func (c *CacheFunkConfig) Get(key string) *KeyConfig {
-	if value, exists := c.Configs[key]; exists {
-		return value
-	} else if c.Defaults != nil {
-		c.Configs[key] = c.Defaults
-		return c.Defaults
-	} else {
+	if c == nil {
 		return DEFAULT_KEYCONFIG
 	}
+	c.mutex.RLock()
+	value, exists := c.Configs[key]
+	defaults := c.Defaults
+	cached, isCached := c.merged[key]
+	c.mutex.RUnlock()
+	if !exists {
+		if defaults == nil {
+			return DEFAULT_KEYCONFIG
+		}
+		c.Set(key, defaults)
+		return defaults
+	}
+	if defaults == nil || value == defaults {
+		return value
+	}
+	if isCached && cached.config == value && cached.defaults == defaults {
+		return cached.merged
+	}
+
+	merged := value.merge(defaults)
+	c.mutex.Lock()
+	if c.merged == nil {
+		c.merged = make(map[string]mergedKeyConfig)
+	}
+	c.merged[key] = mergedKeyConfig{value, defaults, merged}
+	c.mutex.Unlock()
+	return merged
+}
+
+// Set sets the KeyConfig for key
+func (c *CacheFunkConfig) Set(key string, config *KeyConfig) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.Configs == nil {
+		c.Configs = make(map[string]*KeyConfig)
+	}
+	c.Configs[key] = config
+	delete(c.merged, key)
+}
+
+// resetMerged drops the configs merged by Get, so they are merged again from the current KeyConfigs
+func (c *CacheFunkConfig) resetMerged() {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.merged = nil
+}
+
+// KeyConfigs returns a copy of Configs that is safe to iterate while the config is in use
+func (c *CacheFunkConfig) KeyConfigs() map[string]*KeyConfig {
+	if c == nil {
+		return map[string]*KeyConfig{}
+	}
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	configs := make(map[string]*KeyConfig, len(c.Configs))
+	for key, config := range c.Configs {
+		configs[key] = config
+	}
+	return configs
+}
+
+// ReloadConfigFromFile loads config from a JSON file with LoadConfig and swaps it into cache
+// The existing config is kept if loading fails
+func ReloadConfigFromFile(cache Cache, path string) error {
+	config, err := LoadConfig(path)
+	if err != nil {
+		return err
+	}
+	cache.SetConfig(config)
+	return nil
+}
+
+// LoadConfig reads a CacheFunkConfig from a JSON file such as
+//
+//	{
+//		"defaults": {"ttl": 3600, "ttl_jitter": 300, "use_compression": true},
+//		"configs": {
+//			"hello": {"ttl": 60}
+//		}
+//	}
+//
+// Unknown fields and invalid values are reported with the key they belong to.
+func LoadConfig(path string) (*CacheFunkConfig, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var parsed struct {
+		Defaults            json.RawMessage            `json:"defaults"`
+		Configs             map[string]json.RawMessage `json:"configs"`
+		AdaptiveCompression bool                       `json:"adaptive_compression"`
+		JitterSeed          int64                      `json:"jitter_seed"`
+		MaxWorkers          int                        `json:"max_workers"`
+	}
+	if err := decodeStrict(raw, &parsed); err != nil {
+		return nil, fmt.Errorf("cachefunk: %s: %w", path, err)
+	}
+
+	config := CacheFunkConfig{
+		Configs:             make(map[string]*KeyConfig, len(parsed.Configs)),
+		AdaptiveCompression: parsed.AdaptiveCompression,
+		JitterSeed:          parsed.JitterSeed,
+		MaxWorkers:          parsed.MaxWorkers,
+	}
+	if parsed.Defaults != nil {
+		config.Defaults = &KeyConfig{}
+		if err := loadKeyConfig(parsed.Defaults, config.Defaults); err != nil {
+			return nil, fmt.Errorf("cachefunk: %s: defaults: %w", path, err)
+		}
+	}
+	for key, rawKeyConfig := range parsed.Configs {
+		keyConfig := &KeyConfig{}
+		if err := loadKeyConfig(rawKeyConfig, keyConfig); err != nil {
+			return nil, fmt.Errorf("cachefunk: %s: config for key %q: %w", path, key, err)
+		}
+		config.Configs[key] = keyConfig
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("cachefunk: %s: %w", path, err)
+	}
+	return &config, nil
+}
+
+// Validate checks Defaults and every KeyConfig, returning an error listing every problem found
+// LoadConfig validates the configs it loads, use Validate to check configs built in code before using them
+func (c *CacheFunkConfig) Validate() error {
+	var errs []error
+	if c.MaxWorkers < 0 {
+		errs = append(errs, errors.New("max_workers must not be negative"))
+	}
+	if c.Defaults != nil {
+		for _, err := range splitErrors(c.Defaults.Validate()) {
+			errs = append(errs, fmt.Errorf("defaults: %w", err))
+		}
+	}
+	keys := make([]string, 0, len(c.Configs))
+	for key := range c.Configs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if c.Configs[key] == nil {
+			errs = append(errs, fmt.Errorf("config for key %q: config is nil", key))
+			continue
+		}
+		for _, err := range splitErrors(c.Configs[key].Validate()) {
+			errs = append(errs, fmt.Errorf("config for key %q: %w", key, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// splitErrors returns the errors joined in err by errors.Join, so each can be given its own prefix
+func splitErrors(err error) []error {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		return joined.Unwrap()
+	}
+	if err != nil {
+		return []error{err}
+	}
+	return nil
+}
+
+// ENV_OVERRIDE_PREFIX starts the name of every environment variable read by ApplyEnvOverrides
+const ENV_OVERRIDE_PREFIX = "CACHEFUNK_"
+
+// envOverrideSettings maps the setting suffix of an override variable to the KeyConfig field it sets
+var envOverrideSettings = map[string]func(kc *KeyConfig, value string) error{
+	"TTL": func(kc *KeyConfig, value string) (err error) {
+		kc.TTL, err = strconv.ParseInt(value, 10, 64)
+		return err
+	},
+	"TTL_JITTER": func(kc *KeyConfig, value string) (err error) {
+		kc.TTLJitter, err = strconv.ParseInt(value, 10, 64)
+		return err
+	},
+	"USE_COMPRESSION": func(kc *KeyConfig, value string) (err error) {
+		kc.UseCompression, err = strconv.ParseBool(value)
+		return err
+	},
+	"MAX_DECOMPRESSED_SIZE": func(kc *KeyConfig, value string) (err error) {
+		kc.MaxDecompressedSize, err = strconv.ParseInt(value, 10, 64)
+		return err
+	},
+	"MAX_VALUE_BYTES": func(kc *KeyConfig, value string) (err error) {
+		kc.MaxValueBytes, err = strconv.ParseInt(value, 10, 64)
+		return err
+	},
+	"RESOLVER_RETRIES": func(kc *KeyConfig, value string) (err error) {
+		kc.ResolverRetries, err = strconv.Atoi(value)
+		return err
+	},
+	"RESOLVER_RETRY_DELAY_MS": func(kc *KeyConfig, value string) (err error) {
+		kc.ResolverRetryDelayMs, err = strconv.ParseInt(value, 10, 64)
+		return err
+	},
+	"VERSION": func(kc *KeyConfig, value string) error {
+		kc.Version = value
+		return nil
+	},
+	"RENDER_PARAMS": func(kc *KeyConfig, value string) error {
+		render, exists := paramsRenderers[value]
+		if !exists {
+			return fmt.Errorf("unknown render_params %q", value)
+		}
+		kc.RenderParams = render
+		return nil
+	},
+}
+
+// envKeyName returns key as it appears in override variable names,
+// upper case with every character other than a letter or digit replaced by _
+func envKeyName(key string) string {
+	return strings.Map(func(r rune) rune {
+		if ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') {
+			return unicode.ToUpper(r)
+		}
+		return '_'
+	}, key)
+}
+
+// ApplyEnvOverrides sets KeyConfig fields in config from environment variables in environ,
+// given in the "NAME=value" form returned by os.Environ
+// Variables are named CACHEFUNK_<KEY>_<SETTING>, such as CACHEFUNK_HELLO_WORLD_TTL=60 for
+// key "hello-world", where <SETTING> is the upper case name of a JSON config field
+// (TTL, TTL_JITTER, USE_COMPRESSION, MAX_DECOMPRESSED_SIZE, MAX_VALUE_BYTES, RESOLVER_RETRIES,
+// RESOLVER_RETRY_DELAY_MS, VERSION or RENDER_PARAMS). Use DEFAULTS as <KEY> to override Defaults.
+// Only keys already in Configs can be overridden. Any other variable starting with
+// CACHEFUNK_, a value that cannot be parsed, or a variable naming more than one key,
+// such as "a-b" and "a_b", is an error naming the variable.
+// Every overridden KeyConfig is checked with Validate, and config is only changed if all of them are valid.
+// KeyConfigs are copied before being changed, so configs shared with other caches are not modified.
+func ApplyEnvOverrides(config *CacheFunkConfig, environ []string) error {
+	envKeys := map[string][]string{}
+	for key := range config.KeyConfigs() {
+		envKeys[envKeyName(key)] = append(envKeys[envKeyName(key)], key)
+	}
+
+	overrides := map[string]*KeyConfig{}
+	var defaults *KeyConfig
+	for _, variable := range environ {
+		name, value, _ := strings.Cut(variable, "=")
+		if !strings.HasPrefix(name, ENV_OVERRIDE_PREFIX) {
+			continue
+		}
+		rest := strings.TrimPrefix(name, ENV_OVERRIDE_PREFIX)
+
+		var envKey, setting string
+		for candidate := range envOverrideSettings {
+			if strings.HasSuffix(rest, "_"+candidate) && len(candidate) > len(setting) {
+				envKey, setting = strings.TrimSuffix(rest, "_"+candidate), candidate
+			}
+		}
+		if setting == "" {
+			return fmt.Errorf("cachefunk: %s: unknown setting", name)
+		}
+
+		var keyConfig *KeyConfig
+		if envKey == "DEFAULTS" {
+			if keys := envKeys[envKey]; len(keys) > 0 {
+				return fmt.Errorf("cachefunk: %s: DEFAULTS is also the name of key %q", name, keys[0])
+			}
+			if defaults == nil {
+				defaults = &KeyConfig{}
+				if config.Defaults != nil {
+					*defaults = *config.Defaults
+				} else {
+					*defaults = *DEFAULT_KEYCONFIG
+				}
+			}
+			keyConfig = defaults
+		} else {
+			keys := envKeys[envKey]
+			if len(keys) == 0 {
+				return fmt.Errorf("cachefunk: %s: no config for key %s", name, envKey)
+			}
+			if len(keys) > 1 {
+				sort.Strings(keys)
+				return fmt.Errorf("cachefunk: %s: keys %q have the same name in variables", name, keys)
+			}
+			key := keys[0]
+			if keyConfig = overrides[key]; keyConfig == nil {
+				keyConfig = &KeyConfig{}
+				*keyConfig = *config.KeyConfigs()[key]
+				overrides[key] = keyConfig
+			}
+		}
+
+		if err := envOverrideSettings[setting](keyConfig, value); err != nil {
+			return fmt.Errorf("cachefunk: %s: invalid value %q: %w", name, value, err)
+		}
+		keyConfig.MarkSet(strings.ToLower(setting))
+	}
+
+	if defaults != nil {
+		if err := defaults.Validate(); err != nil {
+			return fmt.Errorf("cachefunk: defaults: %w", err)
+		}
+	}
+	keys := make([]string, 0, len(overrides))
+	for key := range overrides {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := overrides[key].Validate(); err != nil {
+			return fmt.Errorf("cachefunk: config for key %q: %w", key, err)
+		}
+	}
+
+	if defaults != nil {
+		config.mutex.Lock()
+		config.Defaults = defaults
+		config.mutex.Unlock()
+	}
+	for _, key := range keys {
+		config.Set(key, overrides[key])
+	}
+	return nil
+}
+
+// LoadConfigWithEnv reads a CacheFunkConfig with LoadConfig and applies overrides
+// from the environment with ApplyEnvOverrides
+func LoadConfigWithEnv(path string) (*CacheFunkConfig, error) {
+	config, err := LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := ApplyEnvOverrides(config, os.Environ()); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func loadKeyConfig(raw []byte, keyConfig *KeyConfig) error {
+	return decodeStrict(raw, keyConfig)
+}
+
+// decodeStrict decodes JSON into v, returning an error for unknown fields
+func decodeStrict(raw []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
 }
 
 // Config is used to configure the caching wrapper functions
@@ -33,13 +456,377 @@ type KeyConfig struct {
 	// TTL is time to live in seconds before the cache value can be deleted
 	// If TTL is 0, cache value will expire immediately
 	// Use a very large TTL to make the cached value last a long time
-	// (for instance 31536000 will cache for one year)
-	TTL int64
+	// (for instance 31536000 will cache for one year), or a TTL above TTL_MAX to never expire
+	TTL int64 `json:"ttl"`
 	// When TTLJitter is > 0, a random value from 1 to TTLJitter will be added to TTL
 	// This spreads cache expiry out to stop getting fresh responses all at once
-	TTLJitter int64
+	TTLJitter int64 `json:"ttl_jitter"`
 	// Enable compression of data by gzip
-	UseCompression bool
+	UseCompression bool `json:"use_compression"`
+	// When MaxDecompressedSize is > 0, compressed values that decompress to more than
+	// MaxDecompressedSize bytes are treated as not found
+	// This protects against decompression bombs in shared or externally writable caches
+	MaxDecompressedSize int64 `json:"max_decompressed_size"`
+	// When MaxValueBytes is > 0, values larger than MaxValueBytes bytes after compression are not stored
+	// The retrieve function result is still returned, and ErrValueTooLarge is reported to the Observer
+	MaxValueBytes int64 `json:"max_value_bytes"`
+	// ResolverRetries is how many times a failing retrieve function is retried before its error is returned
+	ResolverRetries int `json:"resolver_retries"`
+	// ResolverRetryDelayMs is the delay in milliseconds before the first retry, doubling after each retry
+	ResolverRetryDelayMs int64 `json:"resolver_retry_delay_ms"`
+	// ShouldRetry decides whether an error from the retrieve function is retried
+	// All errors are retried if nil
+	ShouldRetry func(err error) bool `json:"-"`
+	// Version is mixed into the params of every entry for the key, as with VersionedParams
+	// Change it when the shape of cached values changes so entries stored before are no longer found
+	// Old entries are left to expire and be removed by Cleanup
+	Version string `json:"version"`
+	// RenderParams renders params into the string used to identify a cache entry
+	// RenderParameters (JSON) is used if nil
+	RenderParams func(params interface{}) (string, error) `json:"-"`
+	// Rand is the source used for TTLJitter, the global math/rand source is used if nil
+	// Seed it to make jitter reproducible. It may be shared between keys and caches,
+	// as draws from it are made under a lock
+	Rand *rand.Rand `json:"-"`
+	// set holds the JSON names of fields marked as set, see MarkSet
+	set map[string]bool
+}
+
+// Validate checks that the settings of kc make sense together, returning an error listing every problem found
+func (kc *KeyConfig) Validate() error {
+	var errs []error
+	if kc.TTL < 0 {
+		errs = append(errs, errors.New("ttl must not be negative, use 0 to not store values"))
+	}
+	if kc.TTLJitter < 0 {
+		errs = append(errs, errors.New("ttl_jitter must not be negative"))
+	} else if kc.TTL > 0 && kc.TTLJitter >= kc.TTL {
+		errs = append(errs, errors.New("ttl_jitter must be less than ttl or values can expire as they are stored"))
+	}
+	if kc.MaxDecompressedSize < 0 {
+		errs = append(errs, errors.New("max_decompressed_size must not be negative"))
+	}
+	if kc.MaxValueBytes < 0 {
+		errs = append(errs, errors.New("max_value_bytes must not be negative"))
+	}
+	if kc.ResolverRetries < 0 {
+		errs = append(errs, errors.New("resolver_retries must not be negative"))
+	}
+	if kc.ResolverRetryDelayMs < 0 {
+		errs = append(errs, errors.New("resolver_retry_delay_ms must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// merge returns a copy of kc with unset fields taken from defaults
+// MaxDecompressedSize, MaxValueBytes, Version, ShouldRetry, RenderParams and Rand are unset when zero or nil,
+// as their zero value has no meaning of its own.
+// TTLJitter, UseCompression, ResolverRetries and ResolverRetryDelayMs are unset when zero and not
+// marked as set, as zero also means no jitter, no compression, no retries and no delay. Fields given
+// in JSON or by ApplyEnvOverrides are marked as set, use MarkSet for fields set to zero in code.
+// TTLJitter is not inherited when it is not below TTL, as Validate requires of a key config.
+// TTL is never inherited, as zero means expire immediately, so every key config must set it.
+func (kc *KeyConfig) merge(defaults *KeyConfig) *KeyConfig {
+	merged := *kc
+	if merged.TTLJitter == 0 && !kc.isSet("ttl_jitter") && defaults.TTLJitter < merged.TTL {
+		merged.TTLJitter = defaults.TTLJitter
+	}
+	if !merged.UseCompression && !kc.isSet("use_compression") {
+		merged.UseCompression = defaults.UseCompression
+	}
+	if merged.ResolverRetries == 0 && !kc.isSet("resolver_retries") {
+		merged.ResolverRetries = defaults.ResolverRetries
+	}
+	if merged.ResolverRetryDelayMs == 0 && !kc.isSet("resolver_retry_delay_ms") {
+		merged.ResolverRetryDelayMs = defaults.ResolverRetryDelayMs
+	}
+	if merged.MaxDecompressedSize == 0 {
+		merged.MaxDecompressedSize = defaults.MaxDecompressedSize
+	}
+	if merged.MaxValueBytes == 0 {
+		merged.MaxValueBytes = defaults.MaxValueBytes
+	}
+	if merged.Version == "" {
+		merged.Version = defaults.Version
+	}
+	if merged.ShouldRetry == nil {
+		merged.ShouldRetry = defaults.ShouldRetry
+	}
+	if merged.RenderParams == nil {
+		merged.RenderParams = defaults.RenderParams
+	}
+	if merged.Rand == nil {
+		merged.Rand = defaults.Rand
+	}
+	return &merged
+}
+
+// MarkSet marks the fields of kc with the given JSON names, such as "use_compression", as set
+// so that they are not inherited from Defaults when they are zero, see merge. It returns kc so
+// that it can be used in a config literal, such as (&KeyConfig{TTL: 60}).MarkSet("use_compression")
+func (kc *KeyConfig) MarkSet(fields ...string) *KeyConfig {
+	// the set fields are copied rather than added to, as copies of kc share them
+	set := make(map[string]bool, len(kc.set)+len(fields))
+	for field := range kc.set {
+		set[field] = true
+	}
+	for _, field := range fields {
+		set[field] = true
+	}
+	kc.set = set
+	return kc
+}
+
+// isSet reports whether the field with the given JSON name was marked as set by MarkSet
+func (kc *KeyConfig) isSet(field string) bool {
+	return kc.set[field]
+}
+
+// paramsRenderers are the RenderParams functions that can be referred to by name in JSON config
+var paramsRenderers = map[string]func(params interface{}) (string, error){
+	"json":        RenderParameters,
+	"querystring": RenderQueryStringParameters,
+	"hashed":      RenderHashedParameters,
+	"canonical":   RenderCanonicalParameters,
+}
+
+// paramsRendererName returns the name of a registered RenderParams function
+func paramsRendererName(render func(params interface{}) (string, error)) string {
+	if render == nil {
+		return ""
+	}
+	pointer := reflect.ValueOf(render).Pointer()
+	for name, registered := range paramsRenderers {
+		if reflect.ValueOf(registered).Pointer() == pointer {
+			return name
+		}
+	}
+	return ""
+}
+
+// keyConfigJSON has the fields of KeyConfig without its JSON methods
+type keyConfigJSON KeyConfig
+
+// MarshalJSON encodes RenderParams by name
+// Functions that are not registered in paramsRenderers are omitted, as are fields
+// inherited from Defaults when they are zero and not marked as set, see merge
+func (kc *KeyConfig) MarshalJSON() ([]byte, error) {
+	encoded := struct {
+		*keyConfigJSON
+		RenderParams         string `json:"render_params,omitempty"`
+		TTLJitter            *int64 `json:"ttl_jitter,omitempty"`
+		UseCompression       *bool  `json:"use_compression,omitempty"`
+		ResolverRetries      *int   `json:"resolver_retries,omitempty"`
+		ResolverRetryDelayMs *int64 `json:"resolver_retry_delay_ms,omitempty"`
+	}{
+		keyConfigJSON: (*keyConfigJSON)(kc),
+		RenderParams:  paramsRendererName(kc.RenderParams),
+	}
+	if kc.TTLJitter != 0 || kc.isSet("ttl_jitter") {
+		encoded.TTLJitter = &kc.TTLJitter
+	}
+	if kc.UseCompression || kc.isSet("use_compression") {
+		encoded.UseCompression = &kc.UseCompression
+	}
+	if kc.ResolverRetries != 0 || kc.isSet("resolver_retries") {
+		encoded.ResolverRetries = &kc.ResolverRetries
+	}
+	if kc.ResolverRetryDelayMs != 0 || kc.isSet("resolver_retry_delay_ms") {
+		encoded.ResolverRetryDelayMs = &kc.ResolverRetryDelayMs
+	}
+	return json.Marshal(encoded)
+}
+
+// UnmarshalJSON decodes RenderParams by name
+// Unknown fields and render_params names are errors, so typos do not silently fall back to defaults
+// An empty render_params means the default (JSON) rendering
+// Every field given is marked as set, so fields given as zero are not inherited from Defaults
+func (kc *KeyConfig) UnmarshalJSON(data []byte) error {
+	parsed := struct {
+		*keyConfigJSON
+		RenderParams string `json:"render_params"`
+	}{
+		keyConfigJSON: (*keyConfigJSON)(kc),
+	}
+	if err := decodeStrict(data, &parsed); err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	for field := range fields {
+		kc.MarkSet(field)
+	}
+	if parsed.RenderParams != "" {
+		render, exists := paramsRenderers[parsed.RenderParams]
+		if !exists {
+			return fmt.Errorf("unknown render_params %q", parsed.RenderParams)
+		}
+		kc.RenderParams = render
+	}
+	return nil
+}
+
+// TTL_MAX is the largest TTL in seconds that can be represented as a time.Duration
+// Entries for keys with a larger TTL never expire, see IsNeverExpire
+const TTL_MAX = int64(math.MaxInt64 / int64(time.Second))
+
+// neverExpireTime is earlier than any entry timestamp and can still be given as unix nanoseconds
+var neverExpireTime = time.Unix(0, math.MinInt64).UTC()
+
+// IsImmediateExpire reports whether entries expire as soon as they are stored,
+// in which case they are discarded instead of being stored
+func (kc *KeyConfig) IsImmediateExpire() bool {
+	return kc.TTL <= 0
+}
+
+// IsNeverExpire reports whether TTL is larger than TTL_MAX, so entries never expire
+func (kc *KeyConfig) IsNeverExpire() bool {
+	return kc.TTL > TTL_MAX
+}
+
+// GetExpireTime returns the time before which entries stored at now have expired
+// If IsNeverExpire, a time in 1677 is returned rather than overflowing
+func (kc *KeyConfig) GetExpireTime(now time.Time) time.Time {
+	if kc.IsNeverExpire() {
+		return neverExpireTime
+	}
+	return now.Add(-1 * time.Duration(kc.TTL) * time.Second)
+}
+
+// GetTimestamp returns the timestamp to store with a new cache entry
+// When TTLJitter is > 0, the timestamp is moved back by a random 1 to TTLJitter seconds
+func (kc *KeyConfig) GetTimestamp(now time.Time) time.Time {
+	return kc.jitterTimestamp(now, kc.Rand)
+}
+
+// jitterMutex guards the sources given to jitterTimestamp, as *rand.Rand is not safe for concurrent use
+// and the same source can be shared by many keys, such as Defaults.Rand which is merged into every key
+var jitterMutex sync.Mutex
+
+// jitterTimestamp is GetTimestamp with jitter drawn from source, or the global source if nil
+func (kc *KeyConfig) jitterTimestamp(now time.Time, source *rand.Rand) time.Time {
+	if kc.TTLJitter <= 0 {
+		return now
+	}
+	var jitter int64
+	if source != nil {
+		jitterMutex.Lock()
+		jitter = source.Int63n(kc.TTLJitter) + 1
+		jitterMutex.Unlock()
+	} else {
+		jitter = rand.Int63n(kc.TTLJitter) + 1
+	}
+	return now.Add(-1 * time.Duration(jitter) * time.Second)
+}
+
+// ENTRY_FORMAT_VERSION is prepended to every stored value so that the storage
+// format can change in future without misinterpreting older entries
+const ENTRY_FORMAT_VERSION byte = 1
+
+// encodeEntry prepends the entry format version to value
+func encodeEntry(value []byte) []byte {
+	return append([]byte{ENTRY_FORMAT_VERSION}, value...)
+}
+
+// ErrUnknownEntryVersion is reported to the Observer when a stored value is empty
+// or starts with a version other than ENTRY_FORMAT_VERSION, the entry is treated as a miss
+var ErrUnknownEntryVersion = errors.New("cachefunk: unknown entry format version")
+
+// decodeEntry strips the entry format version from value
+// returning ErrUnknownEntryVersion if value is empty or has an unknown version
+func decodeEntry(value []byte) ([]byte, error) {
+	if len(value) == 0 {
+		return nil, fmt.Errorf("%w: empty value", ErrUnknownEntryVersion)
+	}
+	if value[0] != ENTRY_FORMAT_VERSION {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownEntryVersion, value[0])
+	}
+	return value[1:], nil
+}
+
+// ADAPTIVE_COMPRESSION_MAX_RATIO is the compressed to uncompressed size ratio
+// at or above which AdaptiveCompression stops compressing a key
+const ADAPTIVE_COMPRESSION_MAX_RATIO = 0.9
+
+// ADAPTIVE_COMPRESSION_RECHECK is the number of values stored uncompressed for a key
+// before AdaptiveCompression samples its compression ratio again
+const ADAPTIVE_COMPRESSION_RECHECK = 100
+
+type compressionState struct {
+	disabled bool
+	skipped  int
+}
+
+// ErrValueTooLarge is reported to the Observer when a value is not stored
+// because it is larger than MaxValueBytes
+var ErrValueTooLarge = errors.New("cachefunk: value exceeds max value bytes")
+
+// checkValueSize returns ErrValueTooLarge if value is larger than MaxValueBytes
+func checkValueSize(config *KeyConfig, value []byte) error {
+	if config.MaxValueBytes > 0 && int64(len(value)) > config.MaxValueBytes {
+		return ErrValueTooLarge
+	}
+	return nil
+}
+
+// compressValue compresses value for key if compression is enabled,
+// returning ErrValueTooLarge if the result is larger than MaxValueBytes
+func (c *CacheFunkConfig) compressValue(key string, config *KeyConfig, value []byte) ([]byte, bool, error) {
+	value, isCompressed, err := c.compress(key, config, value)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := checkValueSize(config, value); err != nil {
+		return nil, false, err
+	}
+	return value, isCompressed, nil
+}
+
+// compress compresses value for key if compression is enabled
+// It returns the value to store and whether that value is compressed,
+// which must be stored with the entry as it can change between sets
+func (c *CacheFunkConfig) compress(key string, config *KeyConfig, value []byte) ([]byte, bool, error) {
+	if !config.UseCompression {
+		return value, false, nil
+	}
+	if c == nil || !c.AdaptiveCompression {
+		compressed, err := compressBytes(value)
+		return compressed, err == nil, err
+	}
+
+	c.mutex.Lock()
+	if c.compression == nil {
+		c.compression = make(map[string]*compressionState)
+	}
+	state, exists := c.compression[key]
+	if !exists {
+		state = &compressionState{}
+		c.compression[key] = state
+	}
+	if state.disabled && state.skipped < ADAPTIVE_COMPRESSION_RECHECK {
+		state.skipped += 1
+		c.mutex.Unlock()
+		return value, false, nil
+	}
+	c.mutex.Unlock()
+
+	compressed, err := compressBytes(value)
+	if err != nil {
+		return nil, false, err
+	}
+	effective := float64(len(compressed)) < float64(len(value))*ADAPTIVE_COMPRESSION_MAX_RATIO
+
+	c.mutex.Lock()
+	state.disabled = !effective
+	state.skipped = 0
+	c.mutex.Unlock()
+
+	if !effective {
+		return value, false, nil
+	}
+	return compressed, true, nil
 }
 
 func compressBytes(input []byte) ([]byte, error) {
@@ -48,15 +835,33 @@ func compressBytes(input []byte) ([]byte, error) {
 	writer.Write(input)
 	err := writer.Close()
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %w", ErrCompress, err)
 	}
 	return output.Bytes(), nil
 }
 
-func decompressBytes(input []byte) ([]byte, error) {
+// ErrCompress is wrapped around errors from compressing a value to store it
+var ErrCompress = errors.New("cachefunk: value could not be compressed")
+
+// ErrDecompressedSizeExceeded is returned when a value decompresses to more than MaxDecompressedSize
+var ErrDecompressedSizeExceeded = errors.New("cachefunk: decompressed size exceeds limit")
+
+// decompressBytes decompresses input, failing if the output is larger than limit
+// limit is ignored if it is <= 0
+func decompressBytes(input []byte, limit int64) ([]byte, error) {
 	reader, err := gzip.NewReader(bytes.NewReader(input))
 	if err != nil {
 		return nil, err
 	}
-	return io.ReadAll(reader)
+	if limit <= 0 {
+		return io.ReadAll(reader)
+	}
+	output, err := io.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(output)) > limit {
+		return nil, ErrDecompressedSizeExceeded
+	}
+	return output, nil
 }
@@ -0,0 +1,603 @@
+package cachefunk_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rohfle/cachefunk"
+)
+
+func TestKeyConfigGetTimestamp(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	config := &cachefunk.KeyConfig{TTL: 3600}
+	if timestamp := config.GetTimestamp(now); !timestamp.Equal(now) {
+		t.Fatalf("expected timestamp %s without jitter got %s", now, timestamp)
+	}
+
+	config = &cachefunk.KeyConfig{TTL: 3600, TTLJitter: 300, Rand: rand.New(rand.NewSource(42))}
+	var timestamps []time.Time
+	for i := 0; i < 100; i++ {
+		timestamp := config.GetTimestamp(now)
+		jitter := now.Sub(timestamp)
+		if jitter < time.Second || jitter > 300*time.Second {
+			t.Fatalf("expected jitter between 1s and 300s got %s", jitter)
+		}
+		timestamps = append(timestamps, timestamp)
+	}
+
+	config.Rand = rand.New(rand.NewSource(42))
+	for i, expected := range timestamps {
+		if timestamp := config.GetTimestamp(now); !timestamp.Equal(expected) {
+			t.Fatalf("draw %d: expected seeded timestamp %s got %s", i+1, expected, timestamp)
+		}
+	}
+}
+
+func writeTestConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal("failed to write config:", err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeTestConfig(t, `{
+		"defaults": {"ttl": 3600, "ttl_jitter": 300, "use_compression": true},
+		"configs": {
+			"hello": {"ttl": 60},
+			"world": {"ttl": 0},
+			"plain": {"ttl": 7200, "use_compression": false}
+		}
+	}`)
+
+	config, err := cachefunk.LoadConfig(path)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if config.Defaults == nil || config.Defaults.TTL != 3600 || config.Defaults.TTLJitter != 300 || !config.Defaults.UseCompression {
+		t.Errorf("unexpected defaults %+v", config.Defaults)
+	}
+	// a ttl_jitter of 300 is not below a ttl of 60 so it is not inherited
+	if hello := config.Get("hello"); hello.TTL != 60 || hello.TTLJitter != 0 || !hello.UseCompression {
+		t.Errorf("unexpected config for hello %+v", hello)
+	}
+	if plain := config.Get("plain"); plain.TTL != 7200 || plain.TTLJitter != 300 || plain.UseCompression {
+		t.Errorf("expected use_compression given as false to override defaults got %+v", plain)
+	}
+	if world := config.Get("world"); world.TTL != 0 {
+		t.Errorf("unexpected config for world %+v", world)
+	}
+	if other := config.Get("other"); other != config.Defaults {
+		t.Errorf("expected defaults for unconfigured key got %+v", other)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	testCases := []struct {
+		content  string
+		expected string
+	}{
+		{`{"configs": {"hello": {"ttl_jiter": 5}}}`, `config for key "hello": json: unknown field "ttl_jiter"`},
+		{`{"configs": {"hello": {"ttl": 5, "ttl_jitter": -1}}}`, `config for key "hello": ttl_jitter must not be negative`},
+		{`{"defaults": {"ttl_jitter": -1}}`, `defaults: ttl_jitter must not be negative`},
+		{`{"configs": {"hello": {"ttl": "5"}}}`, `config for key "hello": json: cannot unmarshal string`},
+		{`{"config": {}}`, `json: unknown field "config"`},
+		{`{"configs": `, `unexpected EOF`},
+	}
+
+	for line, tc := range testCases {
+		path := writeTestConfig(t, tc.content)
+		_, err := cachefunk.LoadConfig(path)
+		if err == nil {
+			t.Errorf("subtest %d: expected error containing %q but got nil", line+1, tc.expected)
+		} else if !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("subtest %d: expected error containing %q got %q", line+1, tc.expected, err)
+		}
+	}
+
+	if _, err := cachefunk.LoadConfig(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("expected error for missing config file")
+	}
+}
+
+func TestCacheFunkConfigValidate(t *testing.T) {
+	config := &cachefunk.CacheFunkConfig{
+		Defaults: &cachefunk.KeyConfig{TTL: 60, MaxValueBytes: -1},
+		Configs: map[string]*cachefunk.KeyConfig{
+			"fine":    {TTL: 60, TTLJitter: 10},
+			"hello":   {TTL: -1, TTLJitter: -1, ResolverRetries: -2},
+			"jitter":  {TTL: 60, TTLJitter: 60},
+			"discard": {TTL: 0, TTLJitter: 60},
+		},
+		MaxWorkers: -1,
+	}
+
+	err := config.Validate()
+	if err == nil {
+		t.Fatal("expected error for invalid configs")
+	}
+	expected := []string{
+		`max_workers must not be negative`,
+		`defaults: max_value_bytes must not be negative`,
+		`config for key "hello": ttl must not be negative`,
+		`config for key "hello": ttl_jitter must not be negative`,
+		`config for key "hello": resolver_retries must not be negative`,
+		`config for key "jitter": ttl_jitter must be less than ttl`,
+	}
+	for line, message := range expected {
+		if !strings.Contains(err.Error(), message) {
+			t.Errorf("subtest %d: expected error containing %q got %q", line+1, message, err)
+		}
+	}
+	for _, key := range []string{"fine", "discard"} {
+		if strings.Contains(err.Error(), fmt.Sprintf("%q", key)) {
+			t.Errorf("expected no error for key %s got %q", key, err)
+		}
+	}
+
+	valid := &cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{"hello": {TTL: 60}},
+	}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("expected valid config got %v", err)
+	}
+
+	path := writeTestConfig(t, `{"max_workers": 4, "configs": {"hello": {"ttl": 60}}}`)
+	if loaded, err := cachefunk.LoadConfig(path); err != nil || loaded.MaxWorkers != 4 {
+		t.Errorf("expected LoadConfig to load max_workers got %+v (err %v)", loaded, err)
+	}
+
+	path = writeTestConfig(t, `{"configs": {"a": {"ttl": -1}, "b": {"ttl": 5, "ttl_jitter": 5}}}`)
+	_, err = cachefunk.LoadConfig(path)
+	if err == nil || !strings.Contains(err.Error(), `"a"`) || !strings.Contains(err.Error(), `"b"`) {
+		t.Errorf("expected LoadConfig to report every invalid key got %v", err)
+	}
+}
+
+func TestKeyConfigMarshalUnmarshal(t *testing.T) {
+	config := &cachefunk.CacheFunkConfig{
+		Defaults: &cachefunk.KeyConfig{TTL: 3600, TTLJitter: 300, UseCompression: true},
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 60, RenderParams: cachefunk.RenderQueryStringParameters},
+			"world": {TTL: 60, MaxDecompressedSize: 1024},
+			"plain": (&cachefunk.KeyConfig{TTL: 60}).MarkSet("use_compression"),
+		},
+	}
+
+	raw, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if !strings.Contains(string(raw), `"render_params":"querystring"`) {
+		t.Errorf("expected render_params to be marshaled by name in %s", raw)
+	}
+
+	var decoded cachefunk.CacheFunkConfig
+	if err := json.Unmarshal(raw, &decoded); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if hello := decoded.Configs["hello"]; hello.TTL != 60 || hello.RenderParams == nil {
+		t.Errorf("unexpected config for hello %+v", hello)
+	} else if rendered, _ := hello.RenderParams(&HelloWorldParams{"Bob", 42}); rendered != "Age=42&Name=Bob" {
+		t.Errorf("expected query string render params got \"%s\"", rendered)
+	}
+	if world := decoded.Configs["world"]; world.RenderParams != nil || world.MaxDecompressedSize != 1024 {
+		t.Errorf("unexpected config for world %+v", world)
+	}
+	if defaults := decoded.Defaults; defaults == nil || defaults.TTL != 3600 || defaults.TTLJitter != 300 || !defaults.UseCompression {
+		t.Errorf("expected defaults %+v got %+v", config.Defaults, decoded.Defaults)
+	}
+	// only fields marked as set keep their zero value rather than being inherited
+	if world := decoded.Get("world"); !world.UseCompression {
+		t.Errorf("expected use_compression to be inherited for world got %+v", world)
+	}
+	if plain := decoded.Get("plain"); plain.UseCompression {
+		t.Errorf("expected use_compression marked as set to be kept for plain got %+v", plain)
+	}
+}
+
+func TestKeyConfigUnmarshalErrors(t *testing.T) {
+	testCases := []struct {
+		content  string
+		expected string
+	}{
+		{`{"ttl": 5, "render_params": ""}`, ""},
+		{`{"ttl": 5, "render_params": "hashed"}`, ""},
+		{`{"ttl": 5, "render_params": "jsonn"}`, `unknown render_params "jsonn"`},
+		{`{"ttl": 5, "use_compresion": true}`, `json: unknown field "use_compresion"`},
+	}
+
+	for line, tc := range testCases {
+		var config cachefunk.KeyConfig
+		err := json.Unmarshal([]byte(tc.content), &config)
+		if tc.expected == "" {
+			if err != nil {
+				t.Errorf("subtest %d: unexpected error: %s", line+1, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("subtest %d: expected error containing %q got %v", line+1, tc.expected, err)
+		}
+	}
+}
+
+func TestReloadConfigFromFile(t *testing.T) {
+	cache := cachefunk.NewDiskCache(t.TempDir())
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 60},
+		},
+	})
+
+	longTTL := writeTestConfig(t, `{"defaults": {"ttl": 60}, "configs": {"hello": {"ttl": 60}}}`)
+	noTTL := writeTestConfig(t, `{"defaults": {"ttl": 0}, "configs": {"hello": {"ttl": 0}}}`)
+
+	// readers and writers run while configs are swapped, go test -race will catch unsynchronized access
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for j := 0; ; j++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				params := fmt.Sprint(worker, "-", j%10)
+				cache.Set("hello", params, []byte("world"))
+				cache.Get("hello", params)
+				cache.Get("other", params)
+				cache.ExpiredEntryCount()
+			}
+		}(i)
+	}
+
+	for i := 0; i < 20; i++ {
+		path := longTTL
+		if i%2 == 1 {
+			path = noTTL
+		}
+		if err := cachefunk.ReloadConfigFromFile(cache, path); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	// the last config loaded has TTL 0, so new values are discarded
+	cache.Clear()
+	cache.Set("hello", "params", []byte("world"))
+	if count := cache.EntryCount(); count != 0 {
+		t.Fatalf("expected %d entries with reloaded TTL 0 got %d", 0, count)
+	}
+
+	if err := cachefunk.ReloadConfigFromFile(cache, longTTL); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	cache.Set("hello", "params", []byte("world"))
+	if count := cache.EntryCount(); count != 1 {
+		t.Fatalf("expected %d entries with reloaded TTL 60 got %d", 1, count)
+	}
+
+	broken := writeTestConfig(t, `{"configs": {"hello": {"ttl": -1, "ttl_jitter": -1}}}`)
+	if err := cachefunk.ReloadConfigFromFile(cache, broken); err == nil {
+		t.Fatal("expected error for invalid config")
+	}
+	if ttl := cache.GetConfig().Get("hello").TTL; ttl != 60 {
+		t.Fatalf("expected config to be kept after failed reload but got TTL %d", ttl)
+	}
+}
+
+func TestCacheFunkConfigGetMergesDefaults(t *testing.T) {
+	defaults := &cachefunk.KeyConfig{
+		TTL:                 3600,
+		TTLJitter:           300,
+		UseCompression:      true,
+		MaxDecompressedSize: 1024,
+		RenderParams:        cachefunk.RenderHashedParameters,
+	}
+	config := &cachefunk.CacheFunkConfig{
+		Defaults: defaults,
+		Configs: map[string]*cachefunk.KeyConfig{
+			"partial":  {TTL: 7200},
+			"override": {TTL: 0, MaxDecompressedSize: 10, RenderParams: cachefunk.RenderQueryStringParameters},
+			"short":    {TTL: 60},
+			"explicit": (&cachefunk.KeyConfig{TTL: 7200}).MarkSet("ttl_jitter", "use_compression"),
+		},
+	}
+
+	partial := config.Get("partial")
+	if partial.TTL != 7200 || partial.TTLJitter != 300 || !partial.UseCompression {
+		t.Errorf("expected TTL from the key config and TTLJitter and UseCompression to be inherited got %+v", partial)
+	}
+	if short := config.Get("short"); short.TTLJitter != 0 || !short.UseCompression {
+		t.Errorf("expected TTLJitter not below TTL not to be inherited got %+v", short)
+	}
+	if explicit := config.Get("explicit"); explicit.TTLJitter != 0 || explicit.UseCompression {
+		t.Errorf("expected fields marked as set to override defaults got %+v", explicit)
+	}
+	if partial.MaxDecompressedSize != 1024 {
+		t.Errorf("expected MaxDecompressedSize to be inherited got %d", partial.MaxDecompressedSize)
+	}
+	if rendered, _ := partial.RenderParams(nil); len(rendered) != 64 {
+		t.Errorf("expected RenderParams to be inherited got \"%s\"", rendered)
+	}
+
+	override := config.Get("override")
+	if override.TTL != 0 || override.MaxDecompressedSize != 10 {
+		t.Errorf("expected key config fields to override defaults got %+v", override)
+	}
+	if rendered, _ := override.RenderParams(map[string]int{"a": 1}); rendered != "a=1" {
+		t.Errorf("expected RenderParams to be overridden got \"%s\"", rendered)
+	}
+
+	if config.Configs["partial"].MaxDecompressedSize != 0 {
+		t.Error("expected merging to not modify the key config")
+	}
+	if other := config.Get("other"); other != defaults {
+		t.Errorf("expected defaults for unconfigured key got %+v", other)
+	}
+
+	// merged configs are kept until the key config is replaced
+	if config.Get("partial") != partial {
+		t.Error("expected the merged config to be reused")
+	}
+	config.Set("partial", &cachefunk.KeyConfig{TTL: 30})
+	if replaced := config.Get("partial"); replaced == partial || replaced.TTL != 30 {
+		t.Errorf("expected the merged config to be replaced got %+v", replaced)
+	}
+}
+
+func TestKeyConfigGetExpireTime(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		ttl      int64
+		expected time.Time
+	}{
+		{0, now},
+		{60, now.Add(-60 * time.Second)},
+		{31536000, now.Add(-31536000 * time.Second)},
+		{-60, now.Add(60 * time.Second)},
+	}
+
+	for line, tc := range testCases {
+		config := &cachefunk.KeyConfig{TTL: tc.ttl}
+		if expireTime := config.GetExpireTime(now); !expireTime.Equal(tc.expected) {
+			t.Errorf("subtest %d: expected %s got %s", line+1, tc.expected, expireTime)
+		}
+	}
+
+	// an entry stored with jitter expires up to TTLJitter seconds early
+	config := &cachefunk.KeyConfig{TTL: 60, TTLJitter: 10, Rand: rand.New(rand.NewSource(1))}
+	timestamp := config.GetTimestamp(now)
+	if !timestamp.Before(config.GetExpireTime(now.Add(60 * time.Second))) {
+		t.Error("expected entry to have expired after TTL")
+	}
+	if timestamp.Before(config.GetExpireTime(now.Add(50 * time.Second))) {
+		t.Error("expected entry to not have expired before TTL - TTLJitter")
+	}
+}
+
+func TestKeyConfigTTLMax(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	stored := time.Date(1800, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		ttl         int64
+		immediate   bool
+		neverExpire bool
+		expired     bool
+	}{
+		{-1, true, false, true},
+		{0, true, false, true},
+		{1, false, false, true},
+		{cachefunk.TTL_MAX - 1, false, false, false},
+		{cachefunk.TTL_MAX, false, false, false},
+		{cachefunk.TTL_MAX + 1, false, true, false},
+		{math.MaxInt64, false, true, false},
+	}
+
+	for line, tc := range testCases {
+		config := &cachefunk.KeyConfig{TTL: tc.ttl}
+		if immediate := config.IsImmediateExpire(); immediate != tc.immediate {
+			t.Errorf("subtest %d: expected IsImmediateExpire %v got %v", line+1, tc.immediate, immediate)
+		}
+		if neverExpire := config.IsNeverExpire(); neverExpire != tc.neverExpire {
+			t.Errorf("subtest %d: expected IsNeverExpire %v got %v", line+1, tc.neverExpire, neverExpire)
+		}
+		// the expire time must move back as TTL grows rather than overflowing into the future
+		expireTime := config.GetExpireTime(now)
+		if expireTime.After(now) != (tc.ttl < 0) {
+			t.Errorf("subtest %d: expected expire time before now got %s", line+1, expireTime)
+		}
+		if expired := stored.Before(expireTime); expired != tc.expired {
+			t.Errorf("subtest %d: expected expired %v got %v", line+1, tc.expired, expired)
+		}
+	}
+}
+
+func TestCacheFunkConfigClock(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	config := &cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 60},
+		},
+		Clock: func() time.Time { return now },
+	}
+
+	cache := cachefunk.NewInMemoryCache()
+	cache.SetConfig(config)
+	cache.Set("hello", "params", []byte("world"))
+	if entry := cache.Store["hello:params"]; !entry.Timestamp.Equal(now) {
+		t.Fatalf("expected entry timestamp %s from clock got %s", now, entry.Timestamp)
+	}
+
+	now = now.Add(60 * time.Second)
+	if _, found := cache.Get("hello", "params"); !found {
+		t.Fatal("expected entry to be found at TTL")
+	}
+	if count := cache.ExpiredEntryCount(); count != 0 {
+		t.Fatalf("expected %d expired entries at TTL got %d", 0, count)
+	}
+
+	now = now.Add(time.Second)
+	if count := cache.ExpiredEntryCount(); count != 1 {
+		t.Fatalf("expected %d expired entries after TTL got %d", 1, count)
+	}
+	if _, found := cache.Get("hello", "params"); found {
+		t.Fatal("expected entry to have expired after TTL")
+	}
+
+	var nilConfig *cachefunk.CacheFunkConfig
+	if nilConfig.Now().IsZero() {
+		t.Fatal("expected Now on nil config to return the current time")
+	}
+}
+
+func TestCacheFunkConfigJitterSeed(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	keyConfig := &cachefunk.KeyConfig{TTL: 3600, TTLJitter: 3600}
+	timestamps := func(seed int64) []time.Time {
+		config := &cachefunk.CacheFunkConfig{
+			Clock:      func() time.Time { return now },
+			JitterSeed: seed,
+		}
+		var result []time.Time
+		for i := 0; i < 10; i++ {
+			result = append(result, config.GetTimestamp(keyConfig))
+		}
+		return result
+	}
+
+	first := timestamps(cachefunk.SeedFromInstanceID("instance-1"))
+	again := timestamps(cachefunk.SeedFromInstanceID("instance-1"))
+	second := timestamps(cachefunk.SeedFromInstanceID("instance-2"))
+
+	sameAsSecond := true
+	for i := range first {
+		if !first[i].Equal(again[i]) {
+			t.Errorf("subtest %d: expected the same seed to give %s got %s", i+1, first[i], again[i])
+		}
+		if !first[i].Equal(second[i]) {
+			sameAsSecond = false
+		}
+	}
+	if sameAsSecond {
+		t.Error("expected different instance IDs to give different jitter")
+	}
+}
+
+func TestKeyConfigSharedRand(t *testing.T) {
+	// Defaults.Rand is merged into every key, so Sets on different keys draw from it at once
+	config := &cachefunk.CacheFunkConfig{
+		Defaults: &cachefunk.KeyConfig{Rand: rand.New(rand.NewSource(42))},
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello":   {TTL: 3600, TTLJitter: 300},
+			"goodbye": {TTL: 3600, TTLJitter: 300},
+		},
+	}
+	keyConfigs := []*cachefunk.KeyConfig{config.Get("hello"), config.Get("goodbye")}
+	if keyConfigs[0].Rand != keyConfigs[1].Rand {
+		t.Fatal("expected keys to share Defaults.Rand")
+	}
+
+	var wg sync.WaitGroup
+	for _, keyConfig := range keyConfigs {
+		wg.Add(1)
+		go func(keyConfig *cachefunk.KeyConfig) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				config.GetTimestamp(keyConfig)
+			}
+		}(keyConfig)
+	}
+	wg.Wait()
+}
+
+func TestApplyEnvOverrides(t *testing.T) {
+	hello := &cachefunk.KeyConfig{TTL: 60}
+	config := &cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello":       hello,
+			"hello-world": {TTL: 60, UseCompression: true},
+		},
+	}
+
+	err := cachefunk.ApplyEnvOverrides(config, []string{
+		"PATH=/usr/bin",
+		"CACHEFUNK_HELLO_TTL=120",
+		"CACHEFUNK_HELLO_TTL_JITTER=10",
+		"CACHEFUNK_HELLO_RENDER_PARAMS=querystring",
+		"CACHEFUNK_HELLO_WORLD_USE_COMPRESSION=false",
+		"CACHEFUNK_DEFAULTS_TTL=30",
+		"CACHEFUNK_DEFAULTS_TTL_JITTER=5",
+	})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	helloConfig := config.Get("hello")
+	if helloConfig.TTL != 120 || helloConfig.TTLJitter != 10 || helloConfig.RenderParams == nil {
+		t.Errorf("expected hello overrides to be applied got %+v", helloConfig)
+	}
+	if hello.TTL != 60 {
+		t.Errorf("expected original KeyConfig to be unchanged got TTL %d", hello.TTL)
+	}
+	if worldConfig := config.Get("hello-world"); worldConfig.TTL != 60 || worldConfig.UseCompression {
+		t.Errorf("expected hello-world overrides to be applied got %+v", worldConfig)
+	}
+	if config.Defaults == nil || config.Defaults.TTL != 30 || config.Defaults.TTLJitter != 5 || !config.Defaults.UseCompression {
+		t.Errorf("expected defaults to be DEFAULT_KEYCONFIG with TTL 30 and TTLJitter 5 got %+v", config.Defaults)
+	}
+}
+
+func TestApplyEnvOverridesErrors(t *testing.T) {
+	testCases := []struct {
+		variable string
+		expected string
+	}{
+		{"CACHEFUNK_HELLO_TTL=abc", `CACHEFUNK_HELLO_TTL: invalid value "abc"`},
+		{"CACHEFUNK_HELLO_TTL_JITTER=-1", "ttl_jitter must not be negative"},
+		{"CACHEFUNK_HELLO_USE_COMPRESSION=maybe", `CACHEFUNK_HELLO_USE_COMPRESSION: invalid value "maybe"`},
+		{"CACHEFUNK_HELLO_RENDER_PARAMS=xml", `unknown render_params "xml"`},
+		{"CACHEFUNK_HELLO_TTLX=5", "CACHEFUNK_HELLO_TTLX: unknown setting"},
+		{"CACHEFUNK_WORLD_TTL=5", "CACHEFUNK_WORLD_TTL: no config for key WORLD"},
+		// values are checked with Validate like LoadConfig does
+		{"CACHEFUNK_HELLO_MAX_VALUE_BYTES=-5", `config for key "hello": max_value_bytes must not be negative`},
+		{"CACHEFUNK_HELLO_RESOLVER_RETRIES=-1", `config for key "hello": resolver_retries must not be negative`},
+		{"CACHEFUNK_HELLO_TTL_JITTER=60", `config for key "hello": ttl_jitter must be less than ttl`},
+		{"CACHEFUNK_DEFAULTS_TTL=-1", "defaults: ttl must not be negative"},
+		{"CACHEFUNK_A_B_TTL=5", `CACHEFUNK_A_B_TTL: keys ["a-b" "a_b"] have the same name in variables`},
+	}
+
+	for line, tc := range testCases {
+		config := &cachefunk.CacheFunkConfig{
+			Configs: map[string]*cachefunk.KeyConfig{
+				"hello": {TTL: 60},
+				"a-b":   {TTL: 60},
+				"a_b":   {TTL: 60},
+			},
+		}
+		err := cachefunk.ApplyEnvOverrides(config, []string{tc.variable})
+		if err == nil {
+			t.Errorf("subtest %d: expected error containing %q but got nil", line+1, tc.expected)
+		} else if !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("subtest %d: expected error containing %q got %q", line+1, tc.expected, err)
+		}
+		if config.Get("hello").TTL != 60 {
+			t.Errorf("subtest %d: expected config to be unchanged after error", line+1)
+		}
+	}
+}
@@ -1,25 +1,54 @@
 package cachefunk
 
 import (
+	"compress/gzip"
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 type DiskCache struct {
 	CacheConfig       *CacheFunkConfig
+	configMutex       sync.RWMutex
 	BasePath          string
 	CalculatePath     func(cacheKey string, params string) []string
-	IgnoreCacheCtxKey CtxKey
+	IgnoreCacheCtxKey interface{}
+	// MaxBytes is the total size of entries Evict reduces the cache to, no limit if 0
+	MaxBytes int64
+	// EvictEvery runs Evict after every EvictEvery writes when MaxBytes is set, never if 0
+	EvictEvery int64
+	// ReadConcurrency is the most files GetMany reads at once, DEFAULT_DISK_READ_CONCURRENCY if 0
+	ReadConcurrency int
+	writeCount      atomic.Int64
 }
 
+// SetConfig swaps the config used by the cache, which is safe to do while the cache is in use
 func (c *DiskCache) SetConfig(config *CacheFunkConfig) {
+	c.configMutex.Lock()
+	defer c.configMutex.Unlock()
+	config.resetMerged()
 	c.CacheConfig = config
 }
 
+func (c *DiskCache) GetConfig() *CacheFunkConfig {
+	c.configMutex.RLock()
+	defer c.configMutex.RUnlock()
+	return c.CacheConfig
+}
+
 // Returns the
 func DefaultCalculatePath(cacheKey string, params string) []string {
 	data := sha256.Sum256([]byte(params))
@@ -27,6 +56,37 @@ func DefaultCalculatePath(cacheKey string, params string) []string {
 	return []string{cacheKey, hash[0:2], hash[2:4], hash}
 }
 
+// READABLE_PARAMS_MAX_LENGTH is the most bytes of params kept in file names by ReadableCalculatePath
+const READABLE_PARAMS_MAX_LENGTH = 100
+
+// ReadableCalculatePath is a CalculatePath function that keeps params readable in file names,
+// such as "__Name___Bob__-obUtynaNS90s" for {"Name":"Bob"}, to help debugging when params are short.
+// Characters other than letters, digits and "-_=.,+@" are replaced with "_", params are truncated
+// to READABLE_PARAMS_MAX_LENGTH bytes, and a short hash of the full params is appended so
+// params that sanitize or truncate the same are still stored in different files.
+func ReadableCalculatePath(cacheKey string, params string) []string {
+	data := sha256.Sum256([]byte(params))
+	hash := base64.URLEncoding.EncodeToString(data[:])
+
+	var name strings.Builder
+	for _, r := range params {
+		if name.Len()+utf8.RuneLen(r) > READABLE_PARAMS_MAX_LENGTH {
+			break
+		}
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("-_=.,+@", r) {
+			name.WriteRune(r)
+		} else {
+			name.WriteRune('_')
+		}
+	}
+	readable := name.String()
+	// names starting with "." could be "..", or hidden or temporary files
+	if strings.HasPrefix(readable, ".") {
+		readable = "_" + readable[1:]
+	}
+	return []string{cacheKey, hash[0:2], hash[2:4], readable + "-" + hash[:12]}
+}
+
 func NewDiskCache(basePath string, calcPathFn ...func(string, string) []string) *DiskCache {
 	if len(calcPathFn) == 0 {
 		calcPathFn = append(calcPathFn, DefaultCalculatePath)
@@ -40,81 +100,357 @@ func NewDiskCache(basePath string, calcPathFn ...func(string, string) []string)
 	return &cache
 }
 
-func (c *DiskCache) GetIgnoreCacheCtxKey() CtxKey {
+func (c *DiskCache) GetIgnoreCacheCtxKey() interface{} {
 	return c.IgnoreCacheCtxKey
 }
 
-func (c *DiskCache) getCacheItemPath(cacheKey string, params string, useCompression bool) string {
-	bits := append([]string{c.BasePath}, c.CalculatePath(cacheKey, params)...)
-	path := filepath.Join(bits...)
+// ErrInvalidKey is reported when a key cannot be used as a directory under BasePath,
+// such as a key that is empty, contains a path separator or uses ".." to escape BasePath
+var ErrInvalidKey = errors.New("cachefunk: key is not a valid directory name")
+
+// keyPath returns the directory for the entries of key, or ErrInvalidKey if it is not a single directory
+// inside BasePath. Keys cannot nest, or clearing and cleaning up a key would reach into the keys below it
+func (c *DiskCache) keyPath(key string) (string, error) {
+	if strings.ContainsAny(key, `/\`) || !filepath.IsLocal(key) || filepath.Clean(key) == "." {
+		return "", ErrInvalidKey
+	}
+	return filepath.Join(c.BasePath, key), nil
+}
+
+// getCacheItemPath returns the path of the file for key and params, checking that it is inside BasePath
+// in case CalculatePath does not use the key as the first directory
+func (c *DiskCache) getCacheItemPath(cacheKey string, params string, useCompression bool) (string, error) {
+	if _, err := c.keyPath(cacheKey); err != nil {
+		return "", err
+	}
+	relative := filepath.Join(c.CalculatePath(cacheKey, params)...)
+	if !filepath.IsLocal(relative) {
+		return "", ErrInvalidKey
+	}
+	path := filepath.Join(c.BasePath, relative)
 	if useCompression {
 		path += ".gz"
 	}
-	return path
+	return path, nil
+}
+
+// statCacheItem finds the file for a cache entry, trying the configured compression first
+// Entries can be stored either way regardless of the current config, see AdaptiveCompression
+func (c *DiskCache) statCacheItem(key string, params string, useCompression bool) (string, fs.FileInfo, bool, error) {
+	path, err := c.getCacheItemPath(key, params, useCompression)
+	if err != nil {
+		return "", nil, false, err
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		useCompression = !useCompression
+		path, _ = c.getCacheItemPath(key, params, useCompression)
+		stat, err = os.Stat(path)
+	}
+	return path, stat, useCompression, err
 }
 
 func (c *DiskCache) Get(key string, params string) ([]byte, bool) {
-	config := c.CacheConfig.Get(key)
-	path := c.getCacheItemPath(key, params, config.UseCompression)
+	value, _, found := c.GetWithInfo(key, params)
+	return value, found
+}
+
+func (c *DiskCache) GetWithInfo(key string, params string) ([]byte, EntryInfo, bool) {
+	config := c.GetConfig().Get(key)
 
 	// check if path exists
-	stat, err := os.Stat(path)
+	path, stat, isCompressed, err := c.statCacheItem(key, params, config.UseCompression)
 	if err != nil {
-		return nil, false
+		return nil, EntryInfo{}, false
+	}
+	info := EntryInfo{
+		Params:       params,
+		Timestamp:    stat.ModTime(),
+		Size:         stat.Size(),
+		IsCompressed: isCompressed,
 	}
 
 	// check if path modtime is older than ttl
-	expiry := stat.ModTime().Add(time.Second * time.Duration(config.TTL))
-	if time.Now().UTC().After(expiry) {
+	if stat.ModTime().Before(config.GetExpireTime(c.GetConfig().Now())) {
 		os.Remove(path)
-		return nil, false
+		c.GetConfig().notifyExpired(key)
+		return nil, info, false
 	}
 
-	value, err := os.ReadFile(path)
+	raw, err := os.ReadFile(path)
 	if err != nil {
-		return nil, false
+		return nil, EntryInfo{}, false
+	}
+
+	value, err := decodeEntry(raw)
+	if err != nil {
+		os.Remove(path)
+		c.GetConfig().notifyGetError(key, err)
+		return nil, EntryInfo{}, false
 	}
 
 	// if data is compressed, decompress before return
-	if config.UseCompression {
+	if isCompressed {
 		var err error
-		value, err = decompressBytes(value)
+		value, err = decompressBytes(value, config.MaxDecompressedSize)
 		if err != nil {
-			return nil, false
+			os.Remove(path)
+			return nil, EntryInfo{}, false
+		}
+	}
+	return value, info, true
+}
+
+// DEFAULT_DISK_READ_CONCURRENCY is the most files DiskCache.GetMany reads at once by default
+const DEFAULT_DISK_READ_CONCURRENCY = 16
+
+// GetMany will get many cache values for a key, reading up to ReadConcurrency files at once
+// Files are read in the calling goroutine when the config has no worker free, see MaxWorkers
+func (c *DiskCache) GetMany(key string, paramsList []string) map[string][]byte {
+	values := make(map[string][]byte, len(paramsList))
+	concurrency := c.ReadConcurrency
+	if concurrency <= 0 {
+		concurrency = DEFAULT_DISK_READ_CONCURRENCY
+	}
+	slots := make(chan struct{}, concurrency)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for _, params := range paramsList {
+		wg.Add(1)
+		slots <- struct{}{}
+		params := params
+		read := func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if value, found := c.Get(key, params); found {
+				mutex.Lock()
+				values[params] = value
+				mutex.Unlock()
+			}
+		}
+		if !c.GetConfig().goWorker(read) {
+			read()
 		}
 	}
-	return value, true
+	wg.Wait()
+	return values
 }
 
 // Set will set a cache value by its key and params
 func (c *DiskCache) Set(key string, params string, value []byte) {
-	config := c.CacheConfig.Get(key)
-	if config.TTL <= 0 {
+	config := c.GetConfig().Get(key)
+	if config.IsImmediateExpire() {
 		return // immediately discard the entry
 	}
 
-	timestamp := time.Now().UTC()
-	if config.TTLJitter > 0 {
-		timestamp = timestamp.Add(-1 * time.Duration(config.TTLJitter) * time.Second)
+	timestamp := c.GetConfig().GetTimestamp(config)
+
+	value, isCompressed, err := c.GetConfig().compressValue(key, config, value)
+	if err != nil {
+		c.GetConfig().notifySetError(key, err)
+		return
 	}
 
-	if config.UseCompression {
-		var err error
-		value, err = compressBytes(value)
-		if err != nil {
+	c.SetRaw(key, params, value, timestamp, isCompressed)
+}
+
+// SetMany will set many cache values for a key
+func (c *DiskCache) SetMany(key string, values map[string][]byte) {
+	for params, value := range values {
+		c.Set(key, params, value)
+	}
+}
+
+func (c *DiskCache) SetRaw(key string, params string, value []byte, timestamp time.Time, useCompression bool) {
+	err := c.writeCacheItem(key, params, timestamp, useCompression, func(w io.Writer) error {
+		_, err := w.Write(encodeEntry(value))
+		return err
+	})
+	if errors.Is(err, ErrInvalidKey) {
+		c.GetConfig().notifySetError(key, err)
+	}
+}
+
+// writeCacheItem writes a cache entry file, removing any copy stored with the other compression
+func (c *DiskCache) writeCacheItem(key string, params string, timestamp time.Time, useCompression bool, write func(w io.Writer) error) error {
+	path, err := c.getCacheItemPath(key, params, useCompression)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, timestamp, c.GetConfig().Now(), write); err != nil {
+		return err
+	}
+	otherPath, _ := c.getCacheItemPath(key, params, !useCompression)
+	os.Remove(otherPath)
+	if c.MaxBytes > 0 && c.EvictEvery > 0 && c.writeCount.Add(1)%c.EvictEvery == 0 {
+		c.Evict()
+	}
+	return nil
+}
+
+// Evict deletes the oldest entries by modtime until the total size of entries is at most MaxBytes
+func (c *DiskCache) Evict() CleanupResult {
+	var result CleanupResult
+	if c.MaxBytes <= 0 {
+		return result
+	}
+
+	type entryFile struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var files []entryFile
+	var total int64
+	result.Errors = c.iterateFiles(c.BasePath, func(parent string, file fs.DirEntry) {
+		if strings.HasPrefix(file.Name(), ".tmp-") {
 			return
 		}
+		if info, err := file.Info(); err == nil {
+			files = append(files, entryFile{filepath.Join(parent, file.Name()), info.Size(), info.ModTime()})
+			total += info.Size()
+		}
+	})
+	if total <= c.MaxBytes {
+		return result
 	}
 
-	c.SetRaw(key, params, value, timestamp, config.UseCompression)
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+	for _, file := range files {
+		if total <= c.MaxBytes {
+			break
+		}
+		err := os.Remove(file.path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			result.Errors = append(result.Errors, err)
+			continue
+		}
+		total -= file.size
+		if err == nil {
+			result.Removed += 1
+		}
+	}
+	return result
 }
 
-func (c *DiskCache) SetRaw(key string, params string, value []byte, timestamp time.Time, useCompression bool) {
-	path := c.getCacheItemPath(key, params, useCompression)
-	dirs, _ := filepath.Split(path)
-	os.MkdirAll(dirs, 0755)
-	os.WriteFile(path, value, 0644)
-	os.Chtimes(path, time.Now().UTC(), timestamp)
+// writeFileAtomic writes to a temporary file in the same directory as path
+// and then renames it into place, so readers never see a partially written file
+// The temporary file has its modtime set to timestamp before the rename, so created is
+// kept in its name for cleanup to tell how long ago it was written, see tempFileCreated
+func writeFileAtomic(path string, timestamp time.Time, created time.Time, write func(w io.Writer) error) error {
+	dir, _ := filepath.Split(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(dir, fmt.Sprintf(".tmp-%d.*", created.UnixNano()))
+	if err != nil {
+		return err
+	}
+	tempPath := file.Name()
+
+	err = write(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tempPath, 0644)
+	}
+	if err == nil {
+		err = os.Chtimes(tempPath, time.Now().UTC(), timestamp)
+	}
+	if err == nil {
+		err = os.Rename(tempPath, path)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+	}
+	return err
+}
+
+// SetStream will set a cache value by reading it from r
+// The value is compressed as it is written so it is never fully buffered in memory
+func (c *DiskCache) SetStream(key string, params string, r io.Reader) error {
+	config := c.GetConfig().Get(key)
+	if config.IsImmediateExpire() {
+		return nil // immediately discard the entry
+	}
+
+	timestamp := c.GetConfig().GetTimestamp(config)
+	return c.writeCacheItem(key, params, timestamp, config.UseCompression, func(w io.Writer) error {
+		return writeStream(w, r, config.UseCompression)
+	})
+}
+
+func writeStream(w io.Writer, r io.Reader, useCompression bool) error {
+	if _, err := w.Write([]byte{ENTRY_FORMAT_VERSION}); err != nil {
+		return err
+	}
+	if !useCompression {
+		_, err := io.Copy(w, r)
+		return err
+	}
+	writer := gzip.NewWriter(w)
+	if _, err := io.Copy(writer, r); err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+// GetStream will get a reader for a cache value
+// The value is decompressed as it is read so it is never fully buffered in memory
+func (c *DiskCache) GetStream(key string, params string) (io.ReadCloser, bool) {
+	config := c.GetConfig().Get(key)
+	path, _, isCompressed, err := c.statCacheItem(key, params, config.UseCompression)
+	if err != nil {
+		return nil, false
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, false
+	}
+
+	// check if path modtime is older than ttl
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, false
+	}
+	if stat.ModTime().Before(config.GetExpireTime(c.GetConfig().Now())) {
+		file.Close()
+		os.Remove(path)
+		c.GetConfig().notifyExpired(key)
+		return nil, false
+	}
+
+	version := make([]byte, 1)
+	if _, err := io.ReadFull(file, version); err != nil {
+		file.Close()
+		return nil, false
+	}
+	if _, err := decodeEntry(version); err != nil {
+		file.Close()
+		c.GetConfig().notifyGetError(key, err)
+		return nil, false
+	}
+
+	if !isCompressed {
+		return file, true
+	}
+
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, false
+	}
+	var stream io.Reader = reader
+	if config.MaxDecompressedSize > 0 {
+		stream = &sizeLimitReader{reader: reader, limit: config.MaxDecompressedSize}
+	}
+	return &streamReadCloser{Reader: stream, closers: []io.Closer{reader, file}}, true
 }
 
 // Clear will delete all cache entries
@@ -123,37 +459,232 @@ func (c *DiskCache) Clear() {
 	os.Mkdir(c.BasePath, 0755)
 }
 
+// ClearKey will delete all cache entries for key
+// Keys that are not valid relative paths are ignored, see ErrInvalidKey
+func (c *DiskCache) ClearKey(key string) {
+	if keyPath, err := c.keyPath(key); err == nil {
+		os.RemoveAll(keyPath)
+	}
+}
+
+// Delete removes both the compressed and uncompressed files for key and params
+func (c *DiskCache) Delete(key string, params string) {
+	for _, useCompression := range []bool{false, true} {
+		if path, err := c.getCacheItemPath(key, params, useCompression); err == nil {
+			os.Remove(path)
+		}
+	}
+}
+
 // Cleanup will delete all cache entries that have expired
 func (c *DiskCache) Cleanup() {
-	now := time.Now().UTC()
-	for key, config := range c.CacheConfig.Configs {
-		basePath := filepath.Join(c.BasePath, key)
-		cutoff := now.Add(-1 * time.Duration(config.TTL) * time.Second)
-		c.IterateFiles(basePath, func(parent string, file fs.DirEntry) {
-			if info, err := file.Info(); err == nil {
-				if info.ModTime().Before(cutoff) {
-					os.Remove(filepath.Join(parent, file.Name()))
+	c.CleanupWithResult()
+}
+
+// CleanupWithResult deletes expired entries like Cleanup
+// Leftover temporary files are deleted but not counted as entries
+func (c *DiskCache) CleanupWithResult() CleanupResult {
+	return c.CleanupBatch(0)
+}
+
+// CleanupBatch deletes at most maxDeletes expired entries, or all of them if maxDeletes is 0 or less
+// Leftover temporary files are deleted but not counted towards maxDeletes
+func (c *DiskCache) CleanupBatch(maxDeletes int) CleanupResult {
+	var result CleanupResult
+	now := c.GetConfig().Now()
+	for key, config := range c.GetConfig().KeyConfigs() {
+		c.removeBefore(key, config.GetExpireTime(now), maxDeletes, &result)
+	}
+	return result
+}
+
+// ForceCleanup deletes the files of key modified more than maxAge ago, see the ForceCleanup function
+func (c *DiskCache) ForceCleanup(key string, maxAge time.Duration) CleanupResult {
+	var result CleanupResult
+	c.removeBefore(key, forceCleanupCutoff(c, maxAge), 0, &result)
+	return result
+}
+
+// DISK_TEMP_FILE_GRACE is how old a leftover temporary file from Set must be before cleanup removes it,
+// so that files still being written are not deleted from under Set
+const DISK_TEMP_FILE_GRACE = time.Minute
+
+// tempFileCreated returns when the temporary file name was created by writeFileAtomic
+// Its modtime is moved to the entry timestamp before it is renamed into place, so it is only
+// used for temporary files named without a creation time
+func tempFileCreated(name string, info fs.FileInfo) time.Time {
+	created, _, _ := strings.Cut(strings.TrimPrefix(name, ".tmp-"), ".")
+	if nanos, err := strconv.ParseInt(created, 10, 64); err == nil {
+		return time.Unix(0, nanos)
+	}
+	return info.ModTime()
+}
+
+// removeBefore deletes the files of key modified before cutoff, adding them to result
+// until it has removed maxDeletes entries, or without limit if maxDeletes is 0 or less
+// Leftover temporary files are deleted once DISK_TEMP_FILE_GRACE has passed since they were created
+func (c *DiskCache) removeBefore(key string, cutoff time.Time, maxDeletes int, result *CleanupResult) {
+	basePath, err := c.keyPath(key)
+	if err != nil {
+		result.Errors = append(result.Errors, fmt.Errorf("%w: %q", err, key))
+		return
+	}
+	now := c.GetConfig().Now()
+	errs := c.iterateFiles(basePath, func(parent string, file fs.DirEntry) {
+		if maxDeletes > 0 && result.Removed >= int64(maxDeletes) {
+			return
+		}
+		if info, err := file.Info(); err == nil {
+			isTemp := strings.HasPrefix(file.Name(), ".tmp-")
+			if isTemp {
+				// temporary files are judged by when they were created rather than their modtime
+				if now.Sub(tempFileCreated(file.Name(), info)) < DISK_TEMP_FILE_GRACE {
+					return // may still be being written by Set
+				}
+			}
+			if isTemp || info.ModTime().Before(cutoff) {
+				err := os.Remove(filepath.Join(parent, file.Name()))
+				if err != nil && !errors.Is(err, fs.ErrNotExist) {
+					result.Errors = append(result.Errors, err)
+				} else if err == nil && !isTemp {
+					result.Removed += 1
 				}
 			}
+		}
+	})
+	result.Errors = append(result.Errors, errs...)
+}
+
+// KeyEntries lists the files stored under the key directory
+// Params are hashed into the file path so only the file name can be reported
+func (c *DiskCache) KeyEntries(key string) []EntryInfo {
+	var entries []EntryInfo
+	keyPath, err := c.keyPath(key)
+	if err != nil {
+		return nil
+	}
+	c.IterateFiles(keyPath, func(parent string, file fs.DirEntry) {
+		info, err := file.Info()
+		if err != nil {
+			return
+		}
+		name := file.Name()
+		isCompressed := strings.HasSuffix(name, ".gz")
+		entries = append(entries, EntryInfo{
+			Params:       strings.TrimSuffix(name, ".gz"),
+			Timestamp:    info.ModTime(),
+			Size:         info.Size(),
+			IsCompressed: isCompressed,
 		})
+	})
+	return entries
+}
+
+// Iterate walks the files under BasePath, reporting the directory above the two hash directories
+// added by DefaultCalculatePath as the key.
+// Params are hashed into the file path so only the file name can be reported, as in KeyEntries
+func (c *DiskCache) Iterate(fn func(key string, params string, timestamp time.Time) bool) error {
+	stopped := false
+	errs := c.iterateFiles(c.BasePath, func(parent string, file fs.DirEntry) {
+		if stopped || !isLogicalEntry(parent, file.Name()) {
+			return
+		}
+		info, err := file.Info()
+		if err != nil {
+			return
+		}
+		relative, err := filepath.Rel(c.BasePath, parent)
+		if err != nil {
+			return
+		}
+		stopped = !fn(diskEntryKey(filepath.ToSlash(relative)), strings.TrimSuffix(file.Name(), ".gz"), info.ModTime())
+	})
+	return errors.Join(errs...)
+}
+
+// diskEntryKey returns the key of an entry in dir, a slash separated path relative to the base path,
+// by removing the two hash directories added by DefaultCalculatePath
+func diskEntryKey(dir string) string {
+	bits := strings.Split(dir, "/")
+	if len(bits) > 2 {
+		bits = bits[:len(bits)-2]
 	}
+	return strings.Join(bits, "/")
 }
 
 func (c *DiskCache) EntryCount() int64 {
 	var count int64
 	c.IterateFiles(c.BasePath, func(parent string, file fs.DirEntry) {
-		count += 1
+		if isLogicalEntry(parent, file.Name()) {
+			count += 1
+		}
+	})
+	return count
+}
+
+// isLogicalEntry reports whether a file should be counted as a cache entry
+// Temporary files are skipped, and a compressed file is skipped if an uncompressed
+// copy of the same entry also exists, so each entry is only counted once
+func isLogicalEntry(parent string, name string) bool {
+	if strings.HasPrefix(name, ".tmp-") {
+		return false
+	}
+	if strings.HasSuffix(name, ".gz") {
+		if _, err := os.Stat(filepath.Join(parent, strings.TrimSuffix(name, ".gz"))); err == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// PurgeOrphans removes the older copy of entries for key that are stored both
+// compressed and uncompressed, returning the number of files removed
+// Orphaned copies can be left behind by interrupted writes or older versions of the cache
+func (c *DiskCache) PurgeOrphans(key string) int64 {
+	var count int64
+	keyPath, err := c.keyPath(key)
+	if err != nil {
+		return 0
+	}
+	c.IterateFiles(keyPath, func(parent string, file fs.DirEntry) {
+		name := file.Name()
+		if !strings.HasSuffix(name, ".gz") {
+			return
+		}
+		compressedPath := filepath.Join(parent, name)
+		plainPath := strings.TrimSuffix(compressedPath, ".gz")
+		plainStat, err := os.Stat(plainPath)
+		if err != nil {
+			return
+		}
+		compressedStat, err := file.Info()
+		if err != nil {
+			return
+		}
+		orphan := compressedPath
+		if plainStat.ModTime().Before(compressedStat.ModTime()) {
+			orphan = plainPath
+		}
+		if os.Remove(orphan) == nil {
+			count += 1
+		}
 	})
 	return count
 }
 
 func (c *DiskCache) ExpiredEntryCount() int64 {
 	var count int64
-	now := time.Now().UTC()
-	for key, config := range c.CacheConfig.Configs {
-		basePath := filepath.Join(c.BasePath, key)
-		cutoff := now.Add(-1 * time.Duration(config.TTL) * time.Second)
+	now := c.GetConfig().Now()
+	for key, config := range c.GetConfig().KeyConfigs() {
+		basePath, err := c.keyPath(key)
+		if err != nil {
+			continue
+		}
+		cutoff := config.GetExpireTime(now)
 		c.IterateFiles(basePath, func(parent string, file fs.DirEntry) {
+			if !isLogicalEntry(parent, file.Name()) {
+				return
+			}
 			if info, err := file.Info(); err == nil {
 				if info.ModTime().Before(cutoff) {
 					count += 1
@@ -165,12 +696,22 @@ func (c *DiskCache) ExpiredEntryCount() int64 {
 }
 
 func (c *DiskCache) IterateFiles(basePath string, callback func(string, fs.DirEntry)) {
+	c.iterateFiles(basePath, callback)
+}
+
+// iterateFiles is IterateFiles returning errors from directories that could not be read
+// Directories that do not exist are skipped, as keys only have a directory once set
+func (c *DiskCache) iterateFiles(basePath string, callback func(string, fs.DirEntry)) []error {
+	var errs []error
 	dirsLeft := []string{basePath}
 	var curDir string
 	for len(dirsLeft) > 0 {
 		curDir, dirsLeft = dirsLeft[0], dirsLeft[1:]
 		entries, err := os.ReadDir(curDir)
 		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				errs = append(errs, err)
+			}
 			continue
 		}
 
@@ -182,4 +723,10 @@ func (c *DiskCache) IterateFiles(basePath string, callback func(string, fs.DirEn
 			}
 		}
 	}
+	return errs
+}
+
+// Close does nothing as DiskCache keeps no files open between calls
+func (c *DiskCache) Close() error {
+	return nil
 }
@@ -1,10 +1,13 @@
 package cachefunk_test
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -26,6 +29,48 @@ func TestDiskCache(t *testing.T) {
 	cache.Clear()
 	runTestCacheFuncWithContextErrorsReturned(t, cache)
 	cache.Clear()
+	runTestCacheObjectMany(t, cache)
+	cache.Clear()
+	runTestSetMany(t, cache)
+	cache.Clear()
+	runTestWarm(t, cache)
+	cache.Clear()
+	runTestCacheObjectAs(t, cache)
+	cache.Clear()
+	runTestGetOrSet(t, cache)
+	cache.Clear()
+	runTestKeyEntries(t, cache)
+	cache.Clear()
+	runTestMaxDecompressedSize(t, cache)
+	cache.Clear()
+	runTestMaxValueBytes(t, cache)
+	cache.Clear()
+	runTestHas(t, cache)
+	cache.Clear()
+	runTestAdaptiveCompression(t, cache)
+	cache.Clear()
+	runTestMustGet(t, cache)
+	cache.Clear()
+	runTestCacheObjectWithMeta(t, cache)
+	cache.Clear()
+	runTestCacheMode(t, cache)
+	cache.Clear()
+	runTestCompressionContext(t, cache)
+	cache.Clear()
+	runTestWrapMeta(t, cache)
+	cache.Clear()
+	runTestIterate(t, cache)
+	cache.Clear()
+	runTestCacheWithTTL(t, cache)
+	cache.Clear()
+	runTestPoisonedEntries(t, cache)
+	cache.Clear()
+	runTestInvalidatePrefix(t, cache)
+	cache.Clear()
+	runTestCleanupBatch(t, cache)
+	cache.Clear()
+	runTestForceCleanup(t, cache)
+	cache.Clear()
 	expireAllEntries := func() {
 		cache.IterateFiles(cache.BasePath, func(parent string, file fs.DirEntry) {
 			if _, err := file.Info(); err != nil {
@@ -60,3 +105,435 @@ func ExampleDiskCache() {
 	value, err = HelloWorld(false, params)
 	fmt.Println("Second call:", value, err)
 }
+
+func TestReadableCalculatePath(t *testing.T) {
+	long := strings.Repeat("x", 1000)
+
+	testCases := []struct {
+		params   string
+		readable string
+	}{
+		{"bob", "bob"},
+		{`{"Name":"Bob"}`, "__Name___Bob__"},
+		{"../../etc/passwd", "_._.._etc_passwd"},
+		{`a\b/c`, "a_b_c"},
+		{"..", "_."},
+		{".tmp-1", "_tmp-1"},
+		{"héllo wörld", "héllo_wörld"},
+		{long, long[:cachefunk.READABLE_PARAMS_MAX_LENGTH]},
+		{long + "y", long[:cachefunk.READABLE_PARAMS_MAX_LENGTH]},
+	}
+
+	seen := map[string]string{}
+	for line, tc := range testCases {
+		bits := cachefunk.ReadableCalculatePath("hello", tc.params)
+		if len(bits) != 4 || bits[0] != "hello" {
+			t.Fatalf("subtest %d: expected key and 3 path components got %q", line+1, bits)
+		}
+		name := bits[3]
+		if !strings.HasPrefix(name, tc.readable+"-") {
+			t.Errorf("subtest %d: expected file name starting %q got %q", line+1, tc.readable+"-", name)
+		}
+		if strings.ContainsAny(name, `/\`) || filepath.Base(name) != name {
+			t.Errorf("subtest %d: expected a single path component got %q", line+1, name)
+		}
+		if len(name) > 255 {
+			t.Errorf("subtest %d: expected file name of at most %d bytes got %d", line+1, 255, len(name))
+		}
+		if other, exists := seen[name]; exists {
+			t.Errorf("subtest %d: params %q and %q have the same file name", line+1, other, tc.params)
+		}
+		seen[name] = tc.params
+	}
+
+	dir := t.TempDir()
+	cache := cachefunk.NewDiskCache(dir, cachefunk.ReadableCalculatePath)
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 60},
+		},
+	})
+	for _, tc := range testCases {
+		cache.Set("hello", tc.params, []byte(tc.params))
+	}
+	for line, tc := range testCases {
+		if value, found := cache.Get("hello", tc.params); !found || string(value) != tc.params {
+			t.Errorf("subtest %d: expected value %q got %q", line+1, tc.params, value)
+		}
+	}
+	if count := cache.EntryCount(); count != int64(len(testCases)) {
+		t.Errorf("expected %d entries got %d", len(testCases), count)
+	}
+	keys, _ := cachefunk.Keys(cache)
+	if len(keys) != 1 || keys[0] != "hello" {
+		t.Errorf("expected only key hello got %q", keys)
+	}
+}
+
+func TestDiskCacheKeyTraversal(t *testing.T) {
+	root := t.TempDir()
+	basePath := filepath.Join(root, "cache")
+	secret := filepath.Join(root, "secret")
+	if err := os.WriteFile(secret, []byte("secret"), 0644); err != nil {
+		t.Fatal("failed to write file:", err)
+	}
+
+	keys := []string{"", ".", "..", "../secret", "a/../../secret", "/etc", "../../../../../tmp", "nested/key", `nested\key`}
+	configs := map[string]*cachefunk.KeyConfig{"nested": {TTL: 60}}
+	for _, key := range keys {
+		configs[key] = &cachefunk.KeyConfig{TTL: 60}
+	}
+	observer := &recordingObserver{}
+	cache := cachefunk.NewDiskCache(basePath)
+	cache.SetConfig(&cachefunk.CacheFunkConfig{Configs: configs, Observer: observer})
+
+	for line, key := range keys {
+		observer.events = nil
+		cache.Set(key, "params", []byte("value"))
+		if len(observer.events) != 1 || observer.events[0] != "set error "+key {
+			t.Errorf("subtest %d: expected set error for key %q got %v", line+1, key, observer.events)
+		}
+		if _, found := cache.Get(key, "params"); found {
+			t.Errorf("subtest %d: expected no value for key %q", line+1, key)
+		}
+		cache.ClearKey(key)
+		cache.Delete(key, "../../secret")
+	}
+	// keys without separators are stored as usual
+	cache.Set("nested", "params", []byte("value"))
+	if _, found := cache.Get("nested", "params"); !found {
+		t.Error("expected key to be stored")
+	}
+
+	result := cache.CleanupWithResult()
+	if len(result.Errors) != len(keys) || !errors.Is(result.Err(), cachefunk.ErrInvalidKey) {
+		t.Errorf("expected cleanup to report %d invalid keys got %v", len(keys), result.Errors)
+	}
+
+	if value, err := os.ReadFile(secret); err != nil || string(value) != "secret" {
+		t.Errorf("expected file outside base path to be untouched got %q %v", value, err)
+	}
+	filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() && path != secret && !strings.HasPrefix(path, basePath+string(filepath.Separator)) {
+			t.Errorf("expected files to stay within base path got %s", path)
+		}
+		return nil
+	})
+}
+
+func TestDiskCacheAtomicSet(t *testing.T) {
+	cache := cachefunk.NewDiskCache(t.TempDir())
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 60, UseCompression: true},
+		},
+	})
+
+	values := [][]byte{
+		bytes.Repeat([]byte("first value "), 100000),
+		bytes.Repeat([]byte("second value "), 100000),
+	}
+	cache.Set("hello", "params", values[0])
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			cache.Set("hello", "params", values[i%2])
+		}
+	}()
+
+	for reading := true; reading; {
+		select {
+		case <-done:
+			reading = false
+		default:
+		}
+		value, found := cache.Get("hello", "params")
+		if !found {
+			t.Fatal("expected value to always be found while it is being rewritten")
+		}
+		if !bytes.Equal(value, values[0]) && !bytes.Equal(value, values[1]) {
+			t.Fatal("read a value that does not match either written value")
+		}
+	}
+
+	if count := cache.EntryCount(); count != 1 {
+		t.Fatalf("expected %d entry without leftover temporary files got %d", 1, count)
+	}
+}
+
+func TestDiskCacheCompressionVariants(t *testing.T) {
+	cache := cachefunk.NewDiskCache(t.TempDir())
+	config := &cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 60, UseCompression: true},
+		},
+	}
+	cache.SetConfig(config)
+
+	cache.Set("hello", "params", []byte("compressed"))
+	config.Set("hello", &cachefunk.KeyConfig{TTL: 60, UseCompression: false})
+	cache.Set("hello", "params", []byte("uncompressed"))
+
+	if count := cache.EntryCount(); count != 1 {
+		t.Fatalf("expected %d entry after changing compression got %d", 1, count)
+	}
+
+	// leave behind an older compressed copy of the entry
+	var plainPath string
+	cache.IterateFiles(cache.BasePath, func(parent string, file fs.DirEntry) {
+		plainPath = filepath.Join(parent, file.Name())
+	})
+	orphanPath := plainPath + ".gz"
+	os.WriteFile(orphanPath, []byte("stale"), 0644)
+	os.Chtimes(orphanPath, time.Time{}, time.Now().Add(-time.Minute))
+
+	if count := cache.EntryCount(); count != 1 {
+		t.Errorf("expected %d entry with orphaned copy got %d", 1, count)
+	}
+	if count := cache.PurgeOrphans("hello"); count != 1 {
+		t.Errorf("expected %d orphan purged got %d", 1, count)
+	}
+	if _, err := os.Stat(orphanPath); err == nil {
+		t.Error("expected orphaned copy to be removed")
+	}
+	if value, found := cache.Get("hello", "params"); !found || string(value) != "uncompressed" {
+		t.Errorf("expected %q got %q", "uncompressed", value)
+	}
+}
+
+func TestDiskCacheCleanupErrors(t *testing.T) {
+	cache := cachefunk.NewDiskCache(t.TempDir())
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello":   {TTL: 60},
+			"missing": {TTL: 60},
+		},
+	})
+
+	if err := cache.CleanupWithResult().Err(); err != nil {
+		t.Fatalf("expected no error for keys without entries got %v", err)
+	}
+
+	// a file where the key directory should be cannot be read as a directory
+	os.WriteFile(filepath.Join(cache.BasePath, "hello"), []byte("not a directory"), 0644)
+	result := cache.CleanupWithResult()
+	if len(result.Errors) != 1 || result.Err() == nil {
+		t.Fatalf("expected %d cleanup error got %v", 1, result.Errors)
+	}
+}
+
+func TestDiskCacheEvict(t *testing.T) {
+	cache := cachefunk.NewDiskCache(t.TempDir())
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 3600},
+		},
+	})
+
+	value := bytes.Repeat([]byte("x"), 999)
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		cache.SetRaw("hello", fmt.Sprint(i), value, now.Add(time.Duration(i)*time.Second), false)
+	}
+
+	// each entry is 1000 bytes including the format version
+	cache.MaxBytes = 3500
+	result := cache.Evict()
+	if result.Removed != 7 || result.Err() != nil {
+		t.Fatalf("expected %d entries evicted without errors got %+v", 7, result)
+	}
+	for i := 0; i < 10; i++ {
+		if _, found := cache.Get("hello", fmt.Sprint(i)); found != (i >= 7) {
+			t.Errorf("subtest %d: expected found %v got %v", i+1, i >= 7, found)
+		}
+	}
+
+	// evict automatically every 2 writes
+	cache.EvictEvery = 2
+	cache.Set("hello", "a", value)
+	if count := cache.EntryCount(); count != 4 {
+		t.Errorf("expected %d entries before eviction got %d", 4, count)
+	}
+	cache.Set("hello", "b", value)
+	if count := cache.EntryCount(); count != 3 {
+		t.Errorf("expected %d entries after eviction got %d", 3, count)
+	}
+}
+
+func TestDiskCacheGetManyReadConcurrency(t *testing.T) {
+	cache := cachefunk.NewDiskCache(t.TempDir())
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 60},
+		},
+	})
+
+	var paramsList []string
+	for i := 0; i < 100; i++ {
+		params := fmt.Sprint(i)
+		paramsList = append(paramsList, params)
+		cache.Set("hello", params, []byte(params))
+	}
+
+	testCases := []struct {
+		concurrency int
+		maxWorkers  int
+	}{
+		{0, 0},
+		{1, 0},
+		{4, 0},
+		// reads without a worker free run in the calling goroutine
+		{4, 1},
+	}
+	for line, tc := range testCases {
+		cache.ReadConcurrency = tc.concurrency
+		cache.SetConfig(&cachefunk.CacheFunkConfig{
+			Configs: map[string]*cachefunk.KeyConfig{
+				"hello": {TTL: 60},
+			},
+			MaxWorkers: tc.maxWorkers,
+		})
+		values := cache.GetMany("hello", paramsList)
+		if len(values) != len(paramsList) {
+			t.Errorf("subtest %d: expected %d values got %d", line+1, len(paramsList), len(values))
+		}
+		for _, params := range paramsList {
+			if string(values[params]) != params {
+				t.Errorf("subtest %d: expected %q got %q", line+1, params, values[params])
+			}
+		}
+	}
+}
+
+func TestDiskCacheForceCleanupTempFiles(t *testing.T) {
+	basePath := t.TempDir()
+	cache := cachefunk.NewDiskCache(basePath)
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 60},
+		},
+	})
+	cache.Set("hello", "params", []byte("value"))
+
+	freshPath := filepath.Join(basePath, "hello", ".tmp-fresh")
+	stalePath := filepath.Join(basePath, "hello", ".tmp-stale")
+	for _, path := range []string{freshPath, stalePath} {
+		if err := os.WriteFile(path, []byte("partial"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	staleTime := time.Now().Add(-2 * cachefunk.DISK_TEMP_FILE_GRACE)
+	if err := os.Chtimes(stalePath, staleTime, staleTime); err != nil {
+		t.Fatal(err)
+	}
+
+	result := cachefunk.ForceCleanup(cache, "hello", 0)
+	if result.Removed != 1 {
+		t.Errorf("expected %d entry removed got %d", 1, result.Removed)
+	}
+	if _, err := os.Stat(freshPath); err != nil {
+		t.Errorf("expected temporary file still being written to survive cleanup: %v", err)
+	}
+	if _, err := os.Stat(stalePath); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected leftover temporary file to be removed got %v", err)
+	}
+}
+
+func TestDiskCacheEntryFormatVersion(t *testing.T) {
+	basePath := t.TempDir()
+	cache := cachefunk.NewDiskCache(basePath)
+	observer := &recordingObserver{}
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 60},
+		},
+		Observer: observer,
+	})
+
+	var paths []string
+	for _, params := range []string{"get", "stream"} {
+		cache.Set("hello", params, []byte("value"))
+	}
+	filepath.WalkDir(basePath, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			paths = append(paths, path)
+		}
+		return err
+	})
+	if len(paths) != 2 {
+		t.Fatalf("expected %d entry files got %d", 2, len(paths))
+	}
+	for _, path := range paths {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if raw[0] != cachefunk.ENTRY_FORMAT_VERSION {
+			t.Fatalf("expected stored value to start with version %d got %d", cachefunk.ENTRY_FORMAT_VERSION, raw[0])
+		}
+		raw[0] = cachefunk.ENTRY_FORMAT_VERSION + 1
+		if err := os.WriteFile(path, raw, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// an unknown version must be treated as a miss rather than misread
+	if stream, found := cache.GetStream("hello", "stream"); found {
+		stream.Close()
+		t.Error("expected stream with unknown format version to be a miss")
+	}
+	if _, found := cache.Get("hello", "get"); found {
+		t.Error("expected entry with unknown format version to be a miss")
+	}
+	if len(observer.getErrors) != 2 {
+		t.Fatalf("expected %d get errors got %v", 2, observer.getErrors)
+	}
+	for _, err := range observer.getErrors {
+		if !errors.Is(err, cachefunk.ErrUnknownEntryVersion) {
+			t.Errorf("expected unknown format version to be reported got %v", err)
+		}
+	}
+	if count := cache.EntryCount(); count != 1 {
+		t.Errorf("expected Get to remove the unreadable entry leaving %d got %d", 1, count)
+	}
+}
+
+func TestDiskCacheForceCleanupBackdatedTempFiles(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	basePath := t.TempDir()
+	cache := cachefunk.NewDiskCache(basePath)
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 60},
+		},
+		Clock: func() time.Time { return now },
+	})
+	cache.Set("hello", "params", []byte("value"))
+
+	// a temporary file has its modtime moved to the entry timestamp before it is renamed into place,
+	// so cleanup must judge it by the creation time in its name and the config clock
+	inFlightPath := filepath.Join(basePath, "hello", fmt.Sprintf(".tmp-%d.1", now.UnixNano()))
+	stalePath := filepath.Join(basePath, "hello", fmt.Sprintf(".tmp-%d.2", now.Add(-2*cachefunk.DISK_TEMP_FILE_GRACE).UnixNano()))
+	for _, path := range []string{inFlightPath, stalePath} {
+		if err := os.WriteFile(path, []byte("partial"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backdated := now.Add(-time.Hour)
+	if err := os.Chtimes(inFlightPath, backdated, backdated); err != nil {
+		t.Fatal(err)
+	}
+
+	result := cachefunk.ForceCleanup(cache, "hello", 0)
+	if result.Removed != 1 {
+		t.Errorf("expected %d entry removed got %d", 1, result.Removed)
+	}
+	if _, err := os.Stat(inFlightPath); err != nil {
+		t.Errorf("expected backdated temporary file still being written to survive cleanup: %v", err)
+	}
+	if _, err := os.Stat(stalePath); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected temporary file created before the grace period to be removed got %v", err)
+	}
+}
@@ -0,0 +1,191 @@
+package cachefunk
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// EncryptedCache wraps another Cache and encrypts values with AES-GCM before they are stored.
+// A random nonce is prepended to each ciphertext.
+// Encrypted values do not compress, so UseCompression should be disabled for wrapped keys.
+type EncryptedCache struct {
+	Cache Cache
+	aead  cipher.AEAD
+}
+
+func NewEncryptedCache(inner Cache, key []byte) (*EncryptedCache, error) {
+	if len(key) != 32 {
+		return nil, errors.New("cachefunk: encryption key must be 32 bytes")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	cache := EncryptedCache{
+		Cache: inner,
+		aead:  aead,
+	}
+	return &cache, nil
+}
+
+func (c *EncryptedCache) encrypt(value []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(nonce, nonce, value, nil), nil
+}
+
+func (c *EncryptedCache) decrypt(value []byte) ([]byte, error) {
+	nonceSize := c.aead.NonceSize()
+	if len(value) < nonceSize {
+		return nil, errors.New("cachefunk: encrypted value too short")
+	}
+	return c.aead.Open(nil, value[:nonceSize], value[nonceSize:], nil)
+}
+
+func (c *EncryptedCache) SetConfig(config *CacheFunkConfig) {
+	c.Cache.SetConfig(config)
+}
+
+func (c *EncryptedCache) GetConfig() *CacheFunkConfig {
+	return c.Cache.GetConfig()
+}
+
+func (c *EncryptedCache) GetIgnoreCacheCtxKey() interface{} {
+	return c.Cache.GetIgnoreCacheCtxKey()
+}
+
+// Get will get and decrypt a cache value
+// Values that fail to decrypt are deleted and treated as not found so they are replaced by a fresh response
+func (c *EncryptedCache) Get(key string, params string) ([]byte, bool) {
+	value, _, found := c.GetWithInfo(key, params)
+	return value, found
+}
+
+// GetWithInfo is Get with information about the entry, which describes the encrypted value
+func (c *EncryptedCache) GetWithInfo(key string, params string) ([]byte, EntryInfo, bool) {
+	value, info, found := c.Cache.GetWithInfo(key, params)
+	if !found {
+		return nil, info, false
+	}
+	value, err := c.decrypt(value)
+	if err != nil {
+		c.Cache.Delete(key, params)
+		return nil, EntryInfo{}, false
+	}
+	return value, info, true
+}
+
+func (c *EncryptedCache) GetMany(key string, paramsList []string) map[string][]byte {
+	values := c.Cache.GetMany(key, paramsList)
+	for params, value := range values {
+		value, err := c.decrypt(value)
+		if err != nil {
+			delete(values, params)
+			continue
+		}
+		values[params] = value
+	}
+	return values
+}
+
+// Set will encrypt and set a cache value
+func (c *EncryptedCache) Set(key string, params string, value []byte) {
+	value, err := c.encrypt(value)
+	if err != nil {
+		return
+	}
+	c.Cache.Set(key, params, value)
+}
+
+func (c *EncryptedCache) SetMany(key string, values map[string][]byte) {
+	encrypted := make(map[string][]byte, len(values))
+	for params, value := range values {
+		value, err := c.encrypt(value)
+		if err != nil {
+			continue
+		}
+		encrypted[params] = value
+	}
+	c.Cache.SetMany(key, encrypted)
+}
+
+// SetRaw will encrypt and set a raw cache value, keeping its timestamp
+// Compressed values are decompressed first as encrypted values do not compress
+func (c *EncryptedCache) SetRaw(key string, params string, value []byte, timestamp time.Time, isCompressed bool) {
+	if isCompressed {
+		var err error
+		value, err = decompressBytes(value, c.GetConfig().Get(key).MaxDecompressedSize)
+		if err != nil {
+			c.GetConfig().notifySetError(key, fmt.Errorf("%w: %w", ErrCompress, err))
+			return
+		}
+	}
+	value, err := c.encrypt(value)
+	if err != nil {
+		c.GetConfig().notifySetError(key, err)
+		return
+	}
+	c.Cache.SetRaw(key, params, value, timestamp, false)
+}
+
+func (c *EncryptedCache) KeyEntries(key string) []EntryInfo {
+	return c.Cache.KeyEntries(key)
+}
+
+func (c *EncryptedCache) Iterate(fn func(key string, params string, timestamp time.Time) bool) error {
+	return c.Cache.Iterate(fn)
+}
+
+func (c *EncryptedCache) EntryCount() int64 {
+	return c.Cache.EntryCount()
+}
+
+func (c *EncryptedCache) ExpiredEntryCount() int64 {
+	return c.Cache.ExpiredEntryCount()
+}
+
+func (c *EncryptedCache) Clear() {
+	c.Cache.Clear()
+}
+
+func (c *EncryptedCache) ClearKey(key string) {
+	c.Cache.ClearKey(key)
+}
+
+func (c *EncryptedCache) Delete(key string, params string) {
+	c.Cache.Delete(key, params)
+}
+
+func (c *EncryptedCache) Cleanup() {
+	c.Cache.Cleanup()
+}
+
+func (c *EncryptedCache) CleanupWithResult() CleanupResult {
+	return c.Cache.CleanupWithResult()
+}
+
+// Close closes the wrapped cache if it implements ClosableCache
+func (c *EncryptedCache) Close() error {
+	return Close(c.Cache)
+}
+
+// CleanupBatch cleans up the wrapped cache, see the CleanupBatch function
+func (c *EncryptedCache) CleanupBatch(maxDeletes int) CleanupResult {
+	return CleanupBatch(c.Cache, maxDeletes)
+}
+
+// ForceCleanup force cleans the wrapped cache, see the ForceCleanup function
+func (c *EncryptedCache) ForceCleanup(key string, maxAge time.Duration) CleanupResult {
+	return ForceCleanup(c.Cache, key, maxAge)
+}
@@ -0,0 +1,151 @@
+package cachefunk_test
+
+import (
+	"bytes"
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rohfle/cachefunk"
+)
+
+var testEncryptionKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestEncryptedCache(t *testing.T) {
+	cache, err := cachefunk.NewEncryptedCache(cachefunk.NewInMemoryCache(), testEncryptionKey)
+	if err != nil {
+		t.Fatal("failed to create encrypted cache:", err)
+	}
+
+	runTestWrapString(t, cache)
+	cache.Clear()
+	runTestWrapStringWithContext(t, cache)
+	cache.Clear()
+	runTestWrapObject(t, cache)
+	cache.Clear()
+	runTestWrapObjectWithContext(t, cache)
+	cache.Clear()
+	runTestCacheObjectMany(t, cache)
+	cache.Clear()
+	runTestSetMany(t, cache)
+	cache.Clear()
+	runTestPoisonedEntries(t, cache)
+	cache.Clear()
+
+	if _, err := cachefunk.NewEncryptedCache(cachefunk.NewInMemoryCache(), []byte("too short")); err == nil {
+		t.Fatal("expected error for short encryption key")
+	}
+}
+
+func TestEncryptedCacheOnDisk(t *testing.T) {
+	disk := cachefunk.NewDiskCache(t.TempDir())
+	cache, err := cachefunk.NewEncryptedCache(disk, testEncryptionKey)
+	if err != nil {
+		t.Fatal("failed to create encrypted cache:", err)
+	}
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"secret": {TTL: 5},
+		},
+	})
+
+	plaintext := []byte("the eagle lands at midnight")
+	cache.Set("secret", "params", plaintext)
+
+	if files := countPlaintextFiles(t, disk, plaintext); files != 0 {
+		t.Fatalf("expected %d cache files to contain plaintext got %d", 0, files)
+	}
+	if count := disk.EntryCount(); count != 1 {
+		t.Fatalf("expected %d cache file got %d", 1, count)
+	}
+
+	value, found := cache.Get("secret", "params")
+	if !found || !bytes.Equal(value, plaintext) {
+		t.Fatalf("expected \"%s\" got \"%s\" (found %v)", plaintext, value, found)
+	}
+
+	// a cache with a different key cannot decrypt the entry and treats it as a miss
+	other, _ := cachefunk.NewEncryptedCache(disk, []byte("fedcba9876543210fedcba9876543210"))
+	if _, found := other.Get("secret", "params"); found {
+		t.Fatal("expected entry encrypted with another key to be a miss")
+	}
+}
+
+// countPlaintextFiles returns how many files stored by disk contain plaintext
+func countPlaintextFiles(t *testing.T, disk *cachefunk.DiskCache, plaintext []byte) int {
+	files := 0
+	disk.IterateFiles(disk.BasePath, func(parent string, file fs.DirEntry) {
+		raw, err := os.ReadFile(filepath.Join(parent, file.Name()))
+		if err != nil {
+			t.Fatal("failed to read cache file:", err)
+		}
+		if bytes.Contains(raw, plaintext) {
+			files += 1
+		}
+	})
+	return files
+}
+
+func TestEncryptedCacheSetRawPaths(t *testing.T) {
+	plaintext := "the eagle lands at midnight"
+
+	testCases := []struct {
+		name  string
+		store func(cache *cachefunk.EncryptedCache) error
+	}{
+		{"SetRaw", func(cache *cachefunk.EncryptedCache) error {
+			cache.SetRaw("secret", `"bob"`, []byte(plaintext), time.Now(), false)
+			return nil
+		}},
+		{"CacheWithTTL", func(cache *cachefunk.EncryptedCache) error {
+			_, err := cachefunk.CacheWithTTL(cache, "secret", func(ignoreCache bool, name string) (string, time.Duration, error) {
+				return plaintext, time.Minute, nil
+			}, false, "bob")
+			return err
+		}},
+		{"CompressionCtxKey", func(cache *cachefunk.EncryptedCache) error {
+			ctx := context.WithValue(context.Background(), cachefunk.CompressionCtxKey, true)
+			_, err := cachefunk.CacheObjectWithContext(cache, "secret", func(ctx context.Context, name string) (string, error) {
+				return plaintext, nil
+			}, ctx, "bob")
+			return err
+		}},
+		{"TieredCache promotion", func(cache *cachefunk.EncryptedCache) error {
+			memory := cachefunk.NewInMemoryCache()
+			memory.SetConfig(cache.GetConfig())
+			memory.Set("secret", `"bob"`, []byte(plaintext))
+			_, err := cachefunk.MustGet[string](cachefunk.NewTieredCache(cache, memory), "secret", "bob")
+			return err
+		}},
+	}
+	for line, tc := range testCases {
+		disk := cachefunk.NewDiskCache(t.TempDir())
+		cache, err := cachefunk.NewEncryptedCache(disk, testEncryptionKey)
+		if err != nil {
+			t.Fatal("failed to create encrypted cache:", err)
+		}
+		cache.SetConfig(&cachefunk.CacheFunkConfig{
+			Configs: map[string]*cachefunk.KeyConfig{
+				"secret": {TTL: 3600},
+			},
+		})
+
+		if err := tc.store(cache); err != nil {
+			t.Errorf("subtest %d (%s): unexpected error: %v", line+1, tc.name, err)
+		}
+		if count := disk.EntryCount(); count != 1 {
+			t.Errorf("subtest %d (%s): expected %d cache file got %d", line+1, tc.name, 1, count)
+		}
+		if files := countPlaintextFiles(t, disk, []byte(plaintext)); files != 0 {
+			t.Errorf("subtest %d (%s): expected %d cache files to contain plaintext got %d", line+1, tc.name, 0, files)
+		}
+		// the stored entry can be read back and decrypted
+		value, found := cache.Get("secret", `"bob"`)
+		if !found || !bytes.Contains(value, []byte(plaintext)) {
+			t.Errorf("subtest %d (%s): expected value containing %q got %q (found %v)", line+1, tc.name, plaintext, value, found)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package cachefunk
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrReadOnly is reported when writing to or cleaning up a read-only cache such as FSCache
+var ErrReadOnly = errors.New("cachefunk: cache is read-only")
+
+// FSCache is a read-only cache over an fs.FS laid out like DiskCache, such as a prebuilt
+// DiskCache directory bundled with embed.FS. Use it as a layer of a LayeredCache
+// to fall back to a writable cache on a miss.
+// Files without a modification time, such as those in an embed.FS, never expire.
+// Writes are dropped and reported to the Observer as ErrReadOnly, and Clear, ClearKey,
+// Delete and Cleanup do nothing.
+type FSCache struct {
+	CacheConfig       *CacheFunkConfig
+	configMutex       sync.RWMutex
+	FS                fs.FS
+	CalculatePath     func(cacheKey string, params string) []string
+	IgnoreCacheCtxKey interface{}
+}
+
+func NewFSCache(fsys fs.FS, calcPathFn ...func(string, string) []string) *FSCache {
+	if len(calcPathFn) == 0 {
+		calcPathFn = append(calcPathFn, DefaultCalculatePath)
+	}
+
+	cache := FSCache{
+		FS:                fsys,
+		CalculatePath:     calcPathFn[0],
+		IgnoreCacheCtxKey: DEFAULT_IGNORE_CACHE_CTX_KEY,
+	}
+	return &cache
+}
+
+// SetConfig swaps the config used by the cache, which is safe to do while the cache is in use
+func (c *FSCache) SetConfig(config *CacheFunkConfig) {
+	c.configMutex.Lock()
+	defer c.configMutex.Unlock()
+	config.resetMerged()
+	c.CacheConfig = config
+}
+
+func (c *FSCache) GetConfig() *CacheFunkConfig {
+	c.configMutex.RLock()
+	defer c.configMutex.RUnlock()
+	return c.CacheConfig
+}
+
+func (c *FSCache) GetIgnoreCacheCtxKey() interface{} {
+	return c.IgnoreCacheCtxKey
+}
+
+func (c *FSCache) readOnly() {}
+
+// isExpired reports whether a file modified at timestamp is older than cutoff
+func (c *FSCache) isExpired(timestamp time.Time, cutoff time.Time) bool {
+	return !timestamp.IsZero() && timestamp.Before(cutoff)
+}
+
+// statCacheItem finds the file for a cache entry, trying the configured compression first
+func (c *FSCache) statCacheItem(key string, params string, useCompression bool) (string, fs.FileInfo, bool, error) {
+	name := path.Join(c.CalculatePath(key, params)...)
+	for _, isCompressed := range []bool{useCompression, !useCompression} {
+		itemPath := name
+		if isCompressed {
+			itemPath += ".gz"
+		}
+		if stat, err := fs.Stat(c.FS, itemPath); err == nil {
+			return itemPath, stat, isCompressed, nil
+		}
+	}
+	return "", nil, false, fs.ErrNotExist
+}
+
+func (c *FSCache) Get(key string, params string) ([]byte, bool) {
+	value, _, found := c.GetWithInfo(key, params)
+	return value, found
+}
+
+func (c *FSCache) GetWithInfo(key string, params string) ([]byte, EntryInfo, bool) {
+	config := c.GetConfig().Get(key)
+	itemPath, stat, isCompressed, err := c.statCacheItem(key, params, config.UseCompression)
+	if err != nil {
+		return nil, EntryInfo{}, false
+	}
+	info := EntryInfo{
+		Params:       params,
+		Timestamp:    stat.ModTime(),
+		Size:         stat.Size(),
+		IsCompressed: isCompressed,
+	}
+	if c.isExpired(stat.ModTime(), config.GetExpireTime(c.GetConfig().Now())) {
+		c.GetConfig().notifyExpired(key)
+		return nil, info, false
+	}
+
+	raw, err := fs.ReadFile(c.FS, itemPath)
+	if err != nil {
+		return nil, EntryInfo{}, false
+	}
+	value, err := decodeEntry(raw)
+	if err != nil {
+		c.GetConfig().notifyGetError(key, err)
+		return nil, EntryInfo{}, false
+	}
+	if isCompressed {
+		value, err = decompressBytes(value, config.MaxDecompressedSize)
+		if err != nil {
+			return nil, EntryInfo{}, false
+		}
+	}
+	return value, info, true
+}
+
+func (c *FSCache) GetMany(key string, paramsList []string) map[string][]byte {
+	values := make(map[string][]byte, len(paramsList))
+	for _, params := range paramsList {
+		if value, found := c.Get(key, params); found {
+			values[params] = value
+		}
+	}
+	return values
+}
+
+func (c *FSCache) Set(key string, params string, value []byte) {
+	c.GetConfig().notifySetError(key, ErrReadOnly)
+}
+
+func (c *FSCache) SetMany(key string, values map[string][]byte) {
+	c.GetConfig().notifySetError(key, ErrReadOnly)
+}
+
+func (c *FSCache) SetRaw(key string, params string, value []byte, timestamp time.Time, isCompressed bool) {
+	c.GetConfig().notifySetError(key, ErrReadOnly)
+}
+
+// walkFiles calls callback for every entry file under dir, skipping temporary files
+// Directories that do not exist are skipped, as with DiskCache
+func (c *FSCache) walkFiles(dir string, callback func(filePath string, info fs.FileInfo) bool) error {
+	err := fs.WalkDir(c.FS, dir, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".tmp-") {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		if !callback(filePath, info) {
+			return fs.SkipAll
+		}
+		return nil
+	})
+	return err
+}
+
+// KeyEntries lists the files stored under the key directory, see DiskCache.KeyEntries
+func (c *FSCache) KeyEntries(key string) []EntryInfo {
+	var entries []EntryInfo
+	c.walkFiles(key, func(filePath string, info fs.FileInfo) bool {
+		entries = append(entries, EntryInfo{
+			Params:       strings.TrimSuffix(info.Name(), ".gz"),
+			Timestamp:    info.ModTime(),
+			Size:         info.Size(),
+			IsCompressed: strings.HasSuffix(info.Name(), ".gz"),
+		})
+		return true
+	})
+	return entries
+}
+
+// Iterate walks every file in FS, reporting keys and params like DiskCache.Iterate
+func (c *FSCache) Iterate(fn func(key string, params string, timestamp time.Time) bool) error {
+	return c.walkFiles(".", func(filePath string, info fs.FileInfo) bool {
+		return fn(diskEntryKey(path.Dir(filePath)), strings.TrimSuffix(info.Name(), ".gz"), info.ModTime())
+	})
+}
+
+func (c *FSCache) EntryCount() int64 {
+	var count int64
+	c.walkFiles(".", func(filePath string, info fs.FileInfo) bool {
+		count += 1
+		return true
+	})
+	return count
+}
+
+func (c *FSCache) ExpiredEntryCount() int64 {
+	var count int64
+	now := c.GetConfig().Now()
+	for key, config := range c.GetConfig().KeyConfigs() {
+		cutoff := config.GetExpireTime(now)
+		c.walkFiles(key, func(filePath string, info fs.FileInfo) bool {
+			if c.isExpired(info.ModTime(), cutoff) {
+				count += 1
+			}
+			return true
+		})
+	}
+	return count
+}
+
+func (c *FSCache) Clear() {}
+
+func (c *FSCache) ClearKey(key string) {}
+
+func (c *FSCache) Delete(key string, params string) {}
+
+func (c *FSCache) Cleanup() {}
+
+// CleanupWithResult removes nothing and reports ErrReadOnly
+func (c *FSCache) CleanupWithResult() CleanupResult {
+	return CleanupResult{Errors: []error{ErrReadOnly}}
+}
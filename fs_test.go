@@ -0,0 +1,95 @@
+package cachefunk_test
+
+import (
+	"os"
+	"path"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/rohfle/cachefunk"
+)
+
+func TestFSCache(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	config := &cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 60},
+			"world": {TTL: 60, UseCompression: true},
+		},
+	}
+	disk := cachefunk.NewDiskCache(dir)
+	disk.SetConfig(config)
+	disk.Set("hello", "bob", []byte("1"))
+	disk.Set("world", "clark", []byte("2"))
+	disk.SetRaw("hello", "expired", []byte("3"), now.Add(-time.Hour), false)
+
+	observer := &recordingObserver{}
+	config.Observer = observer
+	cache := cachefunk.NewFSCache(os.DirFS(dir))
+	cache.SetConfig(config)
+
+	tests := []struct {
+		Key      string
+		Params   string
+		Expected string
+		Found    bool
+	}{
+		{"hello", "bob", "1", true},
+		{"world", "clark", "2", true},
+		{"hello", "expired", "", false},
+		{"hello", "missing", "", false},
+	}
+	for line, test := range tests {
+		value, found := cache.Get(test.Key, test.Params)
+		if found != test.Found || string(value) != test.Expected {
+			t.Errorf("subtest %d: expected %q %v got %q %v", line+1, test.Expected, test.Found, value, found)
+		}
+	}
+
+	if count := cache.EntryCount(); count != 3 {
+		t.Errorf("expected %d entries got %d", 3, count)
+	}
+	if count := cache.ExpiredEntryCount(); count != 1 {
+		t.Errorf("expected %d expired entry got %d", 1, count)
+	}
+	keys, err := cachefunk.Keys(cache)
+	if err != nil || len(keys) != 2 || keys[0] != "hello" || keys[1] != "world" {
+		t.Errorf("expected keys hello and world got %v %v", keys, err)
+	}
+
+	observer.events = nil
+	cache.Set("hello", "new", []byte("4"))
+	if len(observer.events) != 1 || observer.events[0] != "set error hello" {
+		t.Errorf("expected set to report a read-only error got %v", observer.events)
+	}
+	cache.Clear()
+	if count := cache.EntryCount(); count != 3 {
+		t.Errorf("expected clear to leave %d entries got %d", 3, count)
+	}
+	if err := cache.CleanupWithResult().Err(); err == nil {
+		t.Error("expected cleanup to report a read-only error")
+	}
+}
+
+func TestFSCacheNoModTime(t *testing.T) {
+	name := path.Join(cachefunk.DefaultCalculatePath("hello", "bob")...)
+	fsys := fstest.MapFS{
+		name: {Data: append([]byte{cachefunk.ENTRY_FORMAT_VERSION}, "embedded"...)},
+	}
+	cache := cachefunk.NewFSCache(fsys)
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 60},
+		},
+	})
+
+	// files in an embed.FS have no modification time and never expire
+	if value, found := cache.Get("hello", "bob"); !found || string(value) != "embedded" {
+		t.Errorf("expected %q got %q", "embedded", value)
+	}
+	if count := cache.ExpiredEntryCount(); count != 0 {
+		t.Errorf("expected %d expired entries got %d", 0, count)
+	}
+}
@@ -1,6 +1,13 @@
 package cachefunk
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
 	"time"
 
 	"gorm.io/gorm"
@@ -10,101 +17,320 @@ import (
 
 type GORMCache struct {
 	CacheConfig       *CacheFunkConfig
+	configMutex       sync.RWMutex
 	DB                *gorm.DB
-	IgnoreCacheCtxKey CtxKey
+	IgnoreCacheCtxKey interface{}
+	// TableName is the table entries are stored in, the CacheEntry table if empty
+	TableName string
+	// HashParams stores the hash of params in the params column, see WithHashedParams
+	HashParams bool
 }
 
+// GORMCacheOption configures a GORMCache created by NewGORMCache
+type GORMCacheOption func(*GORMCache)
+
+// WithHashedParams stores the hex SHA-256 of params in the indexed params column,
+// and the params themselves in the unindexed full_params column for debugging
+// Use it when params can be longer than the database can index, such as MySQL's index length limit
+// Entries stored without the option are not found with it, and the other way around
+func WithHashedParams() GORMCacheOption {
+	return func(c *GORMCache) {
+		c.HashParams = true
+	}
+}
+
+// WithTableName stores entries in the table name instead of the CacheEntry table
+// Use it to avoid collisions with an application's schema, or to keep several caches in one database
+func WithTableName(name string) GORMCacheOption {
+	return func(c *GORMCache) {
+		c.TableName = name
+	}
+}
+
+// SetConfig swaps the config used by the cache, which is safe to do while the cache is in use
 func (c *GORMCache) SetConfig(config *CacheFunkConfig) {
+	c.configMutex.Lock()
+	defer c.configMutex.Unlock()
+	config.resetMerged()
 	c.CacheConfig = config
 }
 
+func (c *GORMCache) GetConfig() *CacheFunkConfig {
+	c.configMutex.RLock()
+	defer c.configMutex.RUnlock()
+	return c.CacheConfig
+}
+
+// CacheEntry is a cache value stored in the database
+// idx_key_params is used to look up entries, and idx_key_timestamp
+// covers the expiry queries in Cleanup and ExpiredEntryCount
 type CacheEntry struct {
 	ID           int64     `json:"id" gorm:"primaryKey"`
-	Timestamp    time.Time `json:"timestamp" gorm:"not null"`
-	Key          string    `json:"key" gorm:"uniqueIndex:idx_key_params;not null"`
+	Timestamp    time.Time `json:"timestamp" gorm:"index:idx_key_timestamp,priority:2;not null"`
+	Key          string    `json:"key" gorm:"uniqueIndex:idx_key_params;index:idx_key_timestamp,priority:1;not null"`
 	Params       string    `json:"params" gorm:"uniqueIndex:idx_key_params;not null"`
+	FullParams   string    `json:"full_params" gorm:"default:'';not null"`
 	IsCompressed bool      `json:"is_compressed" gorm:"default:false;not null"`
 	Data         []byte    `json:"data" gorm:"not null"`
+	// CreatedAt is when the entry was first stored, upserts do not update it or HitCount
+	CreatedAt time.Time `json:"created_at"`
+	HitCount  int64     `json:"hit_count" gorm:"default:0;not null"`
 }
 
-func NewGORMCache(db *gorm.DB) *GORMCache {
+// GORM_INSERT_BATCH_SIZE is the most entries GORMCache.SetMany inserts in one statement,
+// keeping each insert of CacheEntry columns under GET_MANY_BATCH_SIZE query parameters
+const GORM_INSERT_BATCH_SIZE = GET_MANY_BATCH_SIZE / 10
+
+func NewGORMCache(db *gorm.DB, options ...GORMCacheOption) *GORMCache {
 	cache := GORMCache{
-		DB: db.Session(&gorm.Session{
-			Logger: logger.Default.LogMode(logger.Silent),
-		}),
 		IgnoreCacheCtxKey: DEFAULT_IGNORE_CACHE_CTX_KEY,
 	}
-	db.AutoMigrate(&CacheEntry{})
+	for _, option := range options {
+		option(&cache)
+	}
+	if cache.TableName != "" {
+		db = db.Table(cache.TableName)
+	}
+	cache.DB = db.Session(&gorm.Session{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	db.AutoMigrate(tableModel(cache.TableName))
 	return &cache
 }
 
-func (c *GORMCache) GetIgnoreCacheCtxKey() CtxKey {
+// tableModel returns the model to migrate for table
+// Index names are shared across tables in some databases, so for a custom table
+// CacheEntry is copied with its index names prefixed by the table name
+func tableModel(table string) interface{} {
+	if table == "" {
+		return &CacheEntry{}
+	}
+	entryType := reflect.TypeOf(CacheEntry{})
+	fields := make([]reflect.StructField, entryType.NumField())
+	for i := range fields {
+		field := entryType.Field(i)
+		// matches both index:idx_ and uniqueIndex:idx_
+		tag := strings.ReplaceAll(field.Tag.Get("gorm"), "ndex:idx_", "ndex:idx_"+table+"_")
+		field.Tag = reflect.StructTag(fmt.Sprintf(`json:%q gorm:%q`, field.Tag.Get("json"), tag))
+		fields[i] = field
+	}
+	return reflect.New(reflect.StructOf(fields)).Interface()
+}
+
+// storedParams returns the value stored in the params column for params
+func (c *GORMCache) storedParams(params string) string {
+	if !c.HashParams {
+		return params
+	}
+	hash := sha256.Sum256([]byte(params))
+	return hex.EncodeToString(hash[:])
+}
+
+// newCacheEntry returns the CacheEntry that stores value for key and params
+func (c *GORMCache) newCacheEntry(key string, params string, value []byte, timestamp time.Time, isCompressed bool) CacheEntry {
+	cacheEntry := CacheEntry{
+		Key:          key,
+		Params:       c.storedParams(params),
+		Data:         encodeEntry(value),
+		Timestamp:    timestamp,
+		IsCompressed: isCompressed,
+		CreatedAt:    c.GetConfig().Now(),
+	}
+	if c.HashParams {
+		cacheEntry.FullParams = params
+	}
+	return cacheEntry
+}
+
+func (c *GORMCache) GetIgnoreCacheCtxKey() interface{} {
 	return c.IgnoreCacheCtxKey
 }
 
 func (c *GORMCache) Get(key string, params string) ([]byte, bool) {
+	value, _, found := c.GetWithInfo(key, params)
+	return value, found
+}
+
+func (c *GORMCache) GetWithInfo(key string, params string) ([]byte, EntryInfo, bool) {
+	return c.GetWithInfoContext(context.Background(), key, params)
+}
+
+// GetWithInfoContext is GetWithInfo with queries aborted when ctx is done
+func (c *GORMCache) GetWithInfoContext(ctx context.Context, key string, params string) ([]byte, EntryInfo, bool) {
 	var cacheEntry CacheEntry
 
-	result := c.DB.Where("key = ? AND params = ?", key, params).First(&cacheEntry)
+	db := c.DB.WithContext(ctx)
+	result := db.Where("key = ? AND params = ?", key, c.storedParams(params)).First(&cacheEntry)
 	if result.Error != nil {
-		return nil, false
+		return nil, EntryInfo{}, false
+	}
+	info := EntryInfo{
+		Params:       params,
+		Timestamp:    cacheEntry.Timestamp,
+		Size:         int64(len(cacheEntry.Data)),
+		IsCompressed: cacheEntry.IsCompressed,
+		CreatedAt:    cacheEntry.CreatedAt,
+		HitCount:     cacheEntry.HitCount,
 	}
 	// if entry has expired, delete and return not found
-	config := c.CacheConfig.Get(key)
-	expiry := cacheEntry.Timestamp.Add(time.Second * time.Duration(config.TTL))
-	if time.Now().UTC().After(expiry) {
-		c.DB.Delete(&cacheEntry)
-		return nil, false
+	config := c.GetConfig().Get(key)
+	if cacheEntry.Timestamp.Before(config.GetExpireTime(c.GetConfig().Now())) {
+		db.Delete(&cacheEntry)
+		c.GetConfig().notifyExpired(key)
+		return nil, info, false
 	}
 
-	value := cacheEntry.Data
+	value, err := decodeEntry(cacheEntry.Data)
+	if err != nil {
+		db.Delete(&cacheEntry)
+		c.GetConfig().notifyGetError(key, err)
+		return nil, EntryInfo{}, false
+	}
 	if cacheEntry.IsCompressed {
 		var err error
-		value, err = decompressBytes(value)
+		value, err = decompressBytes(value, config.MaxDecompressedSize)
+		if err != nil {
+			db.Delete(&cacheEntry)
+			return nil, EntryInfo{}, false
+		}
+	}
+	db.Model(&cacheEntry).UpdateColumn("hit_count", gorm.Expr("hit_count + 1"))
+	info.HitCount += 1
+	return value, info, true
+}
+
+// GetMany will get many cache values for a key using a query per GET_MANY_BATCH_SIZE params
+// Queries that fail are reported to the Observer and their params treated as misses
+func (c *GORMCache) GetMany(key string, paramsList []string) map[string][]byte {
+	values := make(map[string][]byte, len(paramsList))
+	if len(paramsList) == 0 {
+		return values
+	}
+
+	storedParamsList := make([]string, len(paramsList))
+	paramsByStored := make(map[string]string, len(paramsList))
+	for idx, params := range paramsList {
+		storedParamsList[idx] = c.storedParams(params)
+		paramsByStored[storedParamsList[idx]] = params
+	}
+
+	var cacheEntries []CacheEntry
+	for _, batch := range batches(storedParamsList, GET_MANY_BATCH_SIZE) {
+		var batchEntries []CacheEntry
+		if err := c.DB.Where("key = ? AND params IN ?", key, batch).Find(&batchEntries).Error; err != nil {
+			c.GetConfig().notifyGetError(key, err)
+			continue
+		}
+		cacheEntries = append(cacheEntries, batchEntries...)
+	}
+
+	config := c.GetConfig().Get(key)
+	now := c.GetConfig().Now()
+	var expiredIDs, hitIDs []int64
+	for _, cacheEntry := range cacheEntries {
+		// if entry has expired, mark for deletion and skip
+		if cacheEntry.Timestamp.Before(config.GetExpireTime(now)) {
+			expiredIDs = append(expiredIDs, cacheEntry.ID)
+			c.GetConfig().notifyExpired(key)
+			continue
+		}
+
+		value, err := decodeEntry(cacheEntry.Data)
 		if err != nil {
-			return nil, false
+			c.GetConfig().notifyGetError(key, err)
+			continue
 		}
+		if cacheEntry.IsCompressed {
+			var err error
+			value, err = decompressBytes(value, config.MaxDecompressedSize)
+			if err != nil {
+				continue
+			}
+		}
+		values[paramsByStored[cacheEntry.Params]] = value
+		hitIDs = append(hitIDs, cacheEntry.ID)
+	}
+
+	for _, batch := range batches(expiredIDs, GET_MANY_BATCH_SIZE) {
+		c.DB.Delete(&CacheEntry{}, batch)
 	}
-	return value, true
+	for _, batch := range batches(hitIDs, GET_MANY_BATCH_SIZE) {
+		c.DB.Model(&CacheEntry{}).Where("id IN ?", batch).UpdateColumn("hit_count", gorm.Expr("hit_count + 1"))
+	}
+	return values
 }
 
 // Set will set a cache value by its key and params
 func (c *GORMCache) Set(key string, params string, value []byte) {
-	config := c.CacheConfig.Get(key)
-	if config.TTL <= 0 {
+	c.SetContext(context.Background(), key, params, value)
+}
+
+// SetContext is Set with the query aborted when ctx is done
+func (c *GORMCache) SetContext(ctx context.Context, key string, params string, value []byte) {
+	config := c.GetConfig().Get(key)
+	if config.IsImmediateExpire() {
 		return // immediately discard the entry
 	}
 
-	timestamp := time.Now().UTC()
-	if config.TTLJitter > 0 {
-		timestamp = timestamp.Add(-1 * time.Duration(config.TTLJitter) * time.Second)
+	timestamp := c.GetConfig().GetTimestamp(config)
+
+	value, isCompressed, err := c.GetConfig().compressValue(key, config, value)
+	if err != nil {
+		c.GetConfig().notifySetError(key, err)
+		return
 	}
 
-	if config.UseCompression {
-		var err error
-		value, err = compressBytes(value)
+	c.SetRawContext(ctx, key, params, value, timestamp, isCompressed)
+}
+
+// SetMany will set many cache values for a key using a single batched insert
+func (c *GORMCache) SetMany(key string, values map[string][]byte) {
+	config := c.GetConfig().Get(key)
+	if config.IsImmediateExpire() || len(values) == 0 {
+		return // immediately discard the entries
+	}
+
+	timestamp := c.GetConfig().GetTimestamp(config)
+
+	cacheEntries := make([]CacheEntry, 0, len(values))
+	for params, value := range values {
+		value, isCompressed, err := c.GetConfig().compressValue(key, config, value)
 		if err != nil {
-			return
+			c.GetConfig().notifySetError(key, err)
+			continue
 		}
+		cacheEntries = append(cacheEntries, c.newCacheEntry(key, params, value, timestamp, isCompressed))
 	}
 
-	c.SetRaw(key, params, value, timestamp, config.UseCompression)
+	if len(cacheEntries) == 0 {
+		return
+	}
+
+	// create or update cacheEntries
+	for _, batch := range batches(cacheEntries, GORM_INSERT_BATCH_SIZE) {
+		err := c.DB.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "key"}, {Name: "params"}},
+			DoUpdates: clause.AssignmentColumns([]string{"data", "timestamp", "is_compressed", "full_params"}),
+		}).Create(&batch).Error
+		if err != nil {
+			c.GetConfig().notifySetError(key, err)
+		}
+	}
 }
 
 // SetRaw will set a cache value by its key and params
 func (c *GORMCache) SetRaw(key string, params string, value []byte, timestamp time.Time, useCompression bool) {
-	cacheEntry := CacheEntry{
-		Key:          key,
-		Params:       params,
-		Data:         value,
-		Timestamp:    timestamp,
-		IsCompressed: useCompression,
-	}
+	c.SetRawContext(context.Background(), key, params, value, timestamp, useCompression)
+}
+
+// SetRawContext is SetRaw with the query aborted when ctx is done
+func (c *GORMCache) SetRawContext(ctx context.Context, key string, params string, value []byte, timestamp time.Time, useCompression bool) {
+	cacheEntry := c.newCacheEntry(key, params, value, timestamp, useCompression)
 
 	// create or update cacheEntry
-	c.DB.Clauses(clause.OnConflict{
+	c.DB.WithContext(ctx).Clauses(clause.OnConflict{
 		Columns:   []clause.Column{{Name: "key"}, {Name: "params"}},
-		DoUpdates: clause.AssignmentColumns([]string{"data", "timestamp", "is_compressed"}),
+		DoUpdates: clause.AssignmentColumns([]string{"data", "timestamp", "is_compressed", "full_params"}),
 	}).Create(&cacheEntry)
 }
 
@@ -113,13 +339,155 @@ func (c *GORMCache) Clear() {
 	c.DB.Where("1 = 1").Delete(&CacheEntry{})
 }
 
+// ClearKey will delete all cache entries for key
+func (c *GORMCache) ClearKey(key string) {
+	c.DB.Where("key = ?", key).Delete(&CacheEntry{})
+}
+
+// CompareAndSet sets the value for key and params only if the stored entry has the expected timestamp,
+// as reported by GetWithInfo, so a newer write from another instance sharing the database is not overwritten.
+// Use a zero expected timestamp to only set the value if there is no entry for key and params.
+// swapped reports whether the value was stored.
+func (c *GORMCache) CompareAndSet(key string, params string, expected time.Time, value []byte) (swapped bool, err error) {
+	config := c.GetConfig().Get(key)
+	if config.IsImmediateExpire() {
+		return false, nil // immediately discard the entry
+	}
+	value, isCompressed, err := c.GetConfig().compressValue(key, config, value)
+	if err != nil {
+		return false, err
+	}
+	cacheEntry := c.newCacheEntry(key, params, value, c.GetConfig().GetTimestamp(config), isCompressed)
+
+	var result *gorm.DB
+	if expected.IsZero() {
+		result = c.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&cacheEntry)
+	} else {
+		result = c.DB.Model(&CacheEntry{}).
+			Where("key = ? AND params = ? AND timestamp = ?", key, cacheEntry.Params, expected).
+			Updates(map[string]interface{}{
+				"data":          cacheEntry.Data,
+				"timestamp":     cacheEntry.Timestamp,
+				"is_compressed": cacheEntry.IsCompressed,
+				"full_params":   cacheEntry.FullParams,
+			})
+	}
+	return result.RowsAffected == 1, result.Error
+}
+
+// ClearPrefix will delete all cache entries for keys starting with prefix
+// LIKE is case insensitive in some databases, so the keys it matches are checked before deleting
+func (c *GORMCache) ClearPrefix(prefix string) error {
+	var candidates []string
+	err := c.DB.Model(&CacheEntry{}).Distinct("key").Where(`key LIKE ? ESCAPE '\'`, escapeLike(prefix)+"%").Pluck("key", &candidates).Error
+	if err != nil {
+		return err
+	}
+	var keys []string
+	for _, key := range candidates {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	return c.DB.Where("key IN ?", keys).Delete(&CacheEntry{}).Error
+}
+
+// Delete will delete the cache entry for key and params
+func (c *GORMCache) Delete(key string, params string) {
+	c.DB.Where("key = ? AND params = ?", key, c.storedParams(params)).Delete(&CacheEntry{})
+}
+
 // Cleanup will delete all cache entries that have expired
 func (c *GORMCache) Cleanup() {
-	now := time.Now().UTC()
-	for key, config := range c.CacheConfig.Configs {
-		cutoff := now.Add(-1 * time.Duration(config.TTL) * time.Second)
-		c.DB.Where("key = ? AND timestamp < ?", key, cutoff).Delete(&CacheEntry{})
+	c.CleanupWithResult()
+}
+
+func (c *GORMCache) CleanupWithResult() CleanupResult {
+	return c.CleanupAll(c.GetConfig().KeyConfigs(), c.GetConfig().Now())
+}
+
+// ForceCleanup deletes the entries of key stored more than maxAge ago, see the ForceCleanup function
+func (c *GORMCache) ForceCleanup(key string, maxAge time.Duration) CleanupResult {
+	var result CleanupResult
+	deleted := c.DB.Where("key = ? AND timestamp < ?", key, forceCleanupCutoff(c, maxAge)).Delete(&CacheEntry{})
+	result.Removed = deleted.RowsAffected
+	if deleted.Error != nil {
+		result.Errors = append(result.Errors, deleted.Error)
+	}
+	return result
+}
+
+// GORM_CLEANUP_BATCH_KEYS is the most keys deleted by one query in CleanupAll
+// Each key uses two query parameters, keeping queries under SQLite's default limit of 999
+const GORM_CLEANUP_BATCH_KEYS = 400
+
+// CleanupAll deletes the entries of every key in configs that have expired at now
+// Keys are deleted together with one query per GORM_CLEANUP_BATCH_KEYS keys,
+// rather than one query per key
+func (c *GORMCache) CleanupAll(configs map[string]*KeyConfig, now time.Time) CleanupResult {
+	var result CleanupResult
+	var conditions []string
+	var args []interface{}
+	deleteExpired := func() {
+		if len(conditions) > 0 {
+			deleted := c.DB.Where(strings.Join(conditions, " OR "), args...).Delete(&CacheEntry{})
+			result.Removed += deleted.RowsAffected
+			if deleted.Error != nil {
+				result.Errors = append(result.Errors, deleted.Error)
+			}
+			conditions, args = nil, nil
+		}
+	}
+
+	for key, config := range configs {
+		conditions = append(conditions, "(key = ? AND timestamp < ?)")
+		args = append(args, key, config.GetExpireTime(now))
+		if len(conditions) == GORM_CLEANUP_BATCH_KEYS {
+			deleteExpired()
+		}
+	}
+	deleteExpired()
+	return result
+}
+
+func (c *GORMCache) KeyEntries(key string) []EntryInfo {
+	var entries []EntryInfo
+	paramsColumn := "params"
+	if c.HashParams {
+		paramsColumn = "full_params AS params"
+	}
+	c.DB.Model(&CacheEntry{}).
+		Select(paramsColumn+", timestamp, length(data) AS size, is_compressed, created_at, hit_count").
+		Where("key = ?", key).
+		Scan(&entries)
+	return entries
+}
+
+// Iterate streams entries from the database, with original params when HashParams is set
+func (c *GORMCache) Iterate(fn func(key string, params string, timestamp time.Time) bool) error {
+	paramsColumn := "params"
+	if c.HashParams {
+		paramsColumn = "full_params"
 	}
+	rows, err := c.DB.Model(&CacheEntry{}).Select("key, " + paramsColumn + ", timestamp").Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key, params string
+		var timestamp time.Time
+		if err := rows.Scan(&key, &params, &timestamp); err != nil {
+			return err
+		}
+		if !fn(key, params, timestamp) {
+			break
+		}
+	}
+	return rows.Err()
 }
 
 func (c *GORMCache) EntryCount() int64 {
@@ -129,13 +497,22 @@ func (c *GORMCache) EntryCount() int64 {
 }
 
 func (c *GORMCache) ExpiredEntryCount() int64 {
-	now := time.Now().UTC()
+	now := c.GetConfig().Now()
 	var total int64
-	for key, config := range c.CacheConfig.Configs {
-		cutoff := now.Add(-1 * time.Duration(config.TTL) * time.Second)
+	for key, config := range c.GetConfig().KeyConfigs() {
+		cutoff := config.GetExpireTime(now)
 		var count int64
 		c.DB.Model(&CacheEntry{}).Where("key = ? AND timestamp < ?", key, cutoff).Count(&count)
 		total += count
 	}
 	return total
 }
+
+// Close closes the database connections of DB, which must not be used afterwards
+func (c *GORMCache) Close() error {
+	db, err := c.DB.DB()
+	if err != nil {
+		return err
+	}
+	return db.Close()
+}
@@ -1,7 +1,9 @@
 package cachefunk_test
 
 import (
+	"errors"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
@@ -35,6 +37,52 @@ func TestGORMCache(t *testing.T) {
 	cache.Clear()
 	runTestCacheFuncWithContextErrorsReturned(t, cache)
 	cache.Clear()
+	runTestCacheObjectMany(t, cache)
+	cache.Clear()
+	runTestSetMany(t, cache)
+	cache.Clear()
+	runTestWarm(t, cache)
+	cache.Clear()
+	runTestCacheObjectAs(t, cache)
+	cache.Clear()
+	runTestGetOrSet(t, cache)
+	cache.Clear()
+	runTestKeyEntries(t, cache)
+	cache.Clear()
+	runTestMaxDecompressedSize(t, cache)
+	cache.Clear()
+	runTestMaxValueBytes(t, cache)
+	cache.Clear()
+	runTestHas(t, cache)
+	cache.Clear()
+	runTestAdaptiveCompression(t, cache)
+	cache.Clear()
+	runTestMustGet(t, cache)
+	cache.Clear()
+	runTestCacheObjectWithMeta(t, cache)
+	cache.Clear()
+	runTestCacheMode(t, cache)
+	cache.Clear()
+	runTestCompressionContext(t, cache)
+	cache.Clear()
+	runTestWrapMeta(t, cache)
+	cache.Clear()
+	runTestIterate(t, cache)
+	cache.Clear()
+	runTestCacheWithTTL(t, cache)
+	cache.Clear()
+	runTestPoisonedEntries(t, cache)
+	cache.Clear()
+	runTestInvalidatePrefix(t, cache)
+	cache.Clear()
+	runTestCleanupBatch(t, cache)
+	cache.Clear()
+	runTestForceCleanup(t, cache)
+	cache.Clear()
+	runTestGetManyBatches(t, cache)
+	cache.Clear()
+	runTestHitCount(t, cache)
+	cache.Clear()
 	expireAllEntries := func() {
 		cache.DB.Model(cachefunk.CacheEntry{}).Where("1=1").Update("timestamp", time.Time{})
 	}
@@ -43,6 +91,349 @@ func TestGORMCache(t *testing.T) {
 	runTestCachePoisoning(t, cache)
 }
 
+func TestGORMCacheIndexes(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal("failed to connect database")
+	}
+
+	cachefunk.NewGORMCache(db)
+	for _, name := range []string{"idx_key_params", "idx_key_timestamp"} {
+		if !db.Migrator().HasIndex(&cachefunk.CacheEntry{}, name) {
+			t.Errorf("expected index %s to exist", name)
+		}
+	}
+}
+
+func TestGORMCacheTableName(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal("failed to connect database")
+	}
+
+	config := &cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 60},
+		},
+	}
+	first := cachefunk.NewGORMCache(db, cachefunk.WithTableName("first_cache"))
+	first.SetConfig(config)
+	second := cachefunk.NewGORMCache(db, cachefunk.WithTableName("second_cache"))
+	second.SetConfig(config)
+
+	for _, table := range []string{"first_cache", "second_cache"} {
+		if !db.Migrator().HasTable(table) {
+			t.Errorf("expected table %s to exist", table)
+		}
+	}
+	if db.Migrator().HasTable(&cachefunk.CacheEntry{}) {
+		t.Error("expected default table not to be created")
+	}
+	if !db.Migrator().HasIndex("second_cache", "idx_second_cache_key_params") {
+		t.Error("expected index idx_second_cache_key_params to exist")
+	}
+
+	first.Set("hello", "params", []byte("first"))
+	second.Set("hello", "params", []byte("second"))
+	second.Set("hello", "other", []byte("second"))
+
+	if value, found := first.Get("hello", "params"); !found || string(value) != "first" {
+		t.Errorf("expected %q got %q", "first", value)
+	}
+	if value, found := second.Get("hello", "params"); !found || string(value) != "second" {
+		t.Errorf("expected %q got %q", "second", value)
+	}
+	if count := first.EntryCount(); count != 1 {
+		t.Errorf("expected %d entry in first cache got %d", 1, count)
+	}
+
+	second.Clear()
+	if count := second.EntryCount(); count != 0 {
+		t.Errorf("expected %d entries in second cache got %d", 0, count)
+	}
+	if count := first.EntryCount(); count != 1 {
+		t.Errorf("expected %d entry in first cache after clearing second got %d", 1, count)
+	}
+}
+
+func TestGORMCacheCleanupAll(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal("failed to connect database")
+	}
+
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	config := &cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{},
+		Clock:   func() time.Time { return now },
+	}
+	cache := cachefunk.NewGORMCache(db)
+	cache.SetConfig(config)
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		config.Set(key, &cachefunk.KeyConfig{TTL: int64(i + 1)})
+		cache.SetRaw(key, "fresh", []byte("fresh"), now, false)
+		cache.SetRaw(key, "expired", []byte("expired"), now.Add(-time.Duration(i+2)*time.Second), false)
+	}
+
+	var queries int
+	db.Callback().Delete().After("gorm:delete").Register("test:count_deletes", func(*gorm.DB) {
+		queries += 1
+	})
+
+	cache.Cleanup()
+
+	if queries != 1 {
+		t.Errorf("expected %d delete query got %d", 1, queries)
+	}
+	if count := cache.EntryCount(); count != 100 {
+		t.Errorf("expected %d entries after cleanup got %d", 100, count)
+	}
+	if count := cache.ExpiredEntryCount(); count != 0 {
+		t.Errorf("expected %d expired entries after cleanup got %d", 0, count)
+	}
+}
+
+func TestGORMCacheHashedParams(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal("failed to connect database")
+	}
+
+	cache := cachefunk.NewGORMCache(db, cachefunk.WithHashedParams())
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 60},
+		},
+	})
+
+	// long enough to exceed MySQL's index length limit if stored in the indexed column
+	longParams := strings.Repeat("x", 5000)
+	cache.Set("hello", longParams, []byte("long"))
+	cache.SetMany("hello", map[string][]byte{"short": []byte("short")})
+
+	var stored []cachefunk.CacheEntry
+	cache.DB.Find(&stored)
+	for _, entry := range stored {
+		if len(entry.Params) != 64 {
+			t.Errorf("expected params column to hold a %d character hash got %d characters", 64, len(entry.Params))
+		}
+	}
+
+	if value, found := cache.Get("hello", longParams); !found || string(value) != "long" {
+		t.Errorf("expected %q got %q", "long", value)
+	}
+	values := cache.GetMany("hello", []string{longParams, "short", "missing"})
+	if len(values) != 2 || string(values[longParams]) != "long" || string(values["short"]) != "short" {
+		t.Errorf("expected values for long and short params got %q", values)
+	}
+
+	params := map[string]bool{}
+	for _, entry := range cache.KeyEntries("hello") {
+		params[entry.Params] = true
+	}
+	if !params[longParams] || !params["short"] {
+		t.Error("expected KeyEntries to report the full params")
+	}
+}
+
+func TestGORMCacheContext(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal("failed to connect database")
+	}
+
+	runTestContextCache(t, cachefunk.NewGORMCache(db))
+}
+
+func TestGORMCacheGetManyError(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal("failed to connect database")
+	}
+
+	cache := cachefunk.NewGORMCache(db)
+	observer := &recordingObserver{}
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 60},
+		},
+		Observer: observer,
+	})
+	cache.Close()
+
+	if values := cache.GetMany("hello", []string{"bob", "clark"}); len(values) != 0 {
+		t.Errorf("expected no values got %d", len(values))
+	}
+	if len(observer.events) != 1 || observer.events[0] != "get error hello" {
+		t.Errorf("expected a get error to be reported got %v", observer.events)
+	}
+}
+
+func TestGORMCacheEntryFormatVersion(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal("failed to connect database")
+	}
+
+	cache := cachefunk.NewGORMCache(db)
+	observer := &recordingObserver{}
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 60},
+		},
+		Observer: observer,
+	})
+
+	cache.Set("hello", "world", []byte("value"))
+	var entry cachefunk.CacheEntry
+	if err := db.First(&entry).Error; err != nil {
+		t.Fatal(err)
+	}
+	if entry.Data[0] != cachefunk.ENTRY_FORMAT_VERSION {
+		t.Fatalf("expected stored value to start with version %d got %d", cachefunk.ENTRY_FORMAT_VERSION, entry.Data[0])
+	}
+	entry.Data[0] = cachefunk.ENTRY_FORMAT_VERSION + 1
+	db.Model(&entry).Update("data", entry.Data)
+
+	// an unknown version must be treated as a miss rather than misread
+	if values := cache.GetMany("hello", []string{"world"}); len(values) != 0 {
+		t.Errorf("expected entry with unknown format version to be a miss got %d values", len(values))
+	}
+	if _, found := cache.Get("hello", "world"); found {
+		t.Error("expected entry with unknown format version to be a miss")
+	}
+	if len(observer.getErrors) != 2 {
+		t.Fatalf("expected %d get errors got %v", 2, observer.getErrors)
+	}
+	for _, err := range observer.getErrors {
+		if !errors.Is(err, cachefunk.ErrUnknownEntryVersion) {
+			t.Errorf("expected unknown format version to be reported got %v", err)
+		}
+	}
+	if count := cache.EntryCount(); count != 0 {
+		t.Errorf("expected Get to remove the unreadable entry got %d entries", count)
+	}
+}
+
+func TestGORMCacheClose(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal("failed to connect database")
+	}
+
+	cache := cachefunk.NewGORMCache(db)
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 60},
+		},
+	})
+	cache.Set("hello", "params", []byte("value"))
+
+	layered := cachefunk.NewLayeredCache(cachefunk.NewInMemoryCache(), cache)
+	if err := cachefunk.Close(layered); err != nil {
+		t.Fatal("unexpected error closing cache:", err)
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal("failed to get database:", err)
+	}
+	if open := sqlDB.Stats().OpenConnections; open != 0 {
+		t.Errorf("expected %d open connections after close got %d", 0, open)
+	}
+	if err := sqlDB.Ping(); err == nil {
+		t.Error("expected database to be closed")
+	}
+}
+
+func TestGORMCacheClearPrefixCaseSensitive(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal("failed to connect database")
+	}
+
+	cache := cachefunk.NewGORMCache(db)
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"User:profile": {TTL: 60},
+			"user:profile": {TTL: 60},
+		},
+	})
+	cache.Set("User:profile", "bob", []byte("1"))
+	cache.Set("user:profile", "bob", []byte("2"))
+
+	// LIKE ignores case in SQLite and MySQL, but prefixes must not
+	if err := cachefunk.InvalidatePrefix(cache, "user:"); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, found := cache.Get("User:profile", "bob"); !found {
+		t.Error("expected key differing in case from the prefix to be kept")
+	}
+	if _, found := cache.Get("user:profile", "bob"); found {
+		t.Error("expected key matching the prefix to be removed")
+	}
+}
+
+func TestGORMCacheCompareAndSet(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal("failed to connect database")
+	}
+
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	config := &cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 60},
+		},
+		Clock: func() time.Time { return now },
+	}
+	// two instances sharing the database
+	first := cachefunk.NewGORMCache(db)
+	first.SetConfig(config)
+	second := cachefunk.NewGORMCache(db)
+	second.SetConfig(config)
+
+	if swapped, err := first.CompareAndSet("hello", "params", time.Time{}, []byte("first")); !swapped || err != nil {
+		t.Fatalf("expected set of missing entry to succeed got %v %v", swapped, err)
+	}
+	if swapped, _ := second.CompareAndSet("hello", "params", time.Time{}, []byte("second")); swapped {
+		t.Fatal("expected set of missing entry to fail once it exists")
+	}
+
+	// both instances read the entry, then race to replace it
+	_, firstInfo, _ := first.GetWithInfo("hello", "params")
+	_, secondInfo, _ := second.GetWithInfo("hello", "params")
+	now = now.Add(time.Second)
+
+	testCases := []struct {
+		cache    *cachefunk.GORMCache
+		expected time.Time
+		value    string
+		swapped  bool
+	}{
+		{first, firstInfo.Timestamp, "first update", true},
+		{second, secondInfo.Timestamp, "second update", false},
+	}
+	for line, tc := range testCases {
+		swapped, err := tc.cache.CompareAndSet("hello", "params", tc.expected, []byte(tc.value))
+		if err != nil {
+			t.Fatalf("subtest %d: unexpected error: %v", line+1, err)
+		}
+		if swapped != tc.swapped {
+			t.Errorf("subtest %d: expected swapped %v got %v", line+1, tc.swapped, swapped)
+		}
+	}
+
+	if value, found := second.Get("hello", "params"); !found || string(value) != "first update" {
+		t.Errorf("expected %q got %q", "first update", value)
+	}
+	if count := first.EntryCount(); count != 1 {
+		t.Errorf("expected %d entry got %d", 1, count)
+	}
+}
+
 func ExampleGORMCache() {
 	type HelloWorldParams struct {
 		Name string
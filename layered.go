@@ -0,0 +1,260 @@
+package cachefunk
+
+import (
+	"errors"
+	"time"
+)
+
+// readOnlyCache is implemented by caches that cannot be written to, such as FSCache
+type readOnlyCache interface {
+	readOnly()
+}
+
+func isReadOnly(cache Cache) bool {
+	_, ok := cache.(readOnlyCache)
+	return ok
+}
+
+// LayeredCache reads from a list of caches in order and writes to the first writable one
+// It can serve a prebuilt read-only FSCache with a writable cache in front of it for misses.
+// Clear, ClearKey, Delete and Cleanup apply to every writable layer.
+type LayeredCache struct {
+	Layers []Cache
+}
+
+func NewLayeredCache(layers ...Cache) *LayeredCache {
+	cache := LayeredCache{
+		Layers: layers,
+	}
+	return &cache
+}
+
+// writable returns the first layer that can be written to, or nil if every layer is read-only
+func (c *LayeredCache) writable() Cache {
+	for _, layer := range c.Layers {
+		if !isReadOnly(layer) {
+			return layer
+		}
+	}
+	return nil
+}
+
+// SetConfig sets the config of every layer
+func (c *LayeredCache) SetConfig(config *CacheFunkConfig) {
+	for _, layer := range c.Layers {
+		layer.SetConfig(config)
+	}
+}
+
+func (c *LayeredCache) GetConfig() *CacheFunkConfig {
+	if len(c.Layers) == 0 {
+		return nil
+	}
+	return c.Layers[0].GetConfig()
+}
+
+func (c *LayeredCache) GetIgnoreCacheCtxKey() interface{} {
+	if len(c.Layers) == 0 {
+		return DEFAULT_IGNORE_CACHE_CTX_KEY
+	}
+	return c.Layers[0].GetIgnoreCacheCtxKey()
+}
+
+func (c *LayeredCache) Get(key string, params string) ([]byte, bool) {
+	value, _, found := c.GetWithInfo(key, params)
+	return value, found
+}
+
+// GetWithInfo returns the value from the first layer that has it
+// If no layer has the value, the info of the first expired entry is returned
+func (c *LayeredCache) GetWithInfo(key string, params string) ([]byte, EntryInfo, bool) {
+	var expired EntryInfo
+	for _, layer := range c.Layers {
+		value, info, found := layer.GetWithInfo(key, params)
+		if found {
+			return value, info, true
+		}
+		if expired.Timestamp.IsZero() {
+			expired = info
+		}
+	}
+	return nil, expired, false
+}
+
+// GetMany asks each layer in turn for the params still missing
+func (c *LayeredCache) GetMany(key string, paramsList []string) map[string][]byte {
+	values := make(map[string][]byte, len(paramsList))
+	missing := paramsList
+	for _, layer := range c.Layers {
+		if len(missing) == 0 {
+			break
+		}
+		var next []string
+		found := layer.GetMany(key, missing)
+		for _, params := range missing {
+			if value, ok := found[params]; ok {
+				values[params] = value
+			} else {
+				next = append(next, params)
+			}
+		}
+		missing = next
+	}
+	return values
+}
+
+func (c *LayeredCache) Set(key string, params string, value []byte) {
+	if layer := c.writable(); layer != nil {
+		layer.Set(key, params, value)
+	} else {
+		c.GetConfig().notifySetError(key, ErrReadOnly)
+	}
+}
+
+func (c *LayeredCache) SetMany(key string, values map[string][]byte) {
+	if layer := c.writable(); layer != nil {
+		layer.SetMany(key, values)
+	} else {
+		c.GetConfig().notifySetError(key, ErrReadOnly)
+	}
+}
+
+func (c *LayeredCache) SetRaw(key string, params string, value []byte, timestamp time.Time, isCompressed bool) {
+	if layer := c.writable(); layer != nil {
+		layer.SetRaw(key, params, value, timestamp, isCompressed)
+	} else {
+		c.GetConfig().notifySetError(key, ErrReadOnly)
+	}
+}
+
+// KeyEntries lists the entries of every layer, so params stored in more than one layer are listed more than once
+func (c *LayeredCache) KeyEntries(key string) []EntryInfo {
+	var entries []EntryInfo
+	for _, layer := range c.Layers {
+		entries = append(entries, layer.KeyEntries(key)...)
+	}
+	return entries
+}
+
+// Iterate visits the entries of every layer in order
+func (c *LayeredCache) Iterate(fn func(key string, params string, timestamp time.Time) bool) error {
+	stopped := false
+	for _, layer := range c.Layers {
+		err := layer.Iterate(func(key string, params string, timestamp time.Time) bool {
+			stopped = !fn(key, params, timestamp)
+			return !stopped
+		})
+		if err != nil {
+			return err
+		}
+		if stopped {
+			break
+		}
+	}
+	return nil
+}
+
+func (c *LayeredCache) EntryCount() int64 {
+	var count int64
+	for _, layer := range c.Layers {
+		count += layer.EntryCount()
+	}
+	return count
+}
+
+func (c *LayeredCache) ExpiredEntryCount() int64 {
+	var count int64
+	for _, layer := range c.Layers {
+		count += layer.ExpiredEntryCount()
+	}
+	return count
+}
+
+func (c *LayeredCache) Clear() {
+	for _, layer := range c.Layers {
+		if !isReadOnly(layer) {
+			layer.Clear()
+		}
+	}
+}
+
+func (c *LayeredCache) ClearKey(key string) {
+	for _, layer := range c.Layers {
+		if !isReadOnly(layer) {
+			layer.ClearKey(key)
+		}
+	}
+}
+
+func (c *LayeredCache) Delete(key string, params string) {
+	for _, layer := range c.Layers {
+		if !isReadOnly(layer) {
+			layer.Delete(key, params)
+		}
+	}
+}
+
+func (c *LayeredCache) Cleanup() {
+	c.CleanupWithResult()
+}
+
+// CleanupWithResult cleans up every writable layer and combines their results
+func (c *LayeredCache) CleanupWithResult() CleanupResult {
+	var result CleanupResult
+	for _, layer := range c.Layers {
+		if isReadOnly(layer) {
+			continue
+		}
+		layerResult := layer.CleanupWithResult()
+		result.Removed += layerResult.Removed
+		result.Errors = append(result.Errors, layerResult.Errors...)
+	}
+	return result
+}
+
+// CleanupBatch deletes at most maxDeletes expired entries across the writable layers,
+// see the CleanupBatch function
+func (c *LayeredCache) CleanupBatch(maxDeletes int) CleanupResult {
+	if maxDeletes <= 0 {
+		return c.CleanupWithResult()
+	}
+	var result CleanupResult
+	for _, layer := range c.Layers {
+		left := maxDeletes - int(result.Removed)
+		if left <= 0 {
+			break
+		}
+		if isReadOnly(layer) {
+			continue
+		}
+		layerResult := CleanupBatch(layer, left)
+		result.Removed += layerResult.Removed
+		result.Errors = append(result.Errors, layerResult.Errors...)
+	}
+	return result
+}
+
+// ForceCleanup force cleans key in every writable layer, see the ForceCleanup function
+func (c *LayeredCache) ForceCleanup(key string, maxAge time.Duration) CleanupResult {
+	var result CleanupResult
+	for _, layer := range c.Layers {
+		if isReadOnly(layer) {
+			continue
+		}
+		layerResult := ForceCleanup(layer, key, maxAge)
+		result.Removed += layerResult.Removed
+		result.Errors = append(result.Errors, layerResult.Errors...)
+	}
+	return result
+}
+
+// Close closes every layer that implements ClosableCache
+func (c *LayeredCache) Close() error {
+	var errs []error
+	for _, layer := range c.Layers {
+		if err := Close(layer); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
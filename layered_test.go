@@ -0,0 +1,91 @@
+package cachefunk_test
+
+import (
+	"path"
+	"testing"
+	"testing/fstest"
+
+	"github.com/rohfle/cachefunk"
+)
+
+func TestLayeredCache(t *testing.T) {
+	cache := cachefunk.NewLayeredCache(cachefunk.NewInMemoryCache(), cachefunk.NewFSCache(fstest.MapFS{}))
+
+	runTestWrapString(t, cache)
+	cache.Clear()
+	runTestWrapObject(t, cache)
+	cache.Clear()
+	runTestCacheFuncErrorsReturned(t, cache)
+	cache.Clear()
+	runTestCacheObjectMany(t, cache)
+	cache.Clear()
+	runTestSetMany(t, cache)
+	cache.Clear()
+	runTestGetOrSet(t, cache)
+	cache.Clear()
+	runTestHas(t, cache)
+	cache.Clear()
+	runTestCacheObjectWithMeta(t, cache)
+	cache.Clear()
+	runTestIterate(t, cache)
+	cache.Clear()
+}
+
+func TestLayeredCacheFallback(t *testing.T) {
+	embedded := fstest.MapFS{}
+	for _, params := range []string{`"bob"`, `"clark"`} {
+		name := path.Join(cachefunk.DefaultCalculatePath("hello", params)...)
+		embedded[name] = &fstest.MapFile{Data: append([]byte{cachefunk.ENTRY_FORMAT_VERSION}, `"embedded"`...)}
+	}
+	memory := cachefunk.NewInMemoryCache()
+	cache := cachefunk.NewLayeredCache(cachefunk.NewFSCache(embedded), memory)
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 60},
+		},
+	})
+
+	calls := 0
+	hello := cachefunk.WrapObject(cache, "hello", func(ignoreCache bool, name string) (string, error) {
+		calls += 1
+		return "resolved", nil
+	})
+
+	tests := []struct {
+		Params   string
+		Expected string
+		Calls    int
+	}{
+		{"bob", "embedded", 0},
+		{"lois", "resolved", 1},
+		{"lois", "resolved", 1},
+	}
+	for line, test := range tests {
+		value, err := hello(false, test.Params)
+		if err != nil {
+			t.Fatalf("subtest %d: unexpected error: %v", line+1, err)
+		}
+		if value != test.Expected || calls != test.Calls {
+			t.Errorf("subtest %d: expected %q after %d calls got %q after %d calls", line+1, test.Expected, test.Calls, value, calls)
+		}
+	}
+
+	if count := memory.EntryCount(); count != 1 {
+		t.Errorf("expected %d entry in the writable layer got %d", 1, count)
+	}
+	values := cache.GetMany("hello", []string{`"bob"`, `"lois"`, `"missing"`})
+	if len(values) != 2 {
+		t.Errorf("expected values from both layers got %q", values)
+	}
+
+	cache.Clear()
+	if count := memory.EntryCount(); count != 0 {
+		t.Errorf("expected writable layer to be cleared got %d entries", count)
+	}
+	if value, err := hello(false, "clark"); err != nil || value != "embedded" {
+		t.Errorf("expected read-only layer to survive clear got %q %v", value, err)
+	}
+	if err := cache.CleanupWithResult().Err(); err != nil {
+		t.Errorf("expected cleanup to skip the read-only layer got %v", err)
+	}
+}
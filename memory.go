@@ -1,114 +1,246 @@
 package cachefunk
 
 import (
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type InMemoryCacheEntry struct {
+	// Key and Params identify the entry, so entries are matched exactly whatever the Store key layout
+	Key          string
+	Params       string
 	Data         string
 	Timestamp    time.Time
 	IsCompressed bool
+	// CreatedAt is when the entry was first stored, and is kept when it is overwritten
+	CreatedAt time.Time
+	// HitCount is how many times the entry has been returned, updated atomically
+	HitCount int64
 }
 
 type InMemoryCache struct {
 	CacheConfig       *CacheFunkConfig
+	configMutex       sync.RWMutex
 	Store             map[string]*InMemoryCacheEntry
-	IgnoreCacheCtxKey CtxKey
+	IgnoreCacheCtxKey interface{}
+	// KeyFunc composes the Store key for an entry from its key and params, DefaultKeyFunc is used if nil
+	// It must return a different Store key for each key and params
+	KeyFunc func(key string, params string) string
 }
 
+// DefaultKeyFunc composes Store keys as key + ":" + params
+func DefaultKeyFunc(key string, params string) string {
+	return key + ":" + params
+}
+
+// SetConfig swaps the config used by the cache, which is safe to do while the cache is in use
 func (c *InMemoryCache) SetConfig(config *CacheFunkConfig) {
+	c.configMutex.Lock()
+	defer c.configMutex.Unlock()
+	config.resetMerged()
 	c.CacheConfig = config
 }
 
+func (c *InMemoryCache) GetConfig() *CacheFunkConfig {
+	c.configMutex.RLock()
+	defer c.configMutex.RUnlock()
+	return c.CacheConfig
+}
+
 func NewInMemoryCache() *InMemoryCache {
 	cache := InMemoryCache{
 		Store:             make(map[string]*InMemoryCacheEntry, 0),
 		IgnoreCacheCtxKey: DEFAULT_IGNORE_CACHE_CTX_KEY,
+		KeyFunc:           DefaultKeyFunc,
 	}
 	return &cache
 }
 
-func (c *InMemoryCache) GetIgnoreCacheCtxKey() CtxKey {
+func (c *InMemoryCache) fullKey(key string, params string) string {
+	if c.KeyFunc == nil {
+		return DefaultKeyFunc(key, params)
+	}
+	return c.KeyFunc(key, params)
+}
+
+func (c *InMemoryCache) GetIgnoreCacheCtxKey() interface{} {
 	return c.IgnoreCacheCtxKey
 }
 
 func (c *InMemoryCache) Get(key string, params string) ([]byte, bool) {
-	fullKey := key + ":" + params
+	value, _, found := c.GetWithInfo(key, params)
+	return value, found
+}
+
+func (c *InMemoryCache) GetWithInfo(key string, params string) ([]byte, EntryInfo, bool) {
+	fullKey := c.fullKey(key, params)
 	value, found := c.Store[fullKey]
 	if !found {
-		return nil, false
+		return nil, EntryInfo{}, false
 	}
+	info := value.info()
 	// check if cached value has expired
-	config := c.CacheConfig.Get(key)
-	expiry := value.Timestamp.Add(time.Second * time.Duration(config.TTL))
-	if time.Now().UTC().After(expiry) {
+	config := c.GetConfig().Get(key)
+	if value.Timestamp.Before(config.GetExpireTime(c.GetConfig().Now())) {
 		delete(c.Store, fullKey)
-		return nil, false
+		c.GetConfig().notifyExpired(key)
+		return nil, info, false
 	}
 
-	data := []byte(value.Data)
+	data, ok := value.decode(c.GetConfig(), key, config)
+	if !ok {
+		delete(c.Store, fullKey)
+		return nil, EntryInfo{}, false
+	}
+	info.HitCount = value.hit()
+	return data, info, true
+}
+
+// decode returns the value stored in the entry, decompressing it if needed
+// ok is false if the entry could not be decoded, and ErrUnknownEntryVersion is reported
+// to the Observer of cfg when the entry has an unknown format version
+func (value *InMemoryCacheEntry) decode(cfg *CacheFunkConfig, key string, config *KeyConfig) ([]byte, bool) {
+	data, err := decodeEntry([]byte(value.Data))
+	if err != nil {
+		cfg.notifyGetError(key, err)
+		return nil, false
+	}
 
 	if value.IsCompressed {
-		var err error
-		data, err = decompressBytes(data)
+		data, err = decompressBytes(data, config.MaxDecompressedSize)
 		if err != nil {
 			return nil, false
 		}
 	}
-
 	return data, true
 }
 
-func (c *InMemoryCache) Set(key string, params string, value []byte) {
-	config := c.CacheConfig.Get(key)
-	if config.TTL <= 0 {
-		return // immediately discard the entry
+// info returns information about the entry
+func (value *InMemoryCacheEntry) info() EntryInfo {
+	return EntryInfo{
+		Params:       value.Params,
+		Timestamp:    value.Timestamp,
+		Size:         int64(len(value.Data)),
+		IsCompressed: value.IsCompressed,
+		CreatedAt:    value.CreatedAt,
+		HitCount:     atomic.LoadInt64(&value.HitCount),
 	}
+}
+
+// hit counts the entry being returned and returns the new HitCount
+func (value *InMemoryCacheEntry) hit() int64 {
+	return atomic.AddInt64(&value.HitCount, 1)
+}
 
-	timestamp := time.Now().UTC()
-	if config.TTLJitter > 0 {
-		timestamp = timestamp.Add(-1 * time.Duration(config.TTLJitter) * time.Second)
+// newInMemoryCacheEntry creates an entry created at now, or when existing was created if it is being overwritten
+func newInMemoryCacheEntry(key string, params string, value []byte, timestamp time.Time, isCompressed bool, now time.Time, existing *InMemoryCacheEntry) *InMemoryCacheEntry {
+	entry := &InMemoryCacheEntry{
+		Key:          key,
+		Params:       params,
+		Data:         string(encodeEntry(value)),
+		Timestamp:    timestamp,
+		IsCompressed: isCompressed,
+		CreatedAt:    now,
+	}
+	if existing != nil {
+		entry.CreatedAt = existing.CreatedAt
+		entry.HitCount = atomic.LoadInt64(&existing.HitCount)
 	}
+	return entry
+}
 
-	if config.UseCompression {
-		var err error
-		value, err = compressBytes(value)
-		if err != nil {
-			return
+// GetMany will get many cache values for a key in a single pass
+func (c *InMemoryCache) GetMany(key string, paramsList []string) map[string][]byte {
+	values := make(map[string][]byte, len(paramsList))
+	for _, params := range paramsList {
+		if value, found := c.Get(key, params); found {
+			values[params] = value
 		}
 	}
+	return values
+}
+
+func (c *InMemoryCache) Set(key string, params string, value []byte) {
+	config := c.GetConfig().Get(key)
+	if config.IsImmediateExpire() {
+		return // immediately discard the entry
+	}
+
+	timestamp := c.GetConfig().GetTimestamp(config)
+
+	value, isCompressed, err := c.GetConfig().compressValue(key, config, value)
+	if err != nil {
+		c.GetConfig().notifySetError(key, err)
+		return
+	}
 
-	c.SetRaw(key, params, value, timestamp, config.UseCompression)
+	c.SetRaw(key, params, value, timestamp, isCompressed)
 }
 
-func (c *InMemoryCache) SetRaw(key string, params string, value []byte, timestamp time.Time, isCompressed bool) {
-	fullKey := key + ":" + params
-	c.Store[fullKey] = &InMemoryCacheEntry{
-		Data:         string(value),
-		Timestamp:    timestamp,
-		IsCompressed: isCompressed,
+// SetMany will set many cache values for a key
+func (c *InMemoryCache) SetMany(key string, values map[string][]byte) {
+	for params, value := range values {
+		c.Set(key, params, value)
 	}
 }
 
+func (c *InMemoryCache) SetRaw(key string, params string, value []byte, timestamp time.Time, isCompressed bool) {
+	fullKey := c.fullKey(key, params)
+	c.Store[fullKey] = newInMemoryCacheEntry(key, params, value, timestamp, isCompressed, c.GetConfig().Now(), c.Store[fullKey])
+}
+
 func (c *InMemoryCache) Clear() {
 	c.Store = make(map[string]*InMemoryCacheEntry, 0)
 }
 
-func (c *InMemoryCache) Cleanup() {
-	now := time.Now().UTC()
-	for key, config := range c.CacheConfig.Configs {
-		cutoff := now.Add(-1 * time.Duration(config.TTL) * time.Second)
-		var expiredKeys []string
-		for fullkey, value := range c.Store {
-			if strings.HasPrefix(fullkey, key+":") && value.Timestamp.Before(cutoff) {
-				expiredKeys = append(expiredKeys, fullkey)
-			}
+func (c *InMemoryCache) ClearKey(key string) {
+	for fullkey, value := range c.Store {
+		if value.Key == key {
+			delete(c.Store, fullkey)
 		}
-		for _, fullkey := range expiredKeys {
+	}
+}
+
+func (c *InMemoryCache) Delete(key string, params string) {
+	delete(c.Store, c.fullKey(key, params))
+}
+
+func (c *InMemoryCache) Cleanup() {
+	c.CleanupWithResult()
+}
+
+func (c *InMemoryCache) CleanupWithResult() CleanupResult {
+	var result CleanupResult
+	now := c.GetConfig().Now()
+	configs := c.GetConfig().KeyConfigs()
+	for fullkey, value := range c.Store {
+		config, exists := configs[value.Key]
+		if exists && value.Timestamp.Before(config.GetExpireTime(now)) {
 			delete(c.Store, fullkey)
+			result.Removed += 1
 		}
 	}
+	return result
+}
+
+func (c *InMemoryCache) KeyEntries(key string) []EntryInfo {
+	var entries []EntryInfo
+	for _, value := range c.Store {
+		if value.Key == key {
+			entries = append(entries, value.info())
+		}
+	}
+	return entries
+}
+
+func (c *InMemoryCache) Iterate(fn func(key string, params string, timestamp time.Time) bool) error {
+	for _, value := range c.Store {
+		if !fn(value.Key, value.Params, value.Timestamp) {
+			break
+		}
+	}
+	return nil
 }
 
 func (c *InMemoryCache) EntryCount() int64 {
@@ -117,14 +249,18 @@ func (c *InMemoryCache) EntryCount() int64 {
 
 func (c *InMemoryCache) ExpiredEntryCount() int64 {
 	var count int64 = 0
-	now := time.Now().UTC()
-	for key, config := range c.CacheConfig.Configs {
-		cutoff := now.Add(-1 * time.Duration(config.TTL) * time.Second)
-		for fullkey, value := range c.Store {
-			if strings.HasPrefix(fullkey, key+":") && value.Timestamp.Before(cutoff) {
-				count += 1
-			}
+	now := c.GetConfig().Now()
+	configs := c.GetConfig().KeyConfigs()
+	for _, value := range c.Store {
+		config, exists := configs[value.Key]
+		if exists && value.Timestamp.Before(config.GetExpireTime(now)) {
+			count += 1
 		}
 	}
 	return count
 }
+
+// Close does nothing as InMemoryCache holds no resources
+func (c *InMemoryCache) Close() error {
+	return nil
+}
@@ -1,6 +1,7 @@
 package cachefunk_test
 
 import (
+	"errors"
 	"fmt"
 	"testing"
 	"time"
@@ -23,6 +24,50 @@ func TestInMemoryCache(t *testing.T) {
 	cache.Clear()
 	runTestCacheFuncWithContextErrorsReturned(t, cache)
 	cache.Clear()
+	runTestCacheObjectMany(t, cache)
+	cache.Clear()
+	runTestSetMany(t, cache)
+	cache.Clear()
+	runTestWarm(t, cache)
+	cache.Clear()
+	runTestCacheObjectAs(t, cache)
+	cache.Clear()
+	runTestGetOrSet(t, cache)
+	cache.Clear()
+	runTestKeyEntries(t, cache)
+	cache.Clear()
+	runTestMaxDecompressedSize(t, cache)
+	cache.Clear()
+	runTestMaxValueBytes(t, cache)
+	cache.Clear()
+	runTestHas(t, cache)
+	cache.Clear()
+	runTestAdaptiveCompression(t, cache)
+	cache.Clear()
+	runTestMustGet(t, cache)
+	cache.Clear()
+	runTestCacheObjectWithMeta(t, cache)
+	cache.Clear()
+	runTestCacheMode(t, cache)
+	cache.Clear()
+	runTestCompressionContext(t, cache)
+	cache.Clear()
+	runTestWrapMeta(t, cache)
+	cache.Clear()
+	runTestIterate(t, cache)
+	cache.Clear()
+	runTestCacheWithTTL(t, cache)
+	cache.Clear()
+	runTestPoisonedEntries(t, cache)
+	cache.Clear()
+	runTestInvalidatePrefix(t, cache)
+	cache.Clear()
+	runTestCleanupBatch(t, cache)
+	cache.Clear()
+	runTestForceCleanup(t, cache)
+	cache.Clear()
+	runTestHitCount(t, cache)
+	cache.Clear()
 	expireAllEntries := func() {
 		for _, value := range cache.Store {
 			value.Timestamp = time.Time{}
@@ -54,3 +99,117 @@ func ExampleInMemoryCache() {
 	value, err = HelloWorld(false, params)
 	fmt.Println("Second call:", value, err)
 }
+
+func TestInMemoryCacheEntryFormatVersion(t *testing.T) {
+	cache := cachefunk.NewInMemoryCache()
+	observer := &recordingObserver{}
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 5},
+		},
+		Observer: observer,
+	})
+
+	cache.Set("hello", "world", []byte("value"))
+	entry, found := cache.Store["hello:world"]
+	if !found {
+		t.Fatal("expected entry to be stored")
+	}
+	if entry.Data[0] != cachefunk.ENTRY_FORMAT_VERSION {
+		t.Fatalf("expected stored value to start with version %d got %d", cachefunk.ENTRY_FORMAT_VERSION, entry.Data[0])
+	}
+	if value, found := cache.Get("hello", "world"); !found || string(value) != "value" {
+		t.Fatalf("expected \"value\" got \"%s\" (found %v)", value, found)
+	}
+
+	// an unknown version must be treated as a miss rather than misread
+	entry.Data = string([]byte{cachefunk.ENTRY_FORMAT_VERSION + 1}) + "value"
+	if _, found := cache.Get("hello", "world"); found {
+		t.Fatal("expected entry with unknown format version to be a miss")
+	}
+	if len(observer.getErrors) != 1 || !errors.Is(observer.getErrors[0], cachefunk.ErrUnknownEntryVersion) {
+		t.Fatalf("expected unknown format version to be reported got %v", observer.getErrors)
+	}
+}
+
+func TestInMemoryCacheKeyFunc(t *testing.T) {
+	cache := cachefunk.NewInMemoryCache()
+	cache.KeyFunc = func(key string, params string) string {
+		return key + "/" + params
+	}
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello":  {TTL: 60},
+			"hello2": {TTL: 60},
+		},
+	})
+
+	cache.Set("hello", "world", []byte("value"))
+	cache.SetRaw("hello", "old", []byte("old"), time.Time{}, false)
+	cache.SetRaw("hello2", "old", []byte("old"), time.Time{}, false)
+	if _, found := cache.Store["hello/world"]; !found {
+		t.Fatal("expected entry to be stored under the key from KeyFunc")
+	}
+	if value, found := cache.Get("hello", "world"); !found || string(value) != "value" {
+		t.Fatalf("expected \"value\" got \"%s\" (found %v)", value, found)
+	}
+	if entries := cache.KeyEntries("hello"); len(entries) != 2 {
+		t.Fatalf("expected 2 entries for hello got %d", len(entries))
+	}
+	if count := cache.ExpiredEntryCount(); count != 2 {
+		t.Fatalf("expected 2 expired entries got %d", count)
+	}
+	if result := cache.CleanupWithResult(); result.Removed != 2 {
+		t.Fatalf("expected cleanup to remove 2 entries got %d", result.Removed)
+	}
+	cache.ClearKey("hello")
+	if count := cache.EntryCount(); count != 0 {
+		t.Fatalf("expected 0 entries after ClearKey got %d", count)
+	}
+}
+
+func TestInMemoryCacheKeysWithColons(t *testing.T) {
+	caches := []cachefunk.Cache{
+		cachefunk.NewInMemoryCache(),
+		cachefunk.NewReadMostlyCache(),
+	}
+
+	for line, cache := range caches {
+		cache.SetConfig(&cachefunk.CacheFunkConfig{
+			Configs: map[string]*cachefunk.KeyConfig{
+				"a":   {TTL: 60},
+				"ab":  {TTL: 60},
+				"a:b": {TTL: 60},
+			},
+		})
+		// "a:b" entries used to match the "a:" prefix of key "a"
+		cache.SetRaw("a", "x:y", []byte("1"), time.Time{}, false)
+		cache.SetRaw("ab", "x:y", []byte("2"), time.Time{}, false)
+		cache.SetRaw("a:b", "z", []byte("3"), time.Time{}, false)
+		cache.Set("a:b", "fresh", []byte("4"))
+
+		if entries := cache.KeyEntries("a"); len(entries) != 1 || entries[0].Params != "x:y" {
+			t.Errorf("subtest %d: expected only entry x:y for key a got %+v", line+1, entries)
+		}
+
+		cache.SetConfig(&cachefunk.CacheFunkConfig{
+			Configs: map[string]*cachefunk.KeyConfig{
+				"a": {TTL: 60},
+			},
+		})
+		if count := cache.ExpiredEntryCount(); count != 1 {
+			t.Errorf("subtest %d: expected 1 expired entry for key a got %d", line+1, count)
+		}
+		if result := cache.CleanupWithResult(); result.Removed != 1 {
+			t.Errorf("subtest %d: expected cleanup to remove 1 entry got %d", line+1, result.Removed)
+		}
+		cache.ClearKey("a")
+		if count := cache.EntryCount(); count != 3 {
+			t.Errorf("subtest %d: expected entries for ab and a:b to remain got %d entries", line+1, count)
+		}
+		keys, _ := cachefunk.Keys(cache)
+		if fmt.Sprint(keys) != "[a:b ab]" {
+			t.Errorf("subtest %d: expected keys [a:b ab] got %v", line+1, keys)
+		}
+	}
+}
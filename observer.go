@@ -0,0 +1,58 @@
+package cachefunk
+
+// Observer receives events from the cache functions and backends
+// Set it on CacheFunkConfig.Observer for logging or metrics
+// Methods are called synchronously so they should return quickly
+type Observer interface {
+	// OnHit is called when a value is returned from the cache
+	OnHit(key string, params string)
+	// OnMiss is called when a value is not in the cache and will be retrieved
+	OnMiss(key string, params string)
+	// OnExpired is called when a backend finds an entry for key that has expired
+	OnExpired(key string)
+	// OnResolverError is called when the retrieve function for key returns an error
+	OnResolverError(key string, err error)
+	// OnSetError is called when a value for key could not be encoded for storage
+	OnSetError(key string, err error)
+	// OnGetError is called when a backend could not read entries for key, which are treated as misses
+	// Entries stored with an unknown format version are reported with ErrUnknownEntryVersion
+	OnGetError(key string, err error)
+}
+
+// The notify methods call Observer if both the config and Observer are set
+
+func (c *CacheFunkConfig) notifyHit(key string, params string) {
+	if c != nil && c.Observer != nil {
+		c.Observer.OnHit(key, params)
+	}
+}
+
+func (c *CacheFunkConfig) notifyMiss(key string, params string) {
+	if c != nil && c.Observer != nil {
+		c.Observer.OnMiss(key, params)
+	}
+}
+
+func (c *CacheFunkConfig) notifyExpired(key string) {
+	if c != nil && c.Observer != nil {
+		c.Observer.OnExpired(key)
+	}
+}
+
+func (c *CacheFunkConfig) notifyResolverError(key string, err error) {
+	if c != nil && c.Observer != nil {
+		c.Observer.OnResolverError(key, err)
+	}
+}
+
+func (c *CacheFunkConfig) notifySetError(key string, err error) {
+	if c != nil && c.Observer != nil {
+		c.Observer.OnSetError(key, err)
+	}
+}
+
+func (c *CacheFunkConfig) notifyGetError(key string, err error) {
+	if c != nil && c.Observer != nil {
+		c.Observer.OnGetError(key, err)
+	}
+}
@@ -0,0 +1,149 @@
+package cachefunk
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strconv"
+)
+
+// RenderHashedParameters renders params as the hex SHA-256 of their JSON representation.
+// This bounds the length of the rendered params to 64 characters however large params are.
+// Hashing is one way so the original params cannot be recovered from the cache.
+// nil params render as the hash of "null", as with RenderParameters.
+func RenderHashedParameters(params interface{}) (string, error) {
+	raw, err := json.Marshal(params)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(raw)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// RenderCanonicalParameters renders params as JSON with object fields sorted by name
+// and null fields removed, so equivalent params render the same whatever their Go type.
+// For example a struct and a map with the same fields, or a struct with and without
+// omitempty on a nil field, share a cache entry. It renders differently to RenderParameters,
+// so switching a key to it means entries stored before are no longer found.
+// nil params render as "null", as with RenderParameters.
+func RenderCanonicalParameters(params interface{}) (string, error) {
+	raw, err := json.Marshal(params)
+	if err != nil {
+		return "", err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var decoded interface{}
+	if err := decoder.Decode(&decoded); err != nil {
+		return "", err
+	}
+
+	// maps are marshaled with their keys sorted
+	canonical, err := json.Marshal(removeNullFields(decoded))
+	if err != nil {
+		return "", err
+	}
+	return string(canonical), nil
+}
+
+// removeNullFields removes fields with null values from objects nested anywhere in value
+func removeNullFields(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for name, child := range v {
+			if child == nil {
+				delete(v, name)
+			} else {
+				v[name] = removeNullFields(child)
+			}
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = removeNullFields(child)
+		}
+	}
+	return value
+}
+
+// VersionedParams returns a RenderParams function that prefixes params rendered by render
+// with version, such as "v2:{"Name":"Bob"}". RenderParameters is used if render is nil.
+// Bump version when the shape of the params changes so entries stored with the old shape
+// are no longer found. Versioned renderers are not registered by name so are not saved in JSON configs.
+func VersionedParams(version string, render func(params interface{}) (string, error)) func(params interface{}) (string, error) {
+	if render == nil {
+		render = RenderParameters
+	}
+	return func(params interface{}) (string, error) {
+		rendered, err := render(params)
+		if err != nil {
+			return "", err
+		}
+		return "v" + version + ":" + rendered, nil
+	}
+}
+
+// RenderQueryStringParameters renders params as a sorted query string such as "Age=42&Name=Bob".
+// This is more readable than JSON in disk paths and database columns.
+// Params must serialize to a JSON object or null. Nested fields are joined with "."
+// and array items are repeated under the same name.
+// nil params render as "", the same as params with no fields, so they share a cache entry.
+func RenderQueryStringParameters(params interface{}) (string, error) {
+	raw, err := json.Marshal(params)
+	if err != nil {
+		return "", err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var decoded interface{}
+	if err := decoder.Decode(&decoded); err != nil {
+		return "", err
+	}
+
+	switch decoded.(type) {
+	case nil:
+		return "", nil
+	case map[string]interface{}:
+	default:
+		return "", errors.New("cachefunk: query string params must be a struct or map")
+	}
+
+	values := make(url.Values)
+	flattenQueryValues(values, "", decoded)
+	// Encode sorts by name, so output is stable regardless of map iteration order
+	return values.Encode(), nil
+}
+
+// ParseQueryStringParameters parses params rendered by RenderQueryStringParameters.
+// Query strings are untyped so all values are returned as strings.
+func ParseQueryStringParameters(rendered string) (url.Values, error) {
+	return url.ParseQuery(rendered)
+}
+
+func flattenQueryValues(values url.Values, name string, value interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for childName, child := range v {
+			if name != "" {
+				childName = name + "." + childName
+			}
+			flattenQueryValues(values, childName, child)
+		}
+	case []interface{}:
+		for _, child := range v {
+			flattenQueryValues(values, name, child)
+		}
+	case nil:
+		values.Add(name, "")
+	case string:
+		values.Add(name, v)
+	case json.Number:
+		values.Add(name, v.String())
+	case bool:
+		values.Add(name, strconv.FormatBool(v))
+	}
+}
@@ -0,0 +1,333 @@
+package cachefunk_test
+
+import (
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rohfle/cachefunk"
+)
+
+func TestRenderQueryStringParameters(t *testing.T) {
+	type Nested struct {
+		Tags  []string
+		Inner struct{ Enabled bool }
+	}
+
+	testCases := []struct {
+		params   interface{}
+		expected string
+	}{
+		{nil, ""},
+		{&HelloWorldParams{"Bob", 42}, "Age=42&Name=Bob"},
+		{map[string]string{"b": "2", "a": "1 & 1"}, "a=1+%26+1&b=2"},
+		{&Nested{Tags: []string{"x", "y"}}, "Inner.Enabled=false&Tags=x&Tags=y"},
+	}
+
+	for line, tc := range testCases {
+		rendered, err := cachefunk.RenderQueryStringParameters(tc.params)
+		if err != nil {
+			t.Errorf("subtest %d: unexpected error: %s", line+1, err)
+		} else if rendered != tc.expected {
+			t.Errorf("subtest %d: expected \"%s\" got \"%s\"", line+1, tc.expected, rendered)
+		}
+	}
+
+	if _, err := cachefunk.RenderQueryStringParameters([]int{1, 2}); err == nil {
+		t.Error("expected error for params that are not a struct or map")
+	}
+	if _, err := cachefunk.RenderQueryStringParameters(func() {}); err == nil {
+		t.Error("expected error for unserializable params")
+	}
+}
+
+func TestQueryStringParametersStableOrder(t *testing.T) {
+	first := map[string]interface{}{}
+	first["zebra"] = 1
+	first["apple"] = "two"
+	first["mango"] = true
+
+	second := map[string]interface{}{}
+	second["mango"] = true
+	second["apple"] = "two"
+	second["zebra"] = 1
+
+	renderedFirst, _ := cachefunk.RenderQueryStringParameters(first)
+	renderedSecond, _ := cachefunk.RenderQueryStringParameters(second)
+	if renderedFirst != renderedSecond {
+		t.Fatalf("expected equal maps to render the same, got \"%s\" and \"%s\"", renderedFirst, renderedSecond)
+	}
+}
+
+func TestQueryStringParametersRoundTrip(t *testing.T) {
+	params := map[string][]string{"name": {"Bob / Clark"}, "ids": {"1", "2"}}
+	rendered, err := cachefunk.RenderQueryStringParameters(params)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	parsed, err := cachefunk.ParseQueryStringParameters(rendered)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if !reflect.DeepEqual(parsed, url.Values(params)) {
+		t.Fatalf("expected %v got %v", params, parsed)
+	}
+}
+
+func TestRenderParamsConfig(t *testing.T) {
+	cache := cachefunk.NewInMemoryCache()
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 5, RenderParams: cachefunk.RenderQueryStringParameters},
+		},
+	})
+
+	helloCounter := 0
+	hello := func(ignoreCache bool, params *HelloWorldParams) (string, error) {
+		helloCounter += 1
+		return "Hello " + params.Name, nil
+	}
+	Hello := cachefunk.WrapString(cache, "hello", hello)
+
+	Hello(false, &HelloWorldParams{"Bob", 42})
+	Hello(false, &HelloWorldParams{"Bob", 42})
+	if helloCounter != 1 {
+		t.Fatalf("expected helloCounter to be 1 got %d", helloCounter)
+	}
+	if _, found := cache.Store["hello:Age=42&Name=Bob"]; !found {
+		t.Fatal("expected entry to be stored under query string params")
+	}
+}
+
+func TestRenderHashedParameters(t *testing.T) {
+	long := &HelloWorldParams{Name: strings.Repeat("Bob", 10000), Age: 42}
+	rendered, err := cachefunk.RenderHashedParameters(long)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(rendered) != 64 {
+		t.Fatalf("expected rendered params of length %d got %d", 64, len(rendered))
+	}
+
+	seen := make(map[string]int64)
+	for age := int64(0); age < 1000; age++ {
+		rendered, err := cachefunk.RenderHashedParameters(&HelloWorldParams{"Bob", age})
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if other, exists := seen[rendered]; exists {
+			t.Fatalf("params with age %d and %d rendered the same", other, age)
+		}
+		seen[rendered] = age
+	}
+
+	again, _ := cachefunk.RenderHashedParameters(long)
+	if again != rendered {
+		t.Fatal("expected rendering the same params to be stable")
+	}
+
+	if _, err := cachefunk.RenderHashedParameters(func() {}); err == nil {
+		t.Error("expected error for unserializable params")
+	}
+}
+
+func TestRenderCanonicalParameters(t *testing.T) {
+	type Reordered struct {
+		Age  int64
+		Name string
+	}
+	type Optional struct {
+		Name  string
+		Age   int64
+		Email *string `json:",omitempty"`
+	}
+	type Nullable struct {
+		Name  string
+		Age   int64
+		Email *string
+	}
+
+	expected := `{"Age":42,"Name":"Bob"}`
+	testCases := []interface{}{
+		&HelloWorldParams{"Bob", 42},
+		HelloWorldParams{"Bob", 42},
+		&Reordered{42, "Bob"},
+		map[string]interface{}{"Name": "Bob", "Age": 42},
+		&Optional{Name: "Bob", Age: 42},
+		&Nullable{Name: "Bob", Age: 42},
+	}
+
+	for line, params := range testCases {
+		rendered, err := cachefunk.RenderCanonicalParameters(params)
+		if err != nil {
+			t.Errorf("subtest %d: unexpected error: %s", line+1, err)
+		} else if rendered != expected {
+			t.Errorf("subtest %d: expected \"%s\" got \"%s\"", line+1, expected, rendered)
+		}
+	}
+
+	nested, _ := cachefunk.RenderCanonicalParameters([]interface{}{map[string]interface{}{"b": nil, "a": 1.5}})
+	if nested != `[{"a":1.5}]` {
+		t.Errorf("expected nested objects to be canonical got \"%s\"", nested)
+	}
+
+	if _, err := cachefunk.RenderCanonicalParameters(func() {}); err == nil {
+		t.Error("expected error for unserializable params")
+	}
+}
+
+func TestVersionedParams(t *testing.T) {
+	params := &HelloWorldParams{"Bob", 42}
+
+	testCases := []struct {
+		render   func(params interface{}) (string, error)
+		expected string
+	}{
+		{cachefunk.VersionedParams("1", nil), `v1:{"Name":"Bob","Age":42}`},
+		{cachefunk.VersionedParams("2", nil), `v2:{"Name":"Bob","Age":42}`},
+		{cachefunk.VersionedParams("2", cachefunk.RenderQueryStringParameters), "v2:Age=42&Name=Bob"},
+	}
+
+	for line, tc := range testCases {
+		rendered, err := tc.render(params)
+		if err != nil {
+			t.Errorf("subtest %d: unexpected error: %s", line+1, err)
+		} else if rendered != tc.expected {
+			t.Errorf("subtest %d: expected \"%s\" got \"%s\"", line+1, tc.expected, rendered)
+		}
+	}
+
+	// bumping the version makes entries stored under the old version a miss
+	cache := cachefunk.NewInMemoryCache()
+	config := &cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 60, RenderParams: cachefunk.VersionedParams("1", nil)},
+		},
+	}
+	cache.SetConfig(config)
+	cachefunk.Warm(cache, "hello", params, "old shape")
+	config.Set("hello", &cachefunk.KeyConfig{TTL: 60, RenderParams: cachefunk.VersionedParams("2", nil)})
+	if found, _ := cachefunk.Has(cache, "hello", params); found {
+		t.Error("expected entry stored under the old version to be a miss")
+	}
+
+	if _, err := cachefunk.VersionedParams("1", nil)(func() {}); err == nil {
+		t.Error("expected error for unserializable params")
+	}
+}
+
+func TestRenderNilParameters(t *testing.T) {
+	nullHash, _ := cachefunk.RenderHashedParameters(json.RawMessage("null"))
+
+	testCases := []struct {
+		render   func(params interface{}) (string, error)
+		expected string
+	}{
+		{cachefunk.RenderParameters, "null"},
+		{cachefunk.RenderQueryStringParameters, ""},
+		{cachefunk.RenderHashedParameters, nullHash},
+		{cachefunk.RenderCanonicalParameters, "null"},
+	}
+
+	for line, tc := range testCases {
+		for _, params := range []interface{}{nil, (*HelloWorldParams)(nil), map[string]string(nil)} {
+			rendered, err := tc.render(params)
+			if err != nil {
+				t.Errorf("subtest %d: unexpected error for %#v: %s", line+1, params, err)
+			} else if rendered != tc.expected {
+				t.Errorf("subtest %d: expected \"%s\" for %#v got \"%s\"", line+1, tc.expected, params, rendered)
+			}
+		}
+
+		cache := cachefunk.NewInMemoryCache()
+		cache.SetConfig(&cachefunk.CacheFunkConfig{
+			Configs: map[string]*cachefunk.KeyConfig{
+				"hello": {TTL: 60, RenderParams: tc.render},
+			},
+		})
+		calls := 0
+		hello := cachefunk.WrapString(cache, "hello", func(ignoreCache bool, params *HelloWorldParams) (string, error) {
+			calls += 1
+			return "hello", nil
+		})
+		for i := 0; i < 2; i++ {
+			if value, err := hello(false, nil); err != nil || value != "hello" {
+				t.Errorf("subtest %d: expected \"hello\" got \"%s\" (err %v)", line+1, value, err)
+			}
+		}
+		if calls != 1 {
+			t.Errorf("subtest %d: expected nil params to be cached got %d calls", line+1, calls)
+		}
+	}
+}
+
+func TestWrapMapAndSliceParams(t *testing.T) {
+	cache := cachefunk.NewInMemoryCache()
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"sum":  {TTL: 60},
+			"join": {TTL: 60},
+		},
+	})
+
+	sumCalls := 0
+	sum := cachefunk.WrapObject(cache, "sum", func(ignoreCache bool, params map[string]int) (int, error) {
+		sumCalls += 1
+		total := 0
+		for _, value := range params {
+			total += value
+		}
+		return total, nil
+	})
+	joinCalls := 0
+	join := cachefunk.WrapObject(cache, "join", func(ignoreCache bool, params []string) (string, error) {
+		joinCalls += 1
+		return strings.Join(params, ","), nil
+	})
+
+	first := map[string]int{}
+	first["b"] = 2
+	first["a"] = 1
+	second := map[string]int{}
+	second["a"] = 1
+	second["b"] = 2
+
+	sumCases := []struct {
+		params   map[string]int
+		expected int
+		calls    int
+	}{
+		{first, 3, 1},
+		{second, 3, 1},
+		{map[string]int{"a": 1, "b": 3}, 4, 2},
+		{map[string]int{"a": 1}, 1, 3},
+		{map[string]int{"a": 1}, 1, 3},
+	}
+	for line, tc := range sumCases {
+		result, err := sum(false, tc.params)
+		if err != nil || result != tc.expected || sumCalls != tc.calls {
+			t.Errorf("subtest %d: expected %d after %d calls got %d after %d calls %v", line+1, tc.expected, tc.calls, result, sumCalls, err)
+		}
+	}
+
+	joinCases := []struct {
+		params   []string
+		expected string
+		calls    int
+	}{
+		{[]string{"x", "y"}, "x,y", 1},
+		{[]string{"x", "y"}, "x,y", 1},
+		{[]string{"y", "x"}, "y,x", 2},
+		{[]string{}, "", 3},
+		{nil, "", 4},
+		{nil, "", 4},
+	}
+	for line, tc := range joinCases {
+		result, err := join(false, tc.params)
+		if err != nil || result != tc.expected || joinCalls != tc.calls {
+			t.Errorf("subtest %d: expected %q after %d calls got %q after %d calls %v", line+1, tc.expected, tc.calls, result, joinCalls, err)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package cachefunk
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ReadMostlyCache is an in-memory cache for workloads that read far more than they write
+// Entries are kept in an immutable map that is swapped atomically, so reads never lock.
+// Each write copies the whole map, so writes get slower as the cache grows.
+// Unlike InMemoryCache, it is safe for concurrent use.
+type ReadMostlyCache struct {
+	CacheConfig       *CacheFunkConfig
+	configMutex       sync.RWMutex
+	store             atomic.Pointer[map[string]*InMemoryCacheEntry]
+	writeMutex        sync.Mutex
+	IgnoreCacheCtxKey interface{}
+}
+
+func NewReadMostlyCache() *ReadMostlyCache {
+	cache := ReadMostlyCache{
+		IgnoreCacheCtxKey: DEFAULT_IGNORE_CACHE_CTX_KEY,
+	}
+	cache.store.Store(&map[string]*InMemoryCacheEntry{})
+	return &cache
+}
+
+// SetConfig swaps the config used by the cache, which is safe to do while the cache is in use
+func (c *ReadMostlyCache) SetConfig(config *CacheFunkConfig) {
+	c.configMutex.Lock()
+	defer c.configMutex.Unlock()
+	config.resetMerged()
+	c.CacheConfig = config
+}
+
+func (c *ReadMostlyCache) GetConfig() *CacheFunkConfig {
+	c.configMutex.RLock()
+	defer c.configMutex.RUnlock()
+	return c.CacheConfig
+}
+
+func (c *ReadMostlyCache) GetIgnoreCacheCtxKey() interface{} {
+	return c.IgnoreCacheCtxKey
+}
+
+// Snapshot returns the current entries, keyed by key and params joined with ":"
+// The map and its entries are shared with the cache and must not be modified
+func (c *ReadMostlyCache) Snapshot() map[string]*InMemoryCacheEntry {
+	return *c.store.Load()
+}
+
+// update replaces the entries with a modified copy
+// modify is called with a copy of the current entries while other writers are locked out
+func (c *ReadMostlyCache) update(modify func(store map[string]*InMemoryCacheEntry)) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	current := c.Snapshot()
+	store := make(map[string]*InMemoryCacheEntry, len(current)+1)
+	for fullKey, value := range current {
+		store[fullKey] = value
+	}
+	modify(store)
+	c.store.Store(&store)
+}
+
+func (c *ReadMostlyCache) Get(key string, params string) ([]byte, bool) {
+	value, _, found := c.GetWithInfo(key, params)
+	return value, found
+}
+
+// GetWithInfo gets a value without locking
+// Expired entries are reported as not found but are left for Cleanup to delete
+func (c *ReadMostlyCache) GetWithInfo(key string, params string) ([]byte, EntryInfo, bool) {
+	value, found := c.Snapshot()[DefaultKeyFunc(key, params)]
+	if !found {
+		return nil, EntryInfo{}, false
+	}
+	info := value.info()
+	// check if cached value has expired
+	config := c.GetConfig().Get(key)
+	if value.Timestamp.Before(config.GetExpireTime(c.GetConfig().Now())) {
+		c.GetConfig().notifyExpired(key)
+		return nil, info, false
+	}
+
+	data, ok := value.decode(c.GetConfig(), key, config)
+	if !ok {
+		c.Delete(key, params)
+		return nil, EntryInfo{}, false
+	}
+	info.HitCount = value.hit()
+	return data, info, true
+}
+
+// GetMany will get many cache values for a key from a single snapshot
+func (c *ReadMostlyCache) GetMany(key string, paramsList []string) map[string][]byte {
+	store := c.Snapshot()
+	config := c.GetConfig().Get(key)
+	cutoff := config.GetExpireTime(c.GetConfig().Now())
+	values := make(map[string][]byte, len(paramsList))
+	for _, params := range paramsList {
+		value, found := store[DefaultKeyFunc(key, params)]
+		if !found {
+			continue
+		}
+		if value.Timestamp.Before(cutoff) {
+			c.GetConfig().notifyExpired(key)
+			continue
+		}
+		if data, ok := value.decode(c.GetConfig(), key, config); ok {
+			value.hit()
+			values[params] = data
+		}
+	}
+	return values
+}
+
+func (c *ReadMostlyCache) Set(key string, params string, value []byte) {
+	c.SetMany(key, map[string][]byte{params: value})
+}
+
+// SetMany will set many cache values for a key with a single copy of the entries
+func (c *ReadMostlyCache) SetMany(key string, values map[string][]byte) {
+	config := c.GetConfig().Get(key)
+	if config.IsImmediateExpire() || len(values) == 0 {
+		return // immediately discard the entries
+	}
+
+	timestamp := c.GetConfig().GetTimestamp(config)
+	now := c.GetConfig().Now()
+
+	type compressedValue struct {
+		value        []byte
+		isCompressed bool
+	}
+	compressed := make(map[string]compressedValue, len(values))
+	for params, value := range values {
+		value, isCompressed, err := c.GetConfig().compressValue(key, config, value)
+		if err != nil {
+			c.GetConfig().notifySetError(key, err)
+			continue
+		}
+		compressed[params] = compressedValue{value, isCompressed}
+	}
+
+	c.update(func(store map[string]*InMemoryCacheEntry) {
+		for params, value := range compressed {
+			fullKey := DefaultKeyFunc(key, params)
+			store[fullKey] = newInMemoryCacheEntry(key, params, value.value, timestamp, value.isCompressed, now, store[fullKey])
+		}
+	})
+}
+
+func (c *ReadMostlyCache) SetRaw(key string, params string, value []byte, timestamp time.Time, isCompressed bool) {
+	now := c.GetConfig().Now()
+	c.update(func(store map[string]*InMemoryCacheEntry) {
+		fullKey := DefaultKeyFunc(key, params)
+		store[fullKey] = newInMemoryCacheEntry(key, params, value, timestamp, isCompressed, now, store[fullKey])
+	})
+}
+
+func (c *ReadMostlyCache) Clear() {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	c.store.Store(&map[string]*InMemoryCacheEntry{})
+}
+
+func (c *ReadMostlyCache) ClearKey(key string) {
+	c.update(func(store map[string]*InMemoryCacheEntry) {
+		for fullKey, value := range store {
+			if value.Key == key {
+				delete(store, fullKey)
+			}
+		}
+	})
+}
+
+func (c *ReadMostlyCache) Delete(key string, params string) {
+	c.update(func(store map[string]*InMemoryCacheEntry) {
+		delete(store, DefaultKeyFunc(key, params))
+	})
+}
+
+func (c *ReadMostlyCache) Cleanup() {
+	c.CleanupWithResult()
+}
+
+// CleanupWithResult deletes expired entries for every key with a single copy of the entries
+func (c *ReadMostlyCache) CleanupWithResult() CleanupResult {
+	var result CleanupResult
+	now := c.GetConfig().Now()
+	configs := c.GetConfig().KeyConfigs()
+	c.update(func(store map[string]*InMemoryCacheEntry) {
+		for fullKey, value := range store {
+			config, exists := configs[value.Key]
+			if exists && value.Timestamp.Before(config.GetExpireTime(now)) {
+				delete(store, fullKey)
+				result.Removed += 1
+			}
+		}
+	})
+	return result
+}
+
+func (c *ReadMostlyCache) KeyEntries(key string) []EntryInfo {
+	var entries []EntryInfo
+	for _, value := range c.Snapshot() {
+		if value.Key == key {
+			entries = append(entries, value.info())
+		}
+	}
+	return entries
+}
+
+// Iterate visits a snapshot of the store
+func (c *ReadMostlyCache) Iterate(fn func(key string, params string, timestamp time.Time) bool) error {
+	for _, value := range c.Snapshot() {
+		if !fn(value.Key, value.Params, value.Timestamp) {
+			break
+		}
+	}
+	return nil
+}
+
+func (c *ReadMostlyCache) EntryCount() int64 {
+	return int64(len(c.Snapshot()))
+}
+
+func (c *ReadMostlyCache) ExpiredEntryCount() int64 {
+	var count int64
+	store := c.Snapshot()
+	now := c.GetConfig().Now()
+	configs := c.GetConfig().KeyConfigs()
+	for _, value := range store {
+		config, exists := configs[value.Key]
+		if exists && value.Timestamp.Before(config.GetExpireTime(now)) {
+			count += 1
+		}
+	}
+	return count
+}
+
+// Close does nothing as ReadMostlyCache holds no resources
+func (c *ReadMostlyCache) Close() error {
+	return nil
+}
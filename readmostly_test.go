@@ -0,0 +1,164 @@
+package cachefunk_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rohfle/cachefunk"
+)
+
+func TestReadMostlyCache(t *testing.T) {
+	cache := cachefunk.NewReadMostlyCache()
+
+	runTestWrapString(t, cache)
+	cache.Clear()
+	runTestWrapStringWithContext(t, cache)
+	cache.Clear()
+	runTestWrapObject(t, cache)
+	cache.Clear()
+	runTestWrapObjectWithContext(t, cache)
+	cache.Clear()
+	runTestCacheFuncErrorsReturned(t, cache)
+	cache.Clear()
+	runTestCacheFuncWithContextErrorsReturned(t, cache)
+	cache.Clear()
+	runTestCacheObjectMany(t, cache)
+	cache.Clear()
+	runTestSetMany(t, cache)
+	cache.Clear()
+	runTestWarm(t, cache)
+	cache.Clear()
+	runTestCacheObjectAs(t, cache)
+	cache.Clear()
+	runTestGetOrSet(t, cache)
+	cache.Clear()
+	runTestKeyEntries(t, cache)
+	cache.Clear()
+	runTestMaxDecompressedSize(t, cache)
+	cache.Clear()
+	runTestMaxValueBytes(t, cache)
+	cache.Clear()
+	runTestHas(t, cache)
+	cache.Clear()
+	runTestAdaptiveCompression(t, cache)
+	cache.Clear()
+	runTestMustGet(t, cache)
+	cache.Clear()
+	runTestCacheObjectWithMeta(t, cache)
+	cache.Clear()
+	runTestCacheMode(t, cache)
+	cache.Clear()
+	runTestCompressionContext(t, cache)
+	cache.Clear()
+	runTestWrapMeta(t, cache)
+	cache.Clear()
+	runTestIterate(t, cache)
+	cache.Clear()
+	runTestCacheWithTTL(t, cache)
+	cache.Clear()
+	runTestPoisonedEntries(t, cache)
+	cache.Clear()
+	runTestInvalidatePrefix(t, cache)
+	cache.Clear()
+	runTestCleanupBatch(t, cache)
+	cache.Clear()
+	runTestForceCleanup(t, cache)
+	cache.Clear()
+	runTestHitCount(t, cache)
+	cache.Clear()
+	expireAllEntries := func() {
+		for _, value := range cache.Snapshot() {
+			value.Timestamp = time.Time{}
+		}
+	}
+	runTestCacheFuncTTL(t, cache, expireAllEntries)
+}
+
+func TestReadMostlyCacheConcurrentUse(t *testing.T) {
+	cache := cachefunk.NewReadMostlyCache()
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 60},
+		},
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				cache.Set("hello", fmt.Sprint(i, j), []byte("world"))
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				cache.Get("hello", fmt.Sprint(i, j))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if count := cache.EntryCount(); count != 200 {
+		t.Errorf("expected %d entries got %d", 200, count)
+	}
+}
+
+func benchmarkCacheGet(b *testing.B, cache cachefunk.Cache) {
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 3600},
+		},
+	})
+	for i := 0; i < 1000; i++ {
+		cache.Set("hello", fmt.Sprint(i), []byte("world"))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cache.Get("hello", fmt.Sprint(i%1000))
+	}
+}
+
+func BenchmarkInMemoryCacheGet(b *testing.B) {
+	benchmarkCacheGet(b, cachefunk.NewInMemoryCache())
+}
+
+func BenchmarkReadMostlyCacheGet(b *testing.B) {
+	benchmarkCacheGet(b, cachefunk.NewReadMostlyCache())
+}
+
+// InMemoryCache is not safe for concurrent use so only ReadMostlyCache has a parallel benchmark
+func BenchmarkReadMostlyCacheGetParallel(b *testing.B) {
+	cache := cachefunk.NewReadMostlyCache()
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 3600},
+		},
+	})
+	for i := 0; i < 1000; i++ {
+		cache.Set("hello", fmt.Sprint(i), []byte("world"))
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			cache.Get("hello", fmt.Sprint(i%1000))
+			i++
+		}
+	})
+}
+
+func BenchmarkReadMostlyCacheSet(b *testing.B) {
+	cache := cachefunk.NewReadMostlyCache()
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 3600},
+		},
+	})
+	for i := 0; i < b.N; i++ {
+		cache.Set("hello", fmt.Sprint(i%1000), []byte("world"))
+	}
+}
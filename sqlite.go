@@ -0,0 +1,420 @@
+package cachefunk
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// SQLiteCache stores entries in SQLite using database/sql rather than GORM
+// Open db with any SQLite driver, such as modernc.org/sqlite for builds without cgo.
+// Entries are stored like GORMCache, unique by key and params, with timestamps
+// stored as unix nanoseconds.
+type SQLiteCache struct {
+	CacheConfig       *CacheFunkConfig
+	configMutex       sync.RWMutex
+	DB                *sql.DB
+	IgnoreCacheCtxKey interface{}
+	// TableName is the table entries are stored in, DEFAULT_SQLITE_TABLE_NAME if empty
+	// It must not be changed after the cache is created, see WithSQLiteTableName
+	TableName string
+}
+
+// DEFAULT_SQLITE_TABLE_NAME is the table SQLiteCache stores entries in by default
+// It differs from the CacheEntry table of GORMCache, which stores timestamps in another format,
+// so both caches can use the same database
+const DEFAULT_SQLITE_TABLE_NAME = "cachefunk_sqlite_entries"
+
+// SQLiteCacheOption configures a SQLiteCache created by NewSQLiteCache
+type SQLiteCacheOption func(*SQLiteCache)
+
+// WithSQLiteTableName stores entries in the table name instead of DEFAULT_SQLITE_TABLE_NAME
+// Use it to avoid collisions with an application's schema, or to keep several caches in one database
+func WithSQLiteTableName(name string) SQLiteCacheOption {
+	return func(c *SQLiteCache) {
+		c.TableName = name
+	}
+}
+
+// NewSQLiteCache creates the entries table and its indexes in db if they do not exist
+func NewSQLiteCache(db *sql.DB, options ...SQLiteCacheOption) (*SQLiteCache, error) {
+	cache := SQLiteCache{
+		DB:                db,
+		IgnoreCacheCtxKey: DEFAULT_IGNORE_CACHE_CTX_KEY,
+	}
+	for _, option := range options {
+		option(&cache)
+	}
+	if _, err := db.Exec(cache.schema()); err != nil {
+		return nil, err
+	}
+	return &cache, nil
+}
+
+// table returns the quoted name of the table entries are stored in
+func (c *SQLiteCache) table() string {
+	return quoteSQLiteIdentifier(c.tableName())
+}
+
+func (c *SQLiteCache) tableName() string {
+	if c.TableName == "" {
+		return DEFAULT_SQLITE_TABLE_NAME
+	}
+	return c.TableName
+}
+
+// quoteSQLiteIdentifier quotes name for use as a table or index name
+func quoteSQLiteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// schema returns the statements creating the entries table and its indexes, which are named after the table
+func (c *SQLiteCache) schema() string {
+	return `
+CREATE TABLE IF NOT EXISTS ` + c.table() + ` (
+	id INTEGER PRIMARY KEY,
+	timestamp INTEGER NOT NULL,
+	key TEXT NOT NULL,
+	params TEXT NOT NULL,
+	is_compressed BOOLEAN NOT NULL DEFAULT false,
+	data BLOB NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS ` + quoteSQLiteIdentifier("idx_"+c.tableName()+"_key_params") + ` ON ` + c.table() + ` (key, params);
+CREATE INDEX IF NOT EXISTS ` + quoteSQLiteIdentifier("idx_"+c.tableName()+"_key_timestamp") + ` ON ` + c.table() + ` (key, timestamp);
+`
+}
+
+// upsert returns the statement storing an entry, replacing any entry with the same key and params
+func (c *SQLiteCache) upsert() string {
+	return `INSERT INTO ` + c.table() + ` (key, params, timestamp, is_compressed, data) VALUES (?, ?, ?, ?, ?)
+ON CONFLICT (key, params) DO UPDATE SET timestamp = excluded.timestamp, is_compressed = excluded.is_compressed, data = excluded.data`
+}
+
+// SetConfig swaps the config used by the cache, which is safe to do while the cache is in use
+func (c *SQLiteCache) SetConfig(config *CacheFunkConfig) {
+	c.configMutex.Lock()
+	defer c.configMutex.Unlock()
+	config.resetMerged()
+	c.CacheConfig = config
+}
+
+func (c *SQLiteCache) GetConfig() *CacheFunkConfig {
+	c.configMutex.RLock()
+	defer c.configMutex.RUnlock()
+	return c.CacheConfig
+}
+
+func (c *SQLiteCache) GetIgnoreCacheCtxKey() interface{} {
+	return c.IgnoreCacheCtxKey
+}
+
+func (c *SQLiteCache) Get(key string, params string) ([]byte, bool) {
+	value, _, found := c.GetWithInfo(key, params)
+	return value, found
+}
+
+func (c *SQLiteCache) GetWithInfo(key string, params string) ([]byte, EntryInfo, bool) {
+	return c.GetWithInfoContext(context.Background(), key, params)
+}
+
+// GetWithInfoContext is GetWithInfo with queries aborted when ctx is done
+func (c *SQLiteCache) GetWithInfoContext(ctx context.Context, key string, params string) ([]byte, EntryInfo, bool) {
+	var id, timestamp int64
+	var isCompressed bool
+	var data []byte
+	err := c.DB.QueryRowContext(ctx,
+		"SELECT id, timestamp, is_compressed, data FROM "+c.table()+" WHERE key = ? AND params = ?",
+		key, params,
+	).Scan(&id, &timestamp, &isCompressed, &data)
+	if err != nil {
+		return nil, EntryInfo{}, false
+	}
+	info := EntryInfo{
+		Params:       params,
+		Timestamp:    time.Unix(0, timestamp).UTC(),
+		Size:         int64(len(data)),
+		IsCompressed: isCompressed,
+	}
+	// if entry has expired, delete and return not found
+	config := c.GetConfig().Get(key)
+	if info.Timestamp.Before(config.GetExpireTime(c.GetConfig().Now())) {
+		c.DB.ExecContext(ctx, "DELETE FROM "+c.table()+" WHERE id = ?", id)
+		c.GetConfig().notifyExpired(key)
+		return nil, info, false
+	}
+
+	value, ok := decodeSQLiteValue(c.GetConfig(), key, data, isCompressed, config)
+	if !ok {
+		c.DB.ExecContext(ctx, "DELETE FROM "+c.table()+" WHERE id = ?", id)
+		return nil, EntryInfo{}, false
+	}
+	return value, info, true
+}
+
+// decodeSQLiteValue returns the value stored in data, decompressing it if needed
+// ErrUnknownEntryVersion is reported to the Observer of cfg when data has an unknown format version
+func decodeSQLiteValue(cfg *CacheFunkConfig, key string, data []byte, isCompressed bool, config *KeyConfig) ([]byte, bool) {
+	value, err := decodeEntry(data)
+	if err != nil {
+		cfg.notifyGetError(key, err)
+		return nil, false
+	}
+	if isCompressed {
+		value, err = decompressBytes(value, config.MaxDecompressedSize)
+		if err != nil {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// GetMany will get many cache values for a key using a query per GET_MANY_BATCH_SIZE params
+// Queries that fail are reported to the Observer and their params treated as misses
+func (c *SQLiteCache) GetMany(key string, paramsList []string) map[string][]byte {
+	values := make(map[string][]byte, len(paramsList))
+	var expiredIDs []int64
+	for _, batch := range batches(paramsList, GET_MANY_BATCH_SIZE) {
+		batchExpiredIDs, err := c.getManyBatch(key, batch, values)
+		if err != nil {
+			c.GetConfig().notifyGetError(key, err)
+		}
+		expiredIDs = append(expiredIDs, batchExpiredIDs...)
+	}
+
+	for _, id := range expiredIDs {
+		c.DB.Exec("DELETE FROM "+c.table()+" WHERE id = ?", id)
+	}
+	return values
+}
+
+// getManyBatch adds the unexpired values for key and paramsList to values with a single query,
+// returning the IDs of expired entries to delete
+func (c *SQLiteCache) getManyBatch(key string, paramsList []string, values map[string][]byte) ([]int64, error) {
+	args := make([]interface{}, 0, len(paramsList)+1)
+	args = append(args, key)
+	for _, params := range paramsList {
+		args = append(args, params)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(paramsList)), ", ")
+	rows, err := c.DB.Query(
+		"SELECT id, params, timestamp, is_compressed, data FROM "+c.table()+" WHERE key = ? AND params IN ("+placeholders+")",
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	config := c.GetConfig().Get(key)
+	cutoff := config.GetExpireTime(c.GetConfig().Now())
+	var expiredIDs []int64
+	for rows.Next() {
+		var id, timestamp int64
+		var params string
+		var isCompressed bool
+		var data []byte
+		if err := rows.Scan(&id, &params, &timestamp, &isCompressed, &data); err != nil {
+			continue
+		}
+		// if entry has expired, mark for deletion and skip
+		if time.Unix(0, timestamp).Before(cutoff) {
+			expiredIDs = append(expiredIDs, id)
+			c.GetConfig().notifyExpired(key)
+			continue
+		}
+		if value, ok := decodeSQLiteValue(c.GetConfig(), key, data, isCompressed, config); ok {
+			values[params] = value
+		}
+	}
+	return expiredIDs, rows.Err()
+}
+
+// Set will set a cache value by its key and params
+func (c *SQLiteCache) Set(key string, params string, value []byte) {
+	c.SetContext(context.Background(), key, params, value)
+}
+
+// SetContext is Set with the query aborted when ctx is done
+func (c *SQLiteCache) SetContext(ctx context.Context, key string, params string, value []byte) {
+	config := c.GetConfig().Get(key)
+	if config.IsImmediateExpire() {
+		return // immediately discard the entry
+	}
+
+	timestamp := c.GetConfig().GetTimestamp(config)
+
+	value, isCompressed, err := c.GetConfig().compressValue(key, config, value)
+	if err != nil {
+		c.GetConfig().notifySetError(key, err)
+		return
+	}
+
+	c.SetRawContext(ctx, key, params, value, timestamp, isCompressed)
+}
+
+// SetMany will set many cache values for a key in a single transaction
+func (c *SQLiteCache) SetMany(key string, values map[string][]byte) {
+	config := c.GetConfig().Get(key)
+	if config.IsImmediateExpire() || len(values) == 0 {
+		return // immediately discard the entries
+	}
+
+	timestamp := c.GetConfig().GetTimestamp(config)
+
+	tx, err := c.DB.Begin()
+	if err != nil {
+		return
+	}
+	for params, value := range values {
+		value, isCompressed, err := c.GetConfig().compressValue(key, config, value)
+		if err != nil {
+			c.GetConfig().notifySetError(key, err)
+			continue
+		}
+		if _, err := tx.Exec(c.upsert(), key, params, timestamp.UnixNano(), isCompressed, encodeEntry(value)); err != nil {
+			tx.Rollback()
+			return
+		}
+	}
+	tx.Commit()
+}
+
+// SetRaw will set a cache value by its key and params
+func (c *SQLiteCache) SetRaw(key string, params string, value []byte, timestamp time.Time, isCompressed bool) {
+	c.SetRawContext(context.Background(), key, params, value, timestamp, isCompressed)
+}
+
+// SetRawContext is SetRaw with the query aborted when ctx is done
+func (c *SQLiteCache) SetRawContext(ctx context.Context, key string, params string, value []byte, timestamp time.Time, isCompressed bool) {
+	c.DB.ExecContext(ctx, c.upsert(), key, params, timestamp.UnixNano(), isCompressed, encodeEntry(value))
+}
+
+// Clear will delete all cache entries
+func (c *SQLiteCache) Clear() {
+	c.DB.Exec("DELETE FROM " + c.table())
+}
+
+// ClearKey will delete all cache entries for key
+func (c *SQLiteCache) ClearKey(key string) {
+	c.DB.Exec("DELETE FROM "+c.table()+" WHERE key = ?", key)
+}
+
+// ClearPrefix will delete all cache entries for keys starting with prefix
+// LIKE is case insensitive in SQLite, so substr checks the exact prefix
+func (c *SQLiteCache) ClearPrefix(prefix string) error {
+	_, err := c.DB.Exec(`DELETE FROM `+c.table()+` WHERE key LIKE ? ESCAPE '\' AND substr(key, 1, ?) = ?`,
+		escapeLike(prefix)+"%", utf8.RuneCountInString(prefix), prefix)
+	return err
+}
+
+// Delete will delete the cache entry for key and params
+func (c *SQLiteCache) Delete(key string, params string) {
+	c.DB.Exec("DELETE FROM "+c.table()+" WHERE key = ? AND params = ?", key, params)
+}
+
+// Cleanup will delete all cache entries that have expired
+func (c *SQLiteCache) Cleanup() {
+	c.CleanupWithResult()
+}
+
+func (c *SQLiteCache) CleanupWithResult() CleanupResult {
+	var result CleanupResult
+	now := c.GetConfig().Now()
+	for key, config := range c.GetConfig().KeyConfigs() {
+		cutoff := config.GetExpireTime(now)
+		deleted, err := c.DB.Exec("DELETE FROM "+c.table()+" WHERE key = ? AND timestamp < ?", key, cutoff.UnixNano())
+		if err != nil {
+			result.Errors = append(result.Errors, err)
+			continue
+		}
+		if removed, err := deleted.RowsAffected(); err == nil {
+			result.Removed += removed
+		}
+	}
+	return result
+}
+
+// ForceCleanup deletes the entries of key stored more than maxAge ago, see the ForceCleanup function
+func (c *SQLiteCache) ForceCleanup(key string, maxAge time.Duration) CleanupResult {
+	var result CleanupResult
+	cutoff := forceCleanupCutoff(c, maxAge)
+	deleted, err := c.DB.Exec("DELETE FROM "+c.table()+" WHERE key = ? AND timestamp < ?", key, cutoff.UnixNano())
+	if err != nil {
+		result.Errors = append(result.Errors, err)
+		return result
+	}
+	if removed, err := deleted.RowsAffected(); err == nil {
+		result.Removed = removed
+	}
+	return result
+}
+
+func (c *SQLiteCache) KeyEntries(key string) []EntryInfo {
+	var entries []EntryInfo
+	rows, err := c.DB.Query(
+		"SELECT params, timestamp, length(data), is_compressed FROM "+c.table()+" WHERE key = ?",
+		key,
+	)
+	if err != nil {
+		return entries
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var entry EntryInfo
+		var timestamp int64
+		if err := rows.Scan(&entry.Params, &timestamp, &entry.Size, &entry.IsCompressed); err != nil {
+			continue
+		}
+		entry.Timestamp = time.Unix(0, timestamp).UTC()
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func (c *SQLiteCache) Iterate(fn func(key string, params string, timestamp time.Time) bool) error {
+	rows, err := c.DB.Query("SELECT key, params, timestamp FROM " + c.table())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key, params string
+		var timestamp int64
+		if err := rows.Scan(&key, &params, &timestamp); err != nil {
+			return err
+		}
+		if !fn(key, params, time.Unix(0, timestamp).UTC()) {
+			break
+		}
+	}
+	return rows.Err()
+}
+
+func (c *SQLiteCache) EntryCount() int64 {
+	var count int64
+	c.DB.QueryRow("SELECT count(*) FROM " + c.table()).Scan(&count)
+	return count
+}
+
+func (c *SQLiteCache) ExpiredEntryCount() int64 {
+	var count int64
+	now := c.GetConfig().Now()
+	for key, config := range c.GetConfig().KeyConfigs() {
+		cutoff := config.GetExpireTime(now)
+		var keyCount int64
+		c.DB.QueryRow(
+			"SELECT count(*) FROM "+c.table()+" WHERE key = ? AND timestamp < ?",
+			key, cutoff.UnixNano(),
+		).Scan(&keyCount)
+		count += keyCount
+	}
+	return count
+}
+
+// Close closes DB, which must not be used afterwards
+func (c *SQLiteCache) Close() error {
+	return c.DB.Close()
+}
@@ -0,0 +1,204 @@
+package cachefunk_test
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/rohfle/cachefunk"
+
+	// registers the sqlite3 database/sql driver used by the GORM tests, so SQLiteCache
+	// adds no SQLite driver to the module requirements
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestSQLiteCache(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal("failed to connect database")
+	}
+	defer db.Close()
+	// each connection to :memory: is a separate database
+	db.SetMaxOpenConns(1)
+
+	cache, err := cachefunk.NewSQLiteCache(db)
+	if err != nil {
+		t.Fatal("failed to create cache:", err)
+	}
+
+	runTestWrapString(t, cache)
+	cache.Clear()
+	runTestWrapStringWithContext(t, cache)
+	cache.Clear()
+	runTestWrapObject(t, cache)
+	cache.Clear()
+	runTestWrapObjectWithContext(t, cache)
+	cache.Clear()
+	runTestCacheFuncErrorsReturned(t, cache)
+	cache.Clear()
+	runTestCacheFuncWithContextErrorsReturned(t, cache)
+	cache.Clear()
+	runTestCacheObjectMany(t, cache)
+	cache.Clear()
+	runTestSetMany(t, cache)
+	cache.Clear()
+	runTestWarm(t, cache)
+	cache.Clear()
+	runTestCacheObjectAs(t, cache)
+	cache.Clear()
+	runTestGetOrSet(t, cache)
+	cache.Clear()
+	runTestKeyEntries(t, cache)
+	cache.Clear()
+	runTestMaxDecompressedSize(t, cache)
+	cache.Clear()
+	runTestMaxValueBytes(t, cache)
+	cache.Clear()
+	runTestHas(t, cache)
+	cache.Clear()
+	runTestAdaptiveCompression(t, cache)
+	cache.Clear()
+	runTestMustGet(t, cache)
+	cache.Clear()
+	runTestCacheObjectWithMeta(t, cache)
+	cache.Clear()
+	runTestCacheMode(t, cache)
+	cache.Clear()
+	runTestCompressionContext(t, cache)
+	cache.Clear()
+	runTestWrapMeta(t, cache)
+	cache.Clear()
+	runTestIterate(t, cache)
+	cache.Clear()
+	runTestCacheWithTTL(t, cache)
+	cache.Clear()
+	runTestPoisonedEntries(t, cache)
+	cache.Clear()
+	runTestInvalidatePrefix(t, cache)
+	cache.Clear()
+	runTestCleanupBatch(t, cache)
+	cache.Clear()
+	runTestForceCleanup(t, cache)
+	cache.Clear()
+	runTestGetManyBatches(t, cache)
+	cache.Clear()
+	expireAllEntries := func() {
+		db.Exec("UPDATE cachefunk_sqlite_entries SET timestamp = 0")
+	}
+	runTestCacheFuncTTL(t, cache, expireAllEntries)
+}
+
+func TestSQLiteCacheContext(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal("failed to connect database")
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	cache, err := cachefunk.NewSQLiteCache(db)
+	if err != nil {
+		t.Fatal("failed to create cache:", err)
+	}
+	runTestContextCache(t, cache)
+}
+
+func TestSQLiteCacheSharedDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	gormDB, err := gorm.Open(sqlite.Open(path), &gorm.Config{})
+	if err != nil {
+		t.Fatal("failed to connect database")
+	}
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal("failed to connect database")
+	}
+	defer db.Close()
+
+	// the caches use separate tables in the same database, so neither reuses the schema of another
+	gormCache := cachefunk.NewGORMCache(gormDB)
+	defer gormCache.Close()
+	sqliteCache, err := cachefunk.NewSQLiteCache(db)
+	if err != nil {
+		t.Fatal("failed to create cache:", err)
+	}
+	otherCache, err := cachefunk.NewSQLiteCache(db, cachefunk.WithSQLiteTableName("other entries"))
+	if err != nil {
+		t.Fatal("failed to create cache:", err)
+	}
+
+	caches := []cachefunk.Cache{gormCache, sqliteCache, otherCache}
+	for i, cache := range caches {
+		cache.SetConfig(&cachefunk.CacheFunkConfig{
+			Configs: map[string]*cachefunk.KeyConfig{
+				"hello": {TTL: 60},
+			},
+		})
+		cache.Set("hello", "world", []byte{byte('a' + i)})
+	}
+	for i, cache := range caches {
+		if value, found := cache.Get("hello", "world"); !found || string(value) != string(rune('a'+i)) {
+			t.Errorf("cache %d: expected %q got %q (found %v)", i, string(rune('a'+i)), value, found)
+		}
+		if count := cache.EntryCount(); count != 1 {
+			t.Errorf("cache %d: expected %d entry got %d", i, 1, count)
+		}
+	}
+}
+
+func TestSQLiteCacheGetManyError(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal("failed to connect database")
+	}
+	db.SetMaxOpenConns(1)
+
+	cache, err := cachefunk.NewSQLiteCache(db)
+	if err != nil {
+		t.Fatal("failed to create cache:", err)
+	}
+	observer := &recordingObserver{}
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 60},
+		},
+		Observer: observer,
+	})
+	db.Close()
+
+	if values := cache.GetMany("hello", []string{"bob", "clark"}); len(values) != 0 {
+		t.Errorf("expected no values got %d", len(values))
+	}
+	if len(observer.events) != 1 || observer.events[0] != "get error hello" {
+		t.Errorf("expected a get error to be reported got %v", observer.events)
+	}
+}
+
+func TestSQLiteCacheClearPrefixCaseSensitive(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal("failed to connect database")
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	cache, err := cachefunk.NewSQLiteCache(db)
+	if err != nil {
+		t.Fatal("failed to create cache:", err)
+	}
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"User:profile": {TTL: 60},
+		},
+	})
+	cache.Set("User:profile", "bob", []byte("1"))
+
+	// LIKE in SQLite ignores case, but prefixes must not
+	if err := cachefunk.InvalidatePrefix(cache, "user:"); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, found := cache.Get("User:profile", "bob"); !found {
+		t.Error("expected key differing in case from the prefix to be kept")
+	}
+}
@@ -0,0 +1,74 @@
+package cachefunk
+
+import (
+	"bytes"
+	"io"
+)
+
+// StreamCache is implemented by caches that can store and load values
+// without buffering them in memory
+type StreamCache interface {
+	// Set a value in the cache by reading it from r
+	SetStream(key string, params string, r io.Reader) error
+	// Get a reader for a value in the cache if it exists
+	GetStream(key string, params string) (io.ReadCloser, bool)
+}
+
+// SetStream sets a value in the cache by reading it from r
+// Caches that do not implement StreamCache buffer the value in memory
+func SetStream(cache Cache, key string, params string, r io.Reader) error {
+	if streamCache, ok := cache.(StreamCache); ok {
+		return streamCache.SetStream(key, params, r)
+	}
+	value, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	cache.Set(key, params, value)
+	return nil
+}
+
+// GetStream returns a reader for a value in the cache if it exists
+// Caches that do not implement StreamCache buffer the value in memory
+func GetStream(cache Cache, key string, params string) (io.ReadCloser, bool) {
+	if streamCache, ok := cache.(StreamCache); ok {
+		return streamCache.GetStream(key, params)
+	}
+	value, found := cache.Get(key, params)
+	if !found {
+		return nil, false
+	}
+	return io.NopCloser(bytes.NewReader(value)), true
+}
+
+// sizeLimitReader fails with ErrDecompressedSizeExceeded once more than limit bytes are read
+type sizeLimitReader struct {
+	reader io.Reader
+	limit  int64
+	read   int64
+}
+
+func (r *sizeLimitReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.read += int64(n)
+	if r.read > r.limit {
+		return n, ErrDecompressedSizeExceeded
+	}
+	return n, err
+}
+
+// streamReadCloser reads from reader and closes each of closers in order
+type streamReadCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *streamReadCloser) Close() error {
+	var firstErr error
+	for _, closer := range r.closers {
+		if err := closer.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,132 @@
+package cachefunk_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/rohfle/cachefunk"
+)
+
+// patternReader generates size bytes of a repeating pattern without holding them in memory
+type patternReader struct {
+	size int64
+	read int64
+}
+
+func (r *patternReader) Read(p []byte) (int, error) {
+	if r.read >= r.size {
+		return 0, io.EOF
+	}
+	if remaining := r.size - r.read; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	for i := range p {
+		p[i] = byte((r.read + int64(i)) % 251)
+	}
+	r.read += int64(len(p))
+	return len(p), nil
+}
+
+func TestDiskCacheStreamLargeValue(t *testing.T) {
+	cache := cachefunk.NewDiskCache(t.TempDir())
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"report": {TTL: 60, UseCompression: true},
+		},
+	})
+
+	const size = 50 * 1024 * 1024
+	expected := sha256.New()
+	io.Copy(expected, &patternReader{size: size})
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	if err := cachefunk.SetStream(cache, "report", "params", &patternReader{size: size}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	reader, found := cachefunk.GetStream(cache, "report", "params")
+	if !found {
+		t.Fatal("expected streamed value to be found")
+	}
+	actual := sha256.New()
+	written, err := io.Copy(actual, reader)
+	reader.Close()
+
+	runtime.ReadMemStats(&after)
+
+	if err != nil {
+		t.Fatal("unexpected error reading stream:", err)
+	}
+	if written != size {
+		t.Fatalf("expected %d bytes got %d", size, written)
+	}
+	if !bytes.Equal(actual.Sum(nil), expected.Sum(nil)) {
+		t.Fatal("expected streamed value to match what was written")
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > size/4 {
+		t.Fatalf("expected streaming to allocate well under the value size but allocated %d bytes", allocated)
+	}
+}
+
+func runTestStream(t *testing.T, cache cachefunk.Cache) {
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"plain":      {TTL: 60},
+			"compressed": {TTL: 60, UseCompression: true},
+			"limited":    {TTL: 60, UseCompression: true, MaxDecompressedSize: 10},
+			"discarded":  {TTL: 0},
+		},
+	})
+
+	for _, key := range []string{"plain", "compressed"} {
+		if err := cachefunk.SetStream(cache, key, "streamed", strings.NewReader("hello stream")); err != nil {
+			t.Fatalf("%s: unexpected error: %s", key, err)
+		}
+		if value, found := cache.Get(key, "streamed"); !found || string(value) != "hello stream" {
+			t.Errorf("%s: expected Get of streamed value got \"%s\" (found %v)", key, value, found)
+		}
+
+		cache.Set(key, "set", []byte("hello set"))
+		reader, found := cachefunk.GetStream(cache, key, "set")
+		if !found {
+			t.Fatalf("%s: expected GetStream of set value to be found", key)
+		}
+		value, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil || string(value) != "hello set" {
+			t.Errorf("%s: expected GetStream of set value got \"%s\" (err %v)", key, value, err)
+		}
+	}
+
+	if _, found := cachefunk.GetStream(cache, "plain", "missing"); found {
+		t.Error("expected missing value to not be found")
+	}
+
+	cachefunk.SetStream(cache, "discarded", "streamed", strings.NewReader("hello stream"))
+	if _, found := cachefunk.GetStream(cache, "discarded", "streamed"); found {
+		t.Error("expected value with TTL 0 to be discarded")
+	}
+
+	cachefunk.SetStream(cache, "limited", "streamed", strings.NewReader("hello stream"))
+	if reader, found := cachefunk.GetStream(cache, "limited", "streamed"); found {
+		_, err := io.ReadAll(reader)
+		reader.Close()
+		if err == nil {
+			t.Error("expected error reading value over MaxDecompressedSize")
+		}
+	}
+}
+
+func TestDiskCacheStream(t *testing.T) {
+	runTestStream(t, cachefunk.NewDiskCache(t.TempDir()))
+}
+
+func TestInMemoryCacheStream(t *testing.T) {
+	runTestStream(t, cachefunk.NewInMemoryCache())
+}
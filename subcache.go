@@ -0,0 +1,221 @@
+package cachefunk
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// SUBCACHE_SEPARATOR joins the Name of a SubCache to its keys in the parent cache
+// It is not a path separator, so sub cache keys are not nested inside a parent key on disk
+const SUBCACHE_SEPARATOR = "~"
+
+// SubCache is a namespace within another Cache with its own config.
+// Keys are stored in the parent cache as Name + SUBCACHE_SEPARATOR + key, so many sub caches
+// can share one storage without their entries or configs colliding.
+// Keys used directly in the parent cache should not start with Name + SUBCACHE_SEPARATOR.
+// Key configs are copied into the parent config when a key is first used,
+// so call SetConfig again after changing the config of a key.
+type SubCache struct {
+	Parent      Cache
+	Name        string
+	CacheConfig *CacheFunkConfig
+	// keys are the keys configured or used in this sub cache, registered in registeredConfig
+	keys             map[string]struct{}
+	registeredConfig *CacheFunkConfig
+	mutex            sync.RWMutex
+}
+
+func NewSubCache(parent Cache, name string) *SubCache {
+	cache := SubCache{
+		Parent: parent,
+		Name:   name,
+		keys:   make(map[string]struct{}),
+	}
+	return &cache
+}
+
+func (c *SubCache) fullKey(key string) string {
+	return c.Name + SUBCACHE_SEPARATOR + key
+}
+
+// register makes sure the config for key has been copied into the parent config under the full key
+// so the parent cache applies this sub cache's config to its entries
+// Keys are only copied the first time they are used, or again if the parent config is replaced
+func (c *SubCache) register(key string) string {
+	fullKey := c.fullKey(key)
+	c.mutex.RLock()
+	_, registered := c.keys[key]
+	current := registered && c.registeredConfig != nil && c.registeredConfig == c.Parent.GetConfig()
+	c.mutex.RUnlock()
+	if current {
+		return fullKey
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.keys[key] = struct{}{}
+	if c.registeredConfig != c.Parent.GetConfig() {
+		// the parent config was replaced so every key needs copying into the new one
+		c.registerAll()
+	} else {
+		c.registerKey(key)
+	}
+	return fullKey
+}
+
+// registerAll copies the config of every key into the parent config, the mutex must be held
+func (c *SubCache) registerAll() {
+	for key := range c.keys {
+		c.registerKey(key)
+	}
+}
+
+// registerKey copies the config for key into the parent config, the mutex must be held
+func (c *SubCache) registerKey(key string) {
+	keyConfig := DEFAULT_KEYCONFIG
+	if c.CacheConfig != nil {
+		keyConfig = c.CacheConfig.Get(key)
+	}
+
+	parentConfig := c.Parent.GetConfig()
+	if parentConfig == nil {
+		parentConfig = &CacheFunkConfig{}
+		c.Parent.SetConfig(parentConfig)
+	}
+	parentConfig.Set(c.fullKey(key), keyConfig)
+	c.registeredConfig = parentConfig
+}
+
+// registeredKeys returns the keys configured or used in this sub cache
+func (c *SubCache) registeredKeys() []string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	keys := make([]string, 0, len(c.keys))
+	for key := range c.keys {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (c *SubCache) SetConfig(config *CacheFunkConfig) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.CacheConfig = config
+	if config != nil {
+		for key := range config.KeyConfigs() {
+			c.keys[key] = struct{}{}
+		}
+	}
+	c.registerAll()
+}
+
+func (c *SubCache) GetConfig() *CacheFunkConfig {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.CacheConfig
+}
+
+func (c *SubCache) GetIgnoreCacheCtxKey() interface{} {
+	return c.Parent.GetIgnoreCacheCtxKey()
+}
+
+func (c *SubCache) Get(key string, params string) ([]byte, bool) {
+	return c.Parent.Get(c.register(key), params)
+}
+
+func (c *SubCache) GetWithInfo(key string, params string) ([]byte, EntryInfo, bool) {
+	return c.Parent.GetWithInfo(c.register(key), params)
+}
+
+func (c *SubCache) GetMany(key string, paramsList []string) map[string][]byte {
+	return c.Parent.GetMany(c.register(key), paramsList)
+}
+
+func (c *SubCache) Set(key string, params string, value []byte) {
+	c.Parent.Set(c.register(key), params, value)
+}
+
+func (c *SubCache) SetMany(key string, values map[string][]byte) {
+	c.Parent.SetMany(c.register(key), values)
+}
+
+func (c *SubCache) SetRaw(key string, params string, value []byte, timestamp time.Time, isCompressed bool) {
+	c.Parent.SetRaw(c.register(key), params, value, timestamp, isCompressed)
+}
+
+func (c *SubCache) KeyEntries(key string) []EntryInfo {
+	return c.Parent.KeyEntries(c.fullKey(key))
+}
+
+// Iterate visits entries in the parent cache that belong to this sub cache, with the Name prefix removed
+func (c *SubCache) Iterate(fn func(key string, params string, timestamp time.Time) bool) error {
+	prefix := c.fullKey("")
+	return c.Parent.Iterate(func(key string, params string, timestamp time.Time) bool {
+		if !strings.HasPrefix(key, prefix) {
+			return true
+		}
+		return fn(strings.TrimPrefix(key, prefix), params, timestamp)
+	})
+}
+
+// EntryCount counts entries for keys that have been configured or used in this sub cache
+func (c *SubCache) EntryCount() int64 {
+	var count int64
+	for _, key := range c.registeredKeys() {
+		count += int64(len(c.KeyEntries(key)))
+	}
+	return count
+}
+
+// ExpiredEntryCount counts expired entries for keys that have been configured or used in this sub cache
+func (c *SubCache) ExpiredEntryCount() int64 {
+	var count int64
+	now := c.Parent.GetConfig().Now()
+	for _, key := range c.registeredKeys() {
+		config := c.Parent.GetConfig().Get(c.register(key))
+		cutoff := config.GetExpireTime(now)
+		for _, entry := range c.KeyEntries(key) {
+			if entry.Timestamp.Before(cutoff) {
+				count += 1
+			}
+		}
+	}
+	return count
+}
+
+// Clear deletes entries for keys that have been configured or used in this sub cache
+func (c *SubCache) Clear() {
+	for _, key := range c.registeredKeys() {
+		c.ClearKey(key)
+	}
+}
+
+func (c *SubCache) ClearKey(key string) {
+	c.Parent.ClearKey(c.fullKey(key))
+}
+
+func (c *SubCache) Delete(key string, params string) {
+	c.Parent.Delete(c.fullKey(key), params)
+}
+
+// Cleanup runs Cleanup on the parent cache, which also removes
+// expired entries belonging to the parent and other sub caches
+func (c *SubCache) Cleanup() {
+	c.Parent.Cleanup()
+}
+
+func (c *SubCache) CleanupWithResult() CleanupResult {
+	return c.Parent.CleanupWithResult()
+}
+
+// CleanupBatch runs CleanupBatch on the parent cache, which like Cleanup
+// may also remove expired entries belonging to the parent and other sub caches
+func (c *SubCache) CleanupBatch(maxDeletes int) CleanupResult {
+	return CleanupBatch(c.Parent, maxDeletes)
+}
+
+// ForceCleanup runs ForceCleanup on the parent cache for the key in this sub cache
+func (c *SubCache) ForceCleanup(key string, maxAge time.Duration) CleanupResult {
+	return ForceCleanup(c.Parent, c.fullKey(key), maxAge)
+}
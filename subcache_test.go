@@ -0,0 +1,206 @@
+package cachefunk_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rohfle/cachefunk"
+)
+
+func TestSubCache(t *testing.T) {
+	cache := cachefunk.NewSubCache(cachefunk.NewInMemoryCache(), "sub")
+
+	runTestWrapString(t, cache)
+	cache.Clear()
+	runTestWrapStringWithContext(t, cache)
+	cache.Clear()
+	runTestWrapObject(t, cache)
+	cache.Clear()
+	runTestWrapObjectWithContext(t, cache)
+	cache.Clear()
+	runTestCacheFuncErrorsReturned(t, cache)
+	cache.Clear()
+	runTestCacheObjectMany(t, cache)
+	cache.Clear()
+	runTestSetMany(t, cache)
+	cache.Clear()
+	runTestKeyEntries(t, cache)
+	cache.Clear()
+	runTestIterate(t, cache)
+	cache.Clear()
+
+	// sub cache keys are separate directories on disk
+	cache = cachefunk.NewSubCache(cachefunk.NewDiskCache(t.TempDir()), "sub")
+	runTestIterate(t, cache)
+}
+
+func TestSubCacheIsolation(t *testing.T) {
+	parent := cachefunk.NewInMemoryCache()
+	parent.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 60},
+		},
+	})
+	first := cachefunk.NewSubCache(parent, "first")
+	first.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 60},
+		},
+	})
+	second := cachefunk.NewSubCache(parent, "second")
+	second.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 0},
+		},
+	})
+
+	parent.Set("hello", "params", []byte("parent"))
+	first.Set("hello", "params", []byte("first"))
+	second.Set("hello", "params", []byte("second"))
+
+	if value, _ := parent.Get("hello", "params"); string(value) != "parent" {
+		t.Errorf("expected parent value got \"%s\"", value)
+	}
+	if value, _ := first.Get("hello", "params"); string(value) != "first" {
+		t.Errorf("expected first value got \"%s\"", value)
+	}
+	// second has TTL 0 so its value is discarded
+	if _, found := second.Get("hello", "params"); found {
+		t.Error("expected second value to be discarded")
+	}
+	if count := parent.EntryCount(); count != 2 {
+		t.Fatalf("expected %d entries in parent got %d", 2, count)
+	}
+	if count := first.EntryCount(); count != 1 {
+		t.Fatalf("expected %d entries in first got %d", 1, count)
+	}
+
+	first.SetRaw("hello", "old", []byte("old"), time.Time{}, false)
+	if count := first.ExpiredEntryCount(); count != 1 {
+		t.Fatalf("expected %d expired entry in first got %d", 1, count)
+	}
+	first.Cleanup()
+	if count := first.EntryCount(); count != 1 {
+		t.Fatalf("expected %d entries in first after cleanup got %d", 1, count)
+	}
+
+	first.Clear()
+	if count := first.EntryCount(); count != 0 {
+		t.Fatalf("expected %d entries in first after clear got %d", 0, count)
+	}
+	if count := parent.EntryCount(); count != 1 {
+		t.Fatalf("expected %d entries in parent after first clear got %d", 1, count)
+	}
+}
+
+func TestSubCacheConcurrent(t *testing.T) {
+	cache := cachefunk.NewSubCache(cachefunk.NewReadMostlyCache(), "sub")
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 60},
+		},
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprint("key", i%2)
+			for j := 0; j < 100; j++ {
+				cache.Set(key, fmt.Sprint(j), []byte("value"))
+				cache.Get(key, fmt.Sprint(j))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// replacing the parent config registers the sub cache keys again
+	cache.Parent.SetConfig(&cachefunk.CacheFunkConfig{})
+	cache.Set("hello", "params", []byte("value"))
+	if config := cache.Parent.GetConfig().Get("sub" + cachefunk.SUBCACHE_SEPARATOR + "hello"); config.TTL != 60 {
+		t.Errorf("expected key config to be registered in replaced parent config got TTL %d", config.TTL)
+	}
+}
+
+func TestSubCacheDiskParentKey(t *testing.T) {
+	parent := cachefunk.NewDiskCache(t.TempDir())
+	parent.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"sub": {TTL: 60},
+		},
+	})
+	cache := cachefunk.NewSubCache(parent, "sub")
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 60},
+		},
+	})
+
+	parent.Set("sub", "params", []byte("parent"))
+	cache.Set("hello", "params", []byte("sub"))
+
+	// sub cache keys are not nested inside the parent key, so clearing it leaves them alone
+	parent.ClearKey("sub")
+	cachefunk.ForceCleanup(parent, "sub", 0)
+	if value, found := cache.Get("hello", "params"); !found || string(value) != "sub" {
+		t.Errorf("expected sub cache value to be kept got %q (found %v)", value, found)
+	}
+	if count := parent.EntryCount(); count != 1 {
+		t.Errorf("expected %d entry left got %d", 1, count)
+	}
+}
+
+func TestSubCacheDiskParentCleanup(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	parent := cachefunk.NewDiskCache(t.TempDir())
+	cache := cachefunk.NewSubCache(parent, "sub")
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 60},
+		},
+		Clock: func() time.Time { return now },
+	})
+
+	cache.SetRaw("hello", "old", []byte("old"), now.Add(-time.Hour), false)
+	if result := cachefunk.CleanupBatch(cache, 10); result.Removed != 1 || len(result.Errors) != 0 {
+		t.Errorf("expected %d expired entry removed got %+v", 1, result)
+	}
+
+	cache.Set("hello", "params", []byte("value"))
+	if result := cachefunk.ForceCleanup(cache, "hello", 0); result.Removed != 1 || len(result.Errors) != 0 {
+		t.Errorf("expected %d entry removed got %+v", 1, result)
+	}
+	if _, found := cache.Get("hello", "params"); found {
+		t.Error("expected entry to be removed by ForceCleanup")
+	}
+	if count := cache.EntryCount(); count != 0 {
+		t.Errorf("expected %d entries got %d", 0, count)
+	}
+}
+
+// plainCache hides the optional cleanup interfaces of the cache it wraps
+type plainCache struct {
+	cachefunk.Cache
+}
+
+func TestForceCleanupUnconfirmedDeletes(t *testing.T) {
+	disk := cachefunk.NewDiskCache(t.TempDir())
+	disk.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 60},
+		},
+	})
+	disk.Set("hello", "params", []byte("value"))
+
+	// DiskCache iterates file names that Delete cannot find, so nothing is removed or counted
+	result := cachefunk.ForceCleanup(plainCache{disk}, "hello", 0)
+	if result.Removed != 0 {
+		t.Errorf("expected deletes that removed nothing not to be counted got %d", result.Removed)
+	}
+	if count := disk.EntryCount(); count != 1 {
+		t.Errorf("expected %d entry got %d", 1, count)
+	}
+}
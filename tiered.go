@@ -0,0 +1,161 @@
+package cachefunk
+
+import "time"
+
+// TieredCache is a LayeredCache where faster tiers hold copies of values from slower ones,
+// such as an InMemoryCache in front of a GORMCache.
+// A value found in a later tier is promoted into every earlier writable tier,
+// so following reads are served without reaching the later tier.
+// Values are promoted decompressed with the timestamp of the tier they were found in,
+// so tiers may use different compression and a promoted copy expires with the original.
+// The last tier is treated as the one holding every entry, so KeyEntries, Iterate,
+// EntryCount and ExpiredEntryCount only report the entries in the last tier.
+type TieredCache struct {
+	LayeredCache
+	// WriteTiers are the tiers that Set, SetMany and SetRaw write to, every writable tier if nil
+	WriteTiers []Cache
+}
+
+func NewTieredCache(tiers ...Cache) *TieredCache {
+	cache := TieredCache{
+		LayeredCache: LayeredCache{Layers: tiers},
+	}
+	return &cache
+}
+
+// writeTiers returns the tiers written to by Set, SetMany and SetRaw
+func (c *TieredCache) writeTiers() []Cache {
+	if c.WriteTiers != nil {
+		return c.WriteTiers
+	}
+	var tiers []Cache
+	for _, tier := range c.Layers {
+		if !isReadOnly(tier) {
+			tiers = append(tiers, tier)
+		}
+	}
+	return tiers
+}
+
+// promote copies a value found in tier index into the writable tiers before it
+func (c *TieredCache) promote(index int, key string, params string, value []byte, timestamp time.Time) {
+	for _, tier := range c.Layers[:index] {
+		if isReadOnly(tier) {
+			continue
+		}
+		if timestamp.IsZero() {
+			// values stored at an unknown time, such as those in an embed.FS, are stored fresh
+			tier.Set(key, params, value)
+		} else {
+			tier.SetRaw(key, params, value, timestamp, false)
+		}
+	}
+}
+
+func (c *TieredCache) Get(key string, params string) ([]byte, bool) {
+	value, _, found := c.GetWithInfo(key, params)
+	return value, found
+}
+
+// GetWithInfo returns the value from the first tier that has it, promoting it into earlier tiers
+func (c *TieredCache) GetWithInfo(key string, params string) ([]byte, EntryInfo, bool) {
+	var expired EntryInfo
+	for index, tier := range c.Layers {
+		value, info, found := tier.GetWithInfo(key, params)
+		if found {
+			c.promote(index, key, params, value, info.Timestamp)
+			return value, info, true
+		}
+		if expired.Timestamp.IsZero() {
+			expired = info
+		}
+	}
+	return nil, expired, false
+}
+
+// GetMany asks each tier in turn for the params still missing, promoting the values found
+// GetMany does not know when values were stored, so promoted copies are stored fresh
+func (c *TieredCache) GetMany(key string, paramsList []string) map[string][]byte {
+	values := make(map[string][]byte, len(paramsList))
+	missing := paramsList
+	for index, tier := range c.Layers {
+		if len(missing) == 0 {
+			break
+		}
+		var next []string
+		found := tier.GetMany(key, missing)
+		for _, params := range missing {
+			if value, ok := found[params]; ok {
+				values[params] = value
+				c.promote(index, key, params, value, time.Time{})
+			} else {
+				next = append(next, params)
+			}
+		}
+		missing = next
+	}
+	return values
+}
+
+// last returns the tier holding every entry
+func (c *TieredCache) last() Cache {
+	return c.Layers[len(c.Layers)-1]
+}
+
+func (c *TieredCache) KeyEntries(key string) []EntryInfo {
+	if len(c.Layers) == 0 {
+		return nil
+	}
+	return c.last().KeyEntries(key)
+}
+
+func (c *TieredCache) Iterate(fn func(key string, params string, timestamp time.Time) bool) error {
+	if len(c.Layers) == 0 {
+		return nil
+	}
+	return c.last().Iterate(fn)
+}
+
+func (c *TieredCache) EntryCount() int64 {
+	if len(c.Layers) == 0 {
+		return 0
+	}
+	return c.last().EntryCount()
+}
+
+func (c *TieredCache) ExpiredEntryCount() int64 {
+	if len(c.Layers) == 0 {
+		return 0
+	}
+	return c.last().ExpiredEntryCount()
+}
+
+func (c *TieredCache) Set(key string, params string, value []byte) {
+	tiers := c.writeTiers()
+	if len(tiers) == 0 {
+		c.GetConfig().notifySetError(key, ErrReadOnly)
+	}
+	for _, tier := range tiers {
+		tier.Set(key, params, value)
+	}
+}
+
+func (c *TieredCache) SetMany(key string, values map[string][]byte) {
+	tiers := c.writeTiers()
+	if len(tiers) == 0 {
+		c.GetConfig().notifySetError(key, ErrReadOnly)
+	}
+	for _, tier := range tiers {
+		tier.SetMany(key, values)
+	}
+}
+
+func (c *TieredCache) SetRaw(key string, params string, value []byte, timestamp time.Time, isCompressed bool) {
+	tiers := c.writeTiers()
+	if len(tiers) == 0 {
+		c.GetConfig().notifySetError(key, ErrReadOnly)
+	}
+	for _, tier := range tiers {
+		tier.SetRaw(key, params, value, timestamp, isCompressed)
+	}
+}
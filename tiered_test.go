@@ -0,0 +1,134 @@
+package cachefunk_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rohfle/cachefunk"
+)
+
+// spyCache counts the reads that reach the wrapped cache
+type spyCache struct {
+	cachefunk.Cache
+	reads int
+}
+
+func (c *spyCache) Get(key string, params string) ([]byte, bool) {
+	c.reads += 1
+	return c.Cache.Get(key, params)
+}
+
+func (c *spyCache) GetWithInfo(key string, params string) ([]byte, cachefunk.EntryInfo, bool) {
+	c.reads += 1
+	return c.Cache.GetWithInfo(key, params)
+}
+
+func (c *spyCache) GetMany(key string, paramsList []string) map[string][]byte {
+	c.reads += 1
+	return c.Cache.GetMany(key, paramsList)
+}
+
+func TestTieredCache(t *testing.T) {
+	cache := cachefunk.NewTieredCache(cachefunk.NewInMemoryCache(), cachefunk.NewReadMostlyCache())
+
+	runTestWrapString(t, cache)
+	cache.Clear()
+	runTestWrapObject(t, cache)
+	cache.Clear()
+	runTestCacheFuncErrorsReturned(t, cache)
+	cache.Clear()
+	runTestCacheObjectMany(t, cache)
+	cache.Clear()
+	runTestSetMany(t, cache)
+	cache.Clear()
+	runTestGetOrSet(t, cache)
+	cache.Clear()
+	runTestHas(t, cache)
+	cache.Clear()
+	runTestCacheObjectWithMeta(t, cache)
+	cache.Clear()
+	runTestKeyEntries(t, cache)
+	cache.Clear()
+	runTestIterate(t, cache)
+	cache.Clear()
+}
+
+func TestTieredCachePromotion(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	l1 := cachefunk.NewInMemoryCache()
+	l2 := &spyCache{Cache: cachefunk.NewInMemoryCache()}
+	cache := cachefunk.NewTieredCache(l1, l2)
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 60},
+		},
+		Clock: func() time.Time { return now },
+	})
+	// the second tier compresses values while the first does not
+	l2.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 60, UseCompression: true},
+		},
+		Clock: func() time.Time { return now },
+	})
+	stored := now
+	l2.Set("hello", "bob", []byte("from l2"))
+	l2.Set("hello", "clark", []byte("many"))
+	now = now.Add(30 * time.Second)
+
+	tests := []struct {
+		Params   string
+		Expected string
+		L2Reads  int
+	}{
+		{"bob", "from l2", 1},
+		{"bob", "from l2", 1},
+		{"missing", "", 2},
+	}
+	for line, test := range tests {
+		value, _ := cache.Get("hello", test.Params)
+		if string(value) != test.Expected || l2.reads != test.L2Reads {
+			t.Errorf("subtest %d: expected %q after %d reads of l2 got %q after %d reads", line+1, test.Expected, test.L2Reads, value, l2.reads)
+		}
+	}
+
+	value, info, found := l1.GetWithInfo("hello", "bob")
+	if !found || string(value) != "from l2" {
+		t.Fatalf("expected value to be promoted into l1 got %q", value)
+	}
+	if !info.Timestamp.Equal(stored) || info.IsCompressed {
+		t.Errorf("expected promoted value to be uncompressed with timestamp %s got %s compressed %v", stored, info.Timestamp, info.IsCompressed)
+	}
+
+	values := cache.GetMany("hello", []string{"clark"})
+	cache.GetMany("hello", []string{"clark"})
+	if string(values["clark"]) != "many" || l2.reads != 3 {
+		t.Errorf("expected GetMany to promote after %d reads of l2 got %q after %d reads", 3, values["clark"], l2.reads)
+	}
+
+	cache.Clear()
+	if l1.EntryCount() != 0 || l2.EntryCount() != 0 {
+		t.Errorf("expected clear to empty every tier got %d and %d entries", l1.EntryCount(), l2.EntryCount())
+	}
+}
+
+func TestTieredCacheWriteTiers(t *testing.T) {
+	l1 := cachefunk.NewInMemoryCache()
+	l2 := cachefunk.NewInMemoryCache()
+	cache := cachefunk.NewTieredCache(l1, l2)
+	cache.WriteTiers = []cachefunk.Cache{l2}
+	cache.SetConfig(&cachefunk.CacheFunkConfig{
+		Configs: map[string]*cachefunk.KeyConfig{
+			"hello": {TTL: 60},
+		},
+	})
+
+	cache.Set("hello", "bob", []byte("1"))
+	if l1.EntryCount() != 0 || l2.EntryCount() != 1 {
+		t.Errorf("expected set to only write l2 got %d and %d entries", l1.EntryCount(), l2.EntryCount())
+	}
+	cache.Get("hello", "bob")
+	if l1.EntryCount() != 1 {
+		t.Errorf("expected read to promote into l1 got %d entries", l1.EntryCount())
+	}
+}
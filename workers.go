@@ -0,0 +1,25 @@
+package cachefunk
+
+// goWorker runs fn in a new goroutine unless MaxWorkers goroutines started by goWorker are
+// already running, reporting whether it did. Callers decide what to do with work that is not started:
+// resolvers and DiskCache.GetMany reads run it in the calling goroutine, so cache calls nested inside
+// a resolver cannot deadlock waiting for a worker, and AutoCleanupCache skips the cleanup until next time.
+func (c *CacheFunkConfig) goWorker(fn func()) bool {
+	if c == nil || c.MaxWorkers <= 0 {
+		go fn()
+		return true
+	}
+	c.workersOnce.Do(func() {
+		c.workers = make(chan struct{}, c.MaxWorkers)
+	})
+	select {
+	case c.workers <- struct{}{}:
+		go func() {
+			defer func() { <-c.workers }()
+			fn()
+		}()
+		return true
+	default:
+		return false
+	}
+}